@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"pegasus/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SECRET_ENV      = "PEGASUS_CLUSTER_SECRET"
+	SECRET_FILE_ENV = "PEGASUS_CLUSTER_SECRET_FILE"
+	// Set to 1 to run without auth, such as on a dev box
+	DISABLED_ENV = "PEGASUS_AUTH_DISABLED"
+
+	HEADER_TIMESTAMP = "X-Pegasus-Timestamp"
+	HEADER_NONCE     = "X-Pegasus-Nonce"
+	HEADER_SIGNATURE = "X-Pegasus-Signature"
+	// Key given to worker by master, covered by the signature
+	HEADER_WORKER_KEY = "X-Pegasus-Worker-Key"
+
+	MAX_CLOCK_SKEW = 5 * time.Minute
+	NONCE_TTL      = 2 * MAX_CLOCK_SKEW
+	NONCE_LEN      = 16
+	// Bodies beyond are refused before the signature is checked
+	MAX_BODY_SIZE = 256 * 1024 * 1024
+)
+
+var secret = new(clusterSecret)
+
+type clusterSecret struct {
+	once     sync.Once
+	key      []byte
+	disabled bool
+}
+
+func (s *clusterSecret) load() {
+	s.once.Do(func() {
+		key := os.Getenv(SECRET_ENV)
+		if fpath := os.Getenv(SECRET_FILE_ENV); key == "" && fpath != "" {
+			buf, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				panic(fmt.Errorf("Fail to read cluster secret from %q, %v", fpath, err))
+			}
+			key = strings.TrimSpace(string(buf))
+		}
+		if key == "" && os.Getenv(DISABLED_ENV) == "1" {
+			log.Error("Request auth disabled by $%s", DISABLED_ENV)
+			s.disabled = true
+			return
+		} else if key == "" {
+			log.Error("Cluster secret not set in $%s or $%s, requests other than public "+
+				"ones are rejected, set $%s=1 to disable auth", SECRET_ENV, SECRET_FILE_ENV,
+				DISABLED_ENV)
+			return
+		}
+		s.key = []byte(key)
+	})
+}
+
+// Requests are signed only with the secret, and verified unless auth is
+// disabled explicitly.
+func Enabled() bool {
+	secret.load()
+	return secret.key != nil
+}
+
+func Disabled() bool {
+	secret.load()
+	return secret.disabled
+}
+
+var nonces = &nonceCache{seen: make(map[string]time.Time)}
+
+type nonceCache struct {
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// Return false if the nonce was already used within NONCE_TTL.
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.lastPrune) > NONCE_TTL/2 {
+		for n, expire := range c.seen {
+			if now.After(expire) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastPrune = now
+	}
+	if expire, ok := c.seen[nonce]; ok && now.Before(expire) {
+		return false
+	}
+	c.seen[nonce] = now.Add(NONCE_TTL)
+	return true
+}
+
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Headers signed besides the timestamp and nonce, each appended as
+// "name:value" only if set, so that signing stays the same without them.
+var signedHeaders = []string{HEADER_WORKER_KEY}
+
+func sign(method, requestUri, ts, nonce string, body []byte, header http.Header) string {
+	parts := []string{method, requestUri, ts, nonce, hashBody(body)}
+	for _, name := range signedHeaders {
+		if v := header.Get(name); v != "" {
+			parts = append(parts, strings.ToLower(name)+":"+v)
+		}
+	}
+	mac := hmac.New(sha256.New, secret.key)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newNonce() (string, error) {
+	buf := make([]byte, NONCE_LEN)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Sign the outgoing request, body should be the exact bytes sent.
+func SignRequest(req *http.Request, body []byte) error {
+	if !Enabled() {
+		return nil
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return fmt.Errorf("Fail to generate nonce, %v", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HEADER_TIMESTAMP, ts)
+	req.Header.Set(HEADER_NONCE, nonce)
+	req.Header.Set(HEADER_SIGNATURE,
+		sign(req.Method, req.URL.RequestURI(), ts, nonce, body, req.Header))
+	return nil
+}
+
+// Verify the signature of incoming request, the body is restored so that
+// handlers could still read it.
+func VerifyRequest(r *http.Request) error {
+	if Disabled() {
+		return nil
+	} else if !Enabled() {
+		return fmt.Errorf("Cluster secret not set, request rejected")
+	}
+	ts, nonce := r.Header.Get(HEADER_TIMESTAMP), r.Header.Get(HEADER_NONCE)
+	signature := r.Header.Get(HEADER_SIGNATURE)
+	if ts == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("Request not signed")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp %q", ts)
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew > MAX_CLOCK_SKEW || skew < -MAX_CLOCK_SKEW {
+		return fmt.Errorf("Request timestamp skew %v too large", skew)
+	}
+	body := []byte{}
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(io.LimitReader(r.Body, MAX_BODY_SIZE+1)); err != nil {
+			return fmt.Errorf("Fail to read request body, %v", err)
+		}
+		if len(body) > MAX_BODY_SIZE {
+			return fmt.Errorf("Request body over %d bytes", MAX_BODY_SIZE)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	}
+	expected := sign(r.Method, r.RequestURI, ts, nonce, body, r.Header)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("Signature mismatch")
+	}
+	if !nonces.add(nonce, now) {
+		return fmt.Errorf("Replayed request, nonce %q", nonce)
+	}
+	return nil
+}
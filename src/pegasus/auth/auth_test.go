@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func resetSecret(env map[string]string) {
+	for _, key := range []string{SECRET_ENV, SECRET_FILE_ENV, DISABLED_ENV} {
+		os.Unsetenv(key)
+	}
+	for key, val := range env {
+		os.Setenv(key, val)
+	}
+	secret = new(clusterSecret)
+}
+
+func newSignedRequest(t *testing.T, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/cfg/revision?x=1", bytes.NewBufferString(body))
+	if err := SignRequest(req, []byte(body)); err != nil {
+		t.Fatalf("Fail to sign, %v", err)
+	}
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	defer resetSecret(nil)
+
+	resetSecret(nil)
+	if err := VerifyRequest(newSignedRequest(t, "{}")); err == nil {
+		t.Fatalf("Verify without cluster secret, expect rejected")
+	}
+
+	resetSecret(map[string]string{DISABLED_ENV: "1"})
+	if err := VerifyRequest(newSignedRequest(t, "{}")); err != nil {
+		t.Fatalf("Verify with auth disabled, %v", err)
+	}
+
+	resetSecret(map[string]string{SECRET_ENV: "s3cret"})
+	req := newSignedRequest(t, "{}")
+	if err := VerifyRequest(req); err != nil {
+		t.Fatalf("Fail to verify signed request, %v", err)
+	}
+	if err := VerifyRequest(req); err == nil {
+		t.Fatalf("Verify replayed request, expect rejected")
+	}
+	req = newSignedRequest(t, "{}")
+	req.Body = http.NoBody
+	if err := VerifyRequest(req); err == nil {
+		t.Fatalf("Verify request with body changed, expect rejected")
+	}
+	unsigned := httptest.NewRequest(http.MethodGet, "/cfg/revision", nil)
+	if err := VerifyRequest(unsigned); err == nil {
+		t.Fatalf("Verify unsigned request, expect rejected")
+	}
+}
+
+// Worker key in the header can't be swapped, added or dropped once signed.
+func TestVerifyWorkerKey(t *testing.T) {
+	defer resetSecret(nil)
+	resetSecret(map[string]string{SECRET_ENV: "s3cret"})
+	signWithKey := func(key string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/worker/hb", bytes.NewBufferString("{}"))
+		if key != "" {
+			req.Header.Set(HEADER_WORKER_KEY, key)
+		}
+		if err := SignRequest(req, []byte("{}")); err != nil {
+			t.Fatalf("Fail to sign, %v", err)
+		}
+		return req
+	}
+	if err := VerifyRequest(signWithKey("k1")); err != nil {
+		t.Fatalf("Fail to verify request with worker key, %v", err)
+	}
+	cases := []struct {
+		signed string
+		sent   string
+	}{
+		{"k1", "k2"},
+		{"k1", ""},
+		{"", "k1"},
+	}
+	for _, c := range cases {
+		req := signWithKey(c.signed)
+		req.Header.Set(HEADER_WORKER_KEY, c.sent)
+		if err := VerifyRequest(req); err == nil {
+			t.Fatalf("Verify request signed with key %q sent with %q, expect rejected",
+				c.signed, c.sent)
+		}
+	}
+}
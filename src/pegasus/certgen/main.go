@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CA_CERT_FILE = "ca.pem"
+	CA_KEY_FILE  = "ca-key.pem"
+	ORGANIZATION = "Pegasus"
+)
+
+var (
+	dir   = flag.String("dir", "./certs", "directory for generated certs")
+	name  = flag.String("name", "node", "node cert name, written as <name>.pem and <name>-key.pem")
+	hosts = flag.String("hosts", "127.0.0.1,localhost", "comma separated IPs and DNS names of the node")
+	days  = flag.Int("days", 365, "validity in days")
+)
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePem(fpath, typ string, der []byte, perm os.FileMode) error {
+	buf := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(fpath, buf, perm); err != nil {
+		return fmt.Errorf("Fail to write %s, %v", fpath, err)
+	}
+	fmt.Printf("Write %s\n", fpath)
+	return nil
+}
+
+func writeKeyPair(certPath, keyPath string, certDer []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("Fail to marshal key, %v", err)
+	}
+	if err := writePem(keyPath, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePem(certPath, "CERTIFICATE", certDer, 0644)
+}
+
+func readPem(fpath, typ string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("No %s found in %s", typ, fpath)
+	}
+	return block.Bytes, nil
+}
+
+func loadCa(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certDer, err := readPem(certPath, "CERTIFICATE")
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Fail to parse %s, %v", certPath, err)
+	}
+	keyDer, err := readPem(keyPath, "EC PRIVATE KEY")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Fail to parse %s, %v", keyPath, err)
+	}
+	return cert, key, nil
+}
+
+func createCa(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{ORGANIZATION},
+			CommonName:   ORGANIZATION + " Cluster CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, *days),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Fail to create CA cert, %v", err)
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// Reuse the CA in dir if there is one, so that all nodes share it.
+func loadOrCreateCa() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(*dir, CA_CERT_FILE)
+	keyPath := filepath.Join(*dir, CA_KEY_FILE)
+	if _, err := os.Stat(certPath); err == nil {
+		fmt.Printf("Use CA %s\n", certPath)
+		return loadCa(certPath, keyPath)
+	}
+	return createCa(certPath, keyPath)
+}
+
+func createNodeCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{ORGANIZATION},
+			CommonName:   *name,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.AddDate(0, 0, *days),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range strings.Split(*hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("Fail to create cert for %s, %v", *name, err)
+	}
+	return writeKeyPair(filepath.Join(*dir, *name+".pem"),
+		filepath.Join(*dir, *name+"-key.pem"), der, key)
+}
+
+func main() {
+	flag.Parse()
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to create %s, %v\n", *dir, err)
+		os.Exit(1)
+	}
+	ca, caKey, err := loadOrCreateCa()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to prepare CA, %v\n", err)
+		os.Exit(1)
+	}
+	if err := createNodeCert(ca, caKey); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,20 +1,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"pegasus/cfgmgr"
+	"pegasus/db"
 	"pegasus/log"
+	"pegasus/pki"
 	"pegasus/route"
 	"pegasus/server"
 	"pegasus/uri"
 	"pegasus/util"
 	"pegasus/workgroup"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var cfgFpath = "./cfg.json"
+// Under data dir of bootstrap cfg
+var cfgFpath = "cfg.json"
+var auditFpath = "cfg_audit.log"
+var snapshotDir = "cfgdata/revisions"
+var leaderDir = "cfgdata/leader"
+
+const AUTHOR_HEADER = "X-Pegasus-Author"
 
 func getCfg(cfgPath string) (interface{}, error) {
 	return cfgmgr.GetCfg(cfgPath)
@@ -28,11 +40,166 @@ func getCfgHandler(w http.ResponseWriter, r *http.Request) {
 	server.FmtResp(w, err, s)
 }
 
+// CN of the client cert under mTLS. Otherwise the header is advisory only,
+// any node holding the cluster secret could claim any author.
+func getAuthor(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if cn := r.TLS.PeerCertificates[0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	if author := r.Header.Get(AUTHOR_HEADER); author != "" {
+		return author
+	}
+	return r.RemoteAddr
+}
+
+func auditCfgHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	limit := 0
+	if s := r.Form.Get(uri.CfgLimitKey); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			server.FmtResp(w, fmt.Errorf("Invalid limit %q, %v", s, err), nil)
+			return
+		}
+	}
+	recs := cfgmgr.GetAuditRecs(r.Form.Get(uri.CfgPathKey), limit)
+	server.FmtResp(w, nil, recs)
+}
+
+func putCfgHandler(w http.ResponseWriter, r *http.Request) {
+	cfgPath := mux.Vars(r)["cfgPath"]
+	log.Info("Update cfg from %s for %s", r.RemoteAddr, cfgPath)
+	body, err := util.HttpReadRequestJsonBody(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	rev, err := cfgmgr.UpdateCfg(cfgPath, body, getAuthor(r))
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	persistCfg()
+	server.FmtResp(w, nil, rev)
+}
+
+// Persist, or the change is lost on next reload of the file
+func persistCfg() {
+	if err := cfgmgr.SaveCfgToJson(cfgFpath); err != nil {
+		log.Error("Fail to save cfg to %s, %v", cfgFpath, err)
+	}
+}
+
+func getRevForm(r *http.Request, key string) (uint64, error) {
+	s := r.Form.Get(key)
+	rev, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s revision %q, %v", key, s, err)
+	}
+	return rev, nil
+}
+
+func listRevsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	limit := 0
+	if s := r.Form.Get(uri.CfgLimitKey); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			server.FmtResp(w, fmt.Errorf("Invalid limit %q, %v", s, err), nil)
+			return
+		}
+	}
+	server.FmtResp(w, nil, cfgmgr.ListRevisions(limit))
+}
+
+// To the current revision if to not given.
+func diffCfgHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	from, err := getRevForm(r, uri.CfgFromKey)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	to := cfgmgr.GetRevision()
+	if r.Form.Get(uri.CfgToKey) != "" {
+		if to, err = getRevForm(r, uri.CfgToKey); err != nil {
+			server.FmtResp(w, err, nil)
+			return
+		}
+	}
+	diffs, err := cfgmgr.DiffRevisions(from, to)
+	server.FmtResp(w, err, diffs)
+}
+
+func rollbackCfgHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	rev, err := getRevForm(r, uri.CfgRevKey)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	log.Info("Roll back cfg from %s to revision %d", r.RemoteAddr, rev)
+	cur, err := cfgmgr.Rollback(rev, getAuthor(r))
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	persistCfg()
+	server.FmtResp(w, nil, cur)
+}
+
+// Long poll, respond once revision differs from the one given, or on
+// timeout with the revision unchanged.
+func watchCfgHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	rev, err := strconv.ParseUint(r.Form.Get(uri.CfgRevKey), 10, 64)
+	if err != nil {
+		server.FmtResp(w, fmt.Errorf("Invalid revision, %v", err), nil)
+		return
+	}
+	timeout := cfgmgr.CFG_WATCH_TIMEOUT
+	if s := r.Form.Get(uri.CfgTimeoutKey); s != "" {
+		if timeout, err = time.ParseDuration(s); err != nil {
+			server.FmtResp(w, fmt.Errorf("Invalid timeout, %v", err), nil)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	cfgmgr.WaitForChange(ctx, rev)
+	snap, err := cfgmgr.SnapshotCfg(r.Form[uri.CfgPathKey])
+	server.FmtResp(w, err, snap)
+}
+
 func flushCfgHandler(w http.ResponseWriter, r *http.Request) {
 	err := cfgmgr.SaveCfgToJson(cfgFpath)
+	if err != nil {
+		err = fmt.Errorf("%w, %v", util.ErrInternal, err)
+	}
 	server.FmtResp(w, err, nil)
 }
 
+func cfgEffectiveHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, cfgmgr.GetCfgOrigins())
+}
+
 func cfgPingHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info("Get ping from %s", r.RemoteAddr)
 	server.FmtResp(w, nil, cfgmgr.PingResp)
@@ -57,6 +224,48 @@ func registerRoutes() {
 		Path:    uri.CfgUriRoot + "{cfgPath}",
 		Handler: getCfgHandler,
 	})
+	route.RegisterRoute(&route.Route{
+		Name:    "putCfgHandler",
+		Method:  http.MethodPut,
+		Path:    uri.CfgUriRoot + "{cfgPath}",
+		Handler: putCfgHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "auditCfgHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CfgAuditUri,
+		Handler: auditCfgHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "listRevsHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CfgRevsUri,
+		Handler: listRevsHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "diffCfgHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CfgDiffUri,
+		Handler: diffCfgHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "rollbackCfgHandler",
+		Method:  http.MethodPost,
+		Path:    uri.CfgRollbackUri,
+		Handler: rollbackCfgHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "cfgEffectiveHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CfgEffectiveUri,
+		Handler: cfgEffectiveHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "watchCfgHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CfgWatchUri,
+		Handler: watchCfgHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "flushCfgHandler",
 		Method:  http.MethodPost,
@@ -68,6 +277,7 @@ func registerRoutes() {
 		Method:  http.MethodGet,
 		Path:    uri.CfgPingUri,
 		Handler: cfgPingHandler,
+		Public:  true,
 	})
 	route.RegisterRoute(&route.Route{
 		Name:    "getMasterAddrHandler",
@@ -76,10 +286,70 @@ func registerRoutes() {
 		Handler: getMasterAddrHandler,
 	})
 	route.RegisterRoute(&route.Route{
-		Name:    "postMasterHandler",
+		Name:    "registerServiceHandler",
 		Method:  http.MethodPost,
-		Path:    uri.CfgMasterUri,
-		Handler: postMasterHandler,
+		Path:    uri.RegistryUri,
+		Handler: registerServiceHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "deregisterServiceHandler",
+		Method:  http.MethodDelete,
+		Path:    uri.RegistryUri,
+		Handler: deregisterServiceHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "listServicesHandler",
+		Method:  http.MethodGet,
+		Path:    uri.RegistryUri,
+		Handler: listServicesHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "renewServiceHandler",
+		Method:  http.MethodPost,
+		Path:    uri.RegistryLeaseUri,
+		Handler: renewServiceHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "watchServicesHandler",
+		Method:  http.MethodGet,
+		Path:    uri.RegistryWatchUri,
+		Handler: watchServicesHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "getLeaderHandler",
+		Method:  http.MethodGet,
+		Path:    uri.LeaderUri,
+		Handler: getLeaderHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "campaignHandler",
+		Method:  http.MethodPost,
+		Path:    uri.LeaderCampaignUri,
+		Handler: campaignHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "getCheckpointHandler",
+		Method:  http.MethodGet,
+		Path:    uri.CheckpointUri,
+		Handler: getCheckpointHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "startCheckpointHandler",
+		Method:  http.MethodPost,
+		Path:    uri.CheckpointUri,
+		Handler: startCheckpointHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "clearCheckpointHandler",
+		Method:  http.MethodDelete,
+		Path:    uri.CheckpointUri,
+		Handler: clearCheckpointHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "addCheckpointReportHandler",
+		Method:  http.MethodPost,
+		Path:    uri.CheckpointReportUri,
+		Handler: addCheckpointReportHandler,
 	})
 	route.RegisterRoute(&route.Route{
 		Name:    "testPost",
@@ -92,20 +362,25 @@ func registerRoutes() {
 		Method:  http.MethodGet,
 		Path:    uri.CfgEchoIpUri,
 		Handler: echoIpHandler,
+		Public:  true,
 	})
 }
 
 func initLogger() error {
+	level, err := log.GetLogLevel(cfgmgr.Bootstrap.LogLevel)
+	if err != nil {
+		return err
+	}
 	consoleLogger := &log.ConsoleLogger{
-		Level: log.LevelInfo,
+		Level: level,
 	}
 	if err := log.RegisterLogger(consoleLogger); err != nil {
 		return err
 	}
 	fileLogger := &log.FileLogger{
-		Path:       "./temp/cfg.log",
+		Path:       filepath.Join(cfgmgr.Bootstrap.LogDir, "cfg.log"),
 		RotateSize: 1024 * 1024,
-		Level:      log.LevelInfo,
+		Level:      level,
 	}
 	if err := log.RegisterLogger(fileLogger); err != nil {
 		return err
@@ -117,6 +392,8 @@ func initLogger() error {
 func registerCfg() {
 	//dummypkg.RegisterCfg()
 	workgroup.RegisterCfg()
+	pki.RegisterCfg()
+	db.RegisterCfg()
 }
 
 func loadCfgFromFile() {
@@ -126,14 +403,40 @@ func loadCfgFromFile() {
 }
 
 func main() {
+	if err := cfgmgr.InitLayers(); err != nil {
+		panic(err)
+	}
+	dataDir := cfgmgr.Bootstrap.DataDir
+	cfgFpath = filepath.Join(dataDir, cfgFpath)
+	if err := cfgmgr.CheckNotLocalCfgFile(cfgFpath); err != nil {
+		panic(err)
+	}
+	auditFpath = filepath.Join(dataDir, auditFpath)
+	snapshotDir = filepath.Join(dataDir, snapshotDir)
+	leaderDir = filepath.Join(dataDir, leaderDir)
 	if err := initLogger(); err != nil {
 		panic(fmt.Errorf("Fail to init logger, %v", err))
 	}
 	registerCfg()
 	registerRoutes()
+	if err := cfgmgr.SetAuditFile(auditFpath); err != nil {
+		panic(err)
+	}
+	if err := cfgmgr.SetSnapshotDir(snapshotDir); err != nil {
+		panic(err)
+	}
+	if err := cfgmgr.SetLeaderDir(leaderDir); err != nil {
+		panic(err)
+	}
 	loadCfgFromFile()
+	if err := pki.Init(); err != nil {
+		panic(err)
+	}
+	cfgmgr.LogCfgOrigins()
+	go cfgmgr.WatchCfgFile(cfgFpath)
+	go cfgmgr.SweepServices()
 	s := new(server.Server)
-	if err := s.ListenAndServe(cfgmgr.CfgServerPort); err != nil {
+	if err := s.ListenAndServe(cfgmgr.Bootstrap.CfgServerBindIP, cfgmgr.CfgServerPort); err != nil {
 		log.Error("Server fault, %v", err)
 	}
 }
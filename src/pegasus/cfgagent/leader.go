@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pegasus/cfgmgr"
+	"pegasus/server"
+	"pegasus/uri"
+	"pegasus/util"
+	"strconv"
+)
+
+func getLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := cfgmgr.GetLeadership()
+	server.FmtResp(w, err, l)
+}
+
+func campaignHandler(w http.ResponseWriter, r *http.Request) {
+	req := new(cfgmgr.Leadership)
+	if err := util.HttpFitRequestInto(r, req); err != nil {
+		server.FmtResp(w, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err), nil)
+		return
+	}
+	l, err := cfgmgr.GrantLeadership(req)
+	server.FmtResp(w, err, l)
+}
+
+func getTokenForm(r *http.Request) (uint64, error) {
+	if err := r.ParseForm(); err != nil {
+		return 0, err
+	}
+	token, err := strconv.ParseUint(r.Form.Get(uri.LeaderTokenKey), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid token, %v", err)
+	}
+	return token, nil
+}
+
+func getCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	ckpt, err := cfgmgr.GetProjCheckpoint()
+	server.FmtResp(w, err, ckpt)
+}
+
+func startCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenForm(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	ckpt := new(cfgmgr.ProjCheckpoint)
+	if err := util.HttpFitRequestInto(r, ckpt); err != nil {
+		server.FmtResp(w, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err), nil)
+		return
+	}
+	ckpt.Token = token
+	server.FmtResp(w, cfgmgr.StartProjCheckpoint(ckpt), nil)
+}
+
+func addCheckpointReportHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenForm(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	body, err := util.HttpReadRequestJsonBody(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	if !json.Valid(body) {
+		server.FmtResp(w, fmt.Errorf("%w, report not valid JSON", util.ErrInvalidSpec), nil)
+		return
+	}
+	err = cfgmgr.AddProjCheckpointReport(token, r.Form.Get(uri.CheckpointKeyKey), body)
+	server.FmtResp(w, err, nil)
+}
+
+func clearCheckpointHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenForm(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	server.FmtResp(w, cfgmgr.ClearProjCheckpoint(token), nil)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/uri"
+	"pegasus/util"
+	"strconv"
+	"time"
+)
+
+// Kept for old clients, the latest master registered.
+func getMasterAddrHandler(w http.ResponseWriter, r *http.Request) {
+	snap := cfgmgr.SnapshotServices(cfgmgr.SERVICE_ROLE_MASTER)
+	if len(snap.Instances) == 0 {
+		server.FmtResp(w, fmt.Errorf("%w, master not registered", util.ErrNotFound), nil)
+		return
+	}
+	server.FmtResp(w, nil, snap.Instances[0].Addr)
+}
+
+func registerServiceHandler(w http.ResponseWriter, r *http.Request) {
+	inst := new(cfgmgr.ServiceInstance)
+	if err := util.HttpFitRequestInto(r, inst); err != nil {
+		server.FmtResp(w, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err), nil)
+		return
+	}
+	log.Info("Register %s service %s from %s", inst.Role, inst.Addr, r.RemoteAddr)
+	reg, err := cfgmgr.AddService(inst)
+	server.FmtResp(w, err, reg)
+}
+
+func renewServiceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	inst, err := cfgmgr.RenewService(r.Form.Get(uri.RegistryIdKey))
+	server.FmtResp(w, err, inst)
+}
+
+func deregisterServiceHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	err := cfgmgr.RemoveService(r.Form.Get(uri.RegistryIdKey))
+	server.FmtResp(w, err, nil)
+}
+
+func listServicesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	server.FmtResp(w, nil, cfgmgr.SnapshotServices(r.Form.Get(uri.RegistryRoleKey)))
+}
+
+func watchServicesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	rev, err := strconv.ParseUint(r.Form.Get(uri.CfgRevKey), 10, 64)
+	if err != nil {
+		server.FmtResp(w, fmt.Errorf("Invalid revision, %v", err), nil)
+		return
+	}
+	timeout := cfgmgr.REGISTRY_WATCH_TIMEOUT
+	if s := r.Form.Get(uri.CfgTimeoutKey); s != "" {
+		if timeout, err = time.ParseDuration(s); err != nil {
+			server.FmtResp(w, fmt.Errorf("Invalid timeout, %v", err), nil)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	cfgmgr.WaitForServiceChange(ctx, rev)
+	server.FmtResp(w, nil, cfgmgr.SnapshotServices(r.Form.Get(uri.RegistryRoleKey)))
+}
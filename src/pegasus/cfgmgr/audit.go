@@ -0,0 +1,107 @@
+package cfgmgr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"pegasus/log"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_MAX_RECS = 1000
+	// Author of changes made by editing cfg file
+	AUTHOR_FILE = "file"
+)
+
+type AuditRec struct {
+	Revision uint64
+	Ts       time.Time
+	Author   string
+	Path     string
+	Old      interface{} `json:",omitempty"`
+	New      interface{}
+}
+
+type auditLog struct {
+	mutex sync.Mutex
+	fpath string
+	recs  []*AuditRec
+}
+
+var audit = new(auditLog)
+
+// Keep audit records in fpath as JSON lines, records already there are
+// loaded so that history survives restart.
+func SetAuditFile(fpath string) error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	audit.fpath = fpath
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Fail to open audit file %s, %v", fpath, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rec := new(AuditRec)
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			log.Error("Skip bad audit record in %s, %v", fpath, err)
+			continue
+		}
+		audit.append(rec)
+	}
+	return scanner.Err()
+}
+
+func (a *auditLog) append(rec *AuditRec) {
+	a.recs = append(a.recs, rec)
+	if len(a.recs) > AUDIT_MAX_RECS {
+		a.recs = a.recs[len(a.recs)-AUDIT_MAX_RECS:]
+	}
+}
+
+func (a *auditLog) record(rec *AuditRec) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.append(rec)
+	log.Info("Cfg %s changed by %s, revision %d", rec.Path, rec.Author, rec.Revision)
+	if a.fpath == "" {
+		return
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Error("Fail to marshal audit record, %v", err)
+		return
+	}
+	f, err := os.OpenFile(a.fpath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error("Fail to open audit file %s, %v", a.fpath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		log.Error("Fail to write audit file %s, %v", a.fpath, err)
+	}
+}
+
+// Latest records first, of all paths if path is empty.
+func GetAuditRecs(path string, limit int) []*AuditRec {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	recs := make([]*AuditRec, 0)
+	for i := len(audit.recs) - 1; i >= 0; i-- {
+		if limit > 0 && len(recs) >= limit {
+			break
+		}
+		if path == "" || audit.recs[i].Path == path {
+			recs = append(recs, audit.recs[i])
+		}
+	}
+	return recs
+}
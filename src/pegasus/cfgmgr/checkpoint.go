@@ -0,0 +1,207 @@
+package cfgmgr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/uri"
+	"pegasus/util"
+	"time"
+)
+
+const CHECKPOINT_FILE = "checkpoint.log"
+
+// Progress of the project running on the leader, for a standby to take
+// over from. Reports are the successful ones, keyed by the task spec they
+// are for, so that tasks done already are not dispatched again.
+type ProjCheckpoint struct {
+	Token    uint64
+	ProjId   string
+	ProjName string
+	Config   string
+	StartTs  time.Time
+	Reports  map[string]json.RawMessage
+}
+
+type checkpointReport struct {
+	Key    string
+	Report json.RawMessage
+}
+
+// Kept as lines of JSON, the project first and then one line per report.
+// Guarded by leader.mutex.
+type projCheckpointStore struct {
+	fpath string
+	ckpt  *ProjCheckpoint
+}
+
+func (s *projCheckpointStore) load(dir string) error {
+	s.fpath = filepath.Join(dir, CHECKPOINT_FILE)
+	s.ckpt = nil
+	f, err := os.Open(s.fpath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Fail to open checkpoint %s, %v", s.fpath, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if s.ckpt == nil {
+			ckpt := new(ProjCheckpoint)
+			if err := json.Unmarshal(scanner.Bytes(), ckpt); err != nil {
+				return fmt.Errorf("Fail to unmarshal checkpoint %s, %v", s.fpath, err)
+			}
+			ckpt.Reports = make(map[string]json.RawMessage)
+			s.ckpt = ckpt
+			continue
+		}
+		rec := new(checkpointReport)
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			// Torn by a crash in the middle of append, the task runs again
+			log.Error("Skip bad report in checkpoint %s, %v", s.fpath, err)
+			continue
+		}
+		s.ckpt.Reports[rec.Key] = rec.Report
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Fail to read checkpoint %s, %v", s.fpath, err)
+	}
+	if s.ckpt != nil {
+		log.Info("Checkpoint of project %q restored, %d reports",
+			s.ckpt.ProjId, len(s.ckpt.Reports))
+	}
+	return nil
+}
+
+func (s *projCheckpointStore) appendLine(v interface{}, flag int) error {
+	if s.fpath == "" {
+		return nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.fpath, flag|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Start the checkpoint of a project, replacing the one before.
+func StartProjCheckpoint(ckpt *ProjCheckpoint) error {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	if err := leader.checkToken(ckpt.Token); err != nil {
+		return err
+	}
+	c := *ckpt
+	c.Reports = make(map[string]json.RawMessage)
+	head := c
+	head.Reports = nil
+	if err := leader.ckpt.appendLine(&head, os.O_CREATE|os.O_TRUNC); err != nil {
+		return fmt.Errorf("%w, fail to save checkpoint, %v", util.ErrInternal, err)
+	}
+	leader.ckpt.ckpt = &c
+	log.Info("Checkpoint of project %q started, token %d", c.ProjId, c.Token)
+	return nil
+}
+
+func AddProjCheckpointReport(token uint64, key string, report json.RawMessage) error {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	if err := leader.checkToken(token); err != nil {
+		return err
+	}
+	ckpt := leader.ckpt.ckpt
+	if ckpt == nil {
+		return fmt.Errorf("%w, no project checkpoint", util.ErrNotFound)
+	}
+	rec := &checkpointReport{Key: key, Report: report}
+	if err := leader.ckpt.appendLine(rec, os.O_APPEND); err != nil {
+		return fmt.Errorf("%w, fail to save checkpoint report, %v", util.ErrInternal, err)
+	}
+	ckpt.Reports[key] = report
+	return nil
+}
+
+// Drop the checkpoint once the project is finished.
+func ClearProjCheckpoint(token uint64) error {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	if err := leader.checkToken(token); err != nil {
+		return err
+	}
+	if leader.ckpt.ckpt == nil {
+		return nil
+	}
+	if leader.ckpt.fpath != "" {
+		if err := os.Remove(leader.ckpt.fpath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%w, fail to remove checkpoint, %v", util.ErrInternal, err)
+		}
+	}
+	log.Info("Checkpoint of project %q cleared", leader.ckpt.ckpt.ProjId)
+	leader.ckpt.ckpt = nil
+	return nil
+}
+
+// ErrNotFound if no project running.
+func GetProjCheckpoint() (*ProjCheckpoint, error) {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	ckpt := leader.ckpt.ckpt
+	if ckpt == nil {
+		return nil, fmt.Errorf("%w, no project checkpoint", util.ErrNotFound)
+	}
+	c := *ckpt
+	c.Reports = make(map[string]json.RawMessage, len(ckpt.Reports))
+	for k, v := range ckpt.Reports {
+		c.Reports[k] = v
+	}
+	return &c, nil
+}
+
+func makeCheckpointUrl(ip, u string, token uint64) *util.HttpUrl {
+	url := makeCfgServerUrl(ip, u)
+	url.Query.Set(uri.LeaderTokenKey, fmt.Sprint(token))
+	return url
+}
+
+func PostProjCheckpoint(ip string, ckpt *ProjCheckpoint) error {
+	_, err := util.HttpPostData(makeCheckpointUrl(ip, uri.CheckpointUri, ckpt.Token), ckpt)
+	return err
+}
+
+func PostProjCheckpointReport(ip string, token uint64, key string, report interface{}) error {
+	u := makeCheckpointUrl(ip, uri.CheckpointReportUri, token)
+	u.Query.Set(uri.CheckpointKeyKey, key)
+	_, err := util.HttpPostData(u, report)
+	return err
+}
+
+func DeleteProjCheckpoint(ip string, token uint64) error {
+	_, err := util.HttpDelete(makeCheckpointUrl(ip, uri.CheckpointUri, token))
+	return err
+}
+
+// ErrNotFound if no project to take over.
+func FetchProjCheckpoint(ip string) (*ProjCheckpoint, error) {
+	s, err := util.HttpGet(makeCfgServerUrl(ip, uri.CheckpointUri))
+	if err != nil {
+		return nil, err
+	}
+	ckpt := new(ProjCheckpoint)
+	if err := json.Unmarshal([]byte(s), ckpt); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal checkpoint, %v", err)
+	}
+	return ckpt, nil
+}
@@ -0,0 +1,365 @@
+package cfgmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func isSimpleType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool:
+		return true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Float32, reflect.Float64:
+		return true
+	case reflect.String:
+		return true
+	}
+	return false
+}
+
+// Simple types, time.Duration, and structs, slices and maps of them. Maps
+// are keyed by string.
+func checkCfgType(t reflect.Type, name string) error {
+	if isSimpleType(t) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous {
+				return fmt.Errorf("%s, embedded field %s not supported", name, f.Name)
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if err := checkCfgType(f.Type, name+"."+f.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		return checkCfgType(t.Elem(), name+"[]")
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("%s, map key %s not string", name, t.Key())
+		}
+		return checkCfgType(t.Elem(), name+"[]")
+	}
+	return fmt.Errorf("%s, type %s not supported", name, t)
+}
+
+func mustCfgStruct(v reflect.Value) {
+	name := v.Type().Name()
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Errorf("%s not a struct", name))
+	}
+	if err := checkCfgType(v.Type(), name); err != nil {
+		panic(err)
+	}
+}
+
+// Name of the field in JSON, empty if skipped.
+func fieldKey(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return ""
+	} else if tag != "" {
+		return tag
+	}
+	return f.Name
+}
+
+func findField(t reflect.Type, key string) int {
+	fold := -1
+	for i := 0; i < t.NumField(); i++ {
+		name := fieldKey(t.Field(i))
+		if name == key {
+			return i
+		} else if fold < 0 && name != "" && strings.EqualFold(name, key) {
+			fold = i
+		}
+	}
+	return fold
+}
+
+func deepCopy(src reflect.Value) reflect.Value {
+	dst := reflect.New(src.Type()).Elem()
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				dst.Field(i).Set(deepCopy(src.Field(i)))
+			}
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			break
+		}
+		dst.Set(reflect.MakeSlice(src.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			dst.Index(i).Set(deepCopy(src.Index(i)))
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			break
+		}
+		dst.Set(reflect.MakeMapWithSize(src.Type(), src.Len()))
+		iter := src.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+	default:
+		dst.Set(src)
+	}
+	return dst
+}
+
+func typeErr(name string, t reflect.Type, in interface{}) error {
+	got := "object"
+	switch in.(type) {
+	case bool:
+		got = "bool"
+	case json.Number:
+		got = "number"
+	case string:
+		got = "string"
+	case []interface{}:
+		got = "array"
+	}
+	return fmt.Errorf("%s, expect %s, get %s", name, t, got)
+}
+
+// Decode in, as decoded by json with UseNumber, into v. Structs are merged
+// field by field, fields not given keep their value. Slices and maps given
+// replace the whole. Unknown fields are refused if strict.
+func decodeValue(in interface{}, v reflect.Value, name string, strict bool) error {
+	if in == nil {
+		return nil
+	}
+	t := v.Type()
+	if t == durationType {
+		switch x := in.(type) {
+		case string:
+			d, err := time.ParseDuration(x)
+			if err != nil {
+				return fmt.Errorf("%s, %v", name, err)
+			}
+			v.SetInt(int64(d))
+			return nil
+		case json.Number:
+			n, err := x.Int64()
+			if err != nil {
+				return fmt.Errorf("%s, %v", name, err)
+			}
+			v.SetInt(n)
+			return nil
+		}
+		return typeErr(name, t, in)
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := in.(bool)
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, ok := in.(json.Number)
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		n, err := strconv.ParseInt(string(x), 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return fmt.Errorf("%s, invalid %s %s", name, t, x)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, ok := in.(json.Number)
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		n, err := strconv.ParseUint(string(x), 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return fmt.Errorf("%s, invalid %s %s", name, t, x)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		x, ok := in.(json.Number)
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		f, err := x.Float64()
+		if err != nil || v.OverflowFloat(f) {
+			return fmt.Errorf("%s, invalid %s %s", name, t, x)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, ok := in.(string)
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		v.SetString(s)
+	case reflect.Struct:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		for key, val := range m {
+			i := findField(t, key)
+			if i < 0 {
+				if strict {
+					return fmt.Errorf("%s, unknown field %q", name, key)
+				}
+				continue
+			}
+			if err := decodeValue(val, v.Field(i), name+"."+t.Field(i).Name, strict); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		a, ok := in.([]interface{})
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		s := reflect.MakeSlice(t, len(a), len(a))
+		for i, val := range a {
+			if err := decodeValue(val, s.Index(i), fmt.Sprintf("%s[%d]", name, i), strict); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		m, ok := in.(map[string]interface{})
+		if !ok {
+			return typeErr(name, t, in)
+		}
+		mv := reflect.MakeMapWithSize(t, len(m))
+		for key, val := range m {
+			elem := reflect.New(t.Elem()).Elem()
+			if err := decodeValue(val, elem, fmt.Sprintf("%s[%q]", name, key), strict); err != nil {
+				return err
+			}
+			mv.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), elem)
+		}
+		v.Set(mv)
+	default:
+		return fmt.Errorf("%s, type %s not supported", name, t)
+	}
+	return nil
+}
+
+// Decode buf over the cfg entry c points to.
+func decodeCfgEntry(buf []byte, c interface{}, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var in interface{}
+	if err := dec.Decode(&in); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(c).Elem()
+	return decodeValue(in, v, v.Type().Name(), strict)
+}
+
+// Same as json, except that durations are written as strings like "1m30s"
+// and fields keep the order of declaration.
+func encodeValue(v reflect.Value) ([]byte, error) {
+	t := v.Type()
+	if t == durationType {
+		return json.Marshal(time.Duration(v.Int()).String())
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		buf := bytes.NewBufferString("{")
+		first := true
+		for i := 0; i < t.NumField(); i++ {
+			key := fieldKey(t.Field(i))
+			if key == "" {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			kb, _ := json.Marshal(key)
+			vb, err := encodeValue(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(kb)
+			buf.WriteByte(':')
+			buf.Write(vb)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		buf := bytes.NewBufferString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			vb, err := encodeValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(vb)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	case reflect.Map:
+		if v.IsNil() {
+			return []byte("null"), nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		buf := bytes.NewBufferString("{")
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			kb, _ := json.Marshal(key.String())
+			vb, err := encodeValue(v.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(kb)
+			buf.WriteByte(':')
+			buf.Write(vb)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(v.Interface())
+}
+
+func encodeConf(c config) (map[string]json.RawMessage, error) {
+	entries := make(map[string]json.RawMessage)
+	for path, cEntry := range c {
+		buf, err := encodeValue(reflect.ValueOf(cEntry).Elem())
+		if err != nil {
+			return nil, fmt.Errorf("Fail to encode %s, %v", path, err)
+		}
+		entries[path] = buf
+	}
+	return entries, nil
+}
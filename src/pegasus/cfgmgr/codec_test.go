@@ -0,0 +1,162 @@
+package cfgmgr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeCfgEntry(t *testing.T) {
+	cases := []struct {
+		name   string
+		buf    string
+		expect func(c *testCfg)
+	}{
+		{"empty", `{}`, func(c *testCfg) {}},
+		{"null", `{"Name": null, "Tags": null}`, func(c *testCfg) {}},
+		{"case folded", `{"cnt": 5}`, func(c *testCfg) { c.Cnt = 5 }},
+		{"nested merge", `{"Nested": {"Addr": "10.0.0.1"}}`, func(c *testCfg) {
+			c.Nested.Addr = "10.0.0.1"
+		}},
+		{"slice replaced", `{"Tags": ["b", "c"]}`, func(c *testCfg) {
+			c.Tags = []string{"b", "c"}
+		}},
+		{"slice emptied", `{"Tags": []}`, func(c *testCfg) { c.Tags = []string{} }},
+		{"map replaced", `{"Labels": {"n": "1"}}`, func(c *testCfg) {
+			c.Labels = map[string]string{"n": "1"}
+		}},
+		{"duration string", `{"Nested": {"Timeout": "1m30s"}}`, func(c *testCfg) {
+			c.Nested.Timeout = 90 * time.Second
+		}},
+		{"duration number", `{"Nested": {"Timeout": 5000000}}`, func(c *testCfg) {
+			c.Nested.Timeout = 5 * time.Millisecond
+		}},
+		{"int8 bounds", `{"Small": -128}`, func(c *testCfg) { c.Small = -128 }},
+	}
+	for _, strict := range []bool{false, true} {
+		for _, tc := range cases {
+			c := loadFromCfgDef(testCfgDef).(*testCfg)
+			if err := decodeCfgEntry([]byte(tc.buf), c, strict); err != nil {
+				t.Fatalf("Fail to decode %s, strict %v, %v", tc.name, strict, err)
+			}
+			expect := loadFromCfgDef(testCfgDef).(*testCfg)
+			tc.expect(expect)
+			if !reflect.DeepEqual(c, expect) {
+				t.Fatalf("Decode %s into %+v, expect %+v", tc.name, c, expect)
+			}
+		}
+	}
+	if !reflect.DeepEqual(testCfgDef.Tags, []string{"a"}) || testCfgDef.Labels["k"] != "v" {
+		t.Fatalf("Default changed by decode, %+v", testCfgDef)
+	}
+}
+
+func TestDecodeCfgEntryErr(t *testing.T) {
+	cases := []struct {
+		name   string
+		buf    string
+		strict bool
+		errStr string
+	}{
+		{"overflow", `{"Small": 128}`, false, "invalid int8 128"},
+		{"fraction", `{"Cnt": 1.5}`, false, "invalid int 1.5"},
+		{"string for int", `{"Cnt": "8"}`, false, "expect int, get string"},
+		{"number for string", `{"Name": 1}`, false, "expect string, get number"},
+		{"object for slice", `{"Tags": {"a": "b"}}`, false, "expect []string, get object"},
+		{"array for struct", `{"Nested": []}`, false, "expect cfgmgr.testNestedCfg, get array"},
+		{"bad element", `{"Tags": ["a", 1]}`, false, "testCfg.Tags[1]"},
+		{"bad map value", `{"Labels": {"k": true}}`, false, `testCfg.Labels["k"]`},
+		{"bad duration", `{"Nested": {"Timeout": "5 parsecs"}}`, false, "testCfg.Nested.Timeout"},
+		{"bool for duration", `{"Nested": {"Timeout": true}}`, false, "get bool"},
+		{"unknown field", `{"Count": 1}`, true, `unknown field "Count"`},
+		{"unknown nested", `{"Nested": {"Port": 80}}`, true, `testCfg.Nested, unknown field "Port"`},
+		{"not object", `[]`, false, "get array"},
+		{"bad json", `{"Cnt": }`, false, "invalid character"},
+	}
+	for _, tc := range cases {
+		c := loadFromCfgDef(testCfgDef).(*testCfg)
+		err := decodeCfgEntry([]byte(tc.buf), c, tc.strict)
+		if err == nil || !strings.Contains(err.Error(), tc.errStr) {
+			t.Fatalf("Decode %s, get %v, expect %q", tc.name, err, tc.errStr)
+		}
+	}
+	// Unknown fields are skipped unless strict, for cfg of newer versions
+	c := loadFromCfgDef(testCfgDef).(*testCfg)
+	if err := decodeCfgEntry([]byte(`{"Count": 1, "Cnt": 3}`), c, false); err != nil || c.Cnt != 3 {
+		t.Fatalf("Decode unknown field not strict, get %+v %v", c, err)
+	}
+}
+
+func TestCheckCfgType(t *testing.T) {
+	type intKeyCfg struct {
+		Ports map[int]string
+	}
+	type embeddedCfg struct {
+		testNestedCfg
+	}
+	type chanCfg struct {
+		Ch chan int
+	}
+	type nestedKeyCfg struct {
+		Groups []map[bool]int
+	}
+	cases := []struct {
+		c      interface{}
+		errStr string
+	}{
+		{intKeyCfg{}, "c.Ports, map key int not string"},
+		{embeddedCfg{}, "c, embedded field testNestedCfg not supported"},
+		{chanCfg{}, "c.Ch, type chan int not supported"},
+		{nestedKeyCfg{}, "c.Groups[], map key bool not string"},
+	}
+	for _, tc := range cases {
+		err := checkCfgType(reflect.TypeOf(tc.c), "c")
+		if err == nil || err.Error() != tc.errStr {
+			t.Fatalf("Check %T, get %v, expect %q", tc.c, err, tc.errStr)
+		}
+	}
+	if err := checkCfgType(reflect.TypeOf(testCfg{}), "c"); err != nil {
+		t.Fatalf("Fail to check testCfg, %v", err)
+	}
+}
+
+func TestEncodeCfgEntry(t *testing.T) {
+	c := &testCfg{
+		Name:   "round\"trip",
+		Cnt:    -3,
+		Small:  127,
+		Tags:   []string{"x", ""},
+		Labels: map[string]string{"z": "1", "a": "2"},
+		Nested: testNestedCfg{Addr: "::1", Timeout: 1500 * time.Millisecond},
+	}
+	buf, err := encodeValue(reflect.ValueOf(c).Elem())
+	if err != nil {
+		t.Fatalf("Fail to encode %+v, %v", c, err)
+	}
+	expect := `{"Name":"round\"trip","Cnt":-3,"Small":127,"Tags":["x",""],` +
+		`"Labels":{"a":"2","z":"1"},"Nested":{"Addr":"::1","Timeout":"1.5s"}}`
+	if string(buf) != expect {
+		t.Fatalf("Encode into %s, expect %s", buf, expect)
+	}
+	cDec := new(testCfg)
+	if err := decodeCfgEntry(buf, cDec, true); err != nil {
+		t.Fatalf("Fail to decode %s, %v", buf, err)
+	}
+	if !reflect.DeepEqual(cDec, c) {
+		t.Fatalf("Round trip into %+v, expect %+v", cDec, c)
+	}
+
+	// Nil slices and maps stay nil
+	buf, err = encodeValue(reflect.ValueOf(testCfg{}))
+	if err != nil {
+		t.Fatalf("Fail to encode zero cfg, %v", err)
+	}
+	cDec = new(testCfg)
+	if err := decodeCfgEntry(buf, cDec, true); err != nil {
+		t.Fatalf("Fail to decode %s, %v", buf, err)
+	}
+	if !reflect.DeepEqual(cDec, new(testCfg)) {
+		t.Fatalf("Round trip zero cfg into %+v", cDec)
+	}
+}
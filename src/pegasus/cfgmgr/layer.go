@@ -0,0 +1,422 @@
+package cfgmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/util"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Layers of cfg from low to high, each one overrides the ones below field
+// by field.
+const (
+	CFG_SRC_DEFAULT = "default"
+	CFG_SRC_SERVER  = "server"
+	CFG_SRC_FILE    = "file"
+	CFG_SRC_ENV     = "env"
+	CFG_SRC_FLAG    = "flag"
+)
+
+const (
+	// Not cfg.json, which is the cfg served by cfg server
+	LOCAL_CFG_FILE     = "./local_cfg.json"
+	LOCAL_CFG_FILE_ENV = "PEGASUS_LOCAL_CFG"
+	// Such as PEGASUS_WORKGROUPCFG_WORKEREXECUTORCNT=4
+	CFG_ENV_PREFIX = "PEGASUS_"
+	// Such as -cfg WorkgroupCfg.WorkerExecutorCnt=4
+	CFG_FLAG_NAME = "cfg"
+)
+
+// Where the value of a field comes from.
+type CfgValueOrigin struct {
+	Entry  string
+	Field  string
+	Value  json.RawMessage
+	Source string
+}
+
+// Override of a field by env or flag, fields of nested structs are given
+// one after another.
+type cfgOverride struct {
+	src    string
+	key    string
+	entry  string
+	fields []string
+	value  string
+}
+
+type layeredEntry struct {
+	c       interface{}
+	cDef    interface{}
+	server  []byte
+	origins map[string]string
+}
+
+var layersMutex sync.Mutex
+var layers = make(map[string]*layeredEntry)
+var localFile = make(map[string]json.RawMessage)
+var overrides []*cfgOverride
+
+type cfgFlagValue []string
+
+func (f *cfgFlagValue) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *cfgFlagValue) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+var cfgFlags cfgFlagValue
+
+func init() {
+	flag.Var(&cfgFlags, CFG_FLAG_NAME,
+		"override cfg field as Entry.Field=value, could be repeated")
+}
+
+func GetLocalCfgFile() string {
+	if fpath := os.Getenv(LOCAL_CFG_FILE_ENV); fpath != "" {
+		return fpath
+	}
+	return LOCAL_CFG_FILE
+}
+
+// Cfg server refuses to serve the local cfg file, which overrides the cfg
+// of the component itself.
+func CheckNotLocalCfgFile(fpath string) error {
+	local := GetLocalCfgFile()
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return fmt.Errorf("Fail to resolve %s, %v", fpath, err)
+	}
+	absLocal, err := filepath.Abs(local)
+	if err != nil {
+		return fmt.Errorf("Fail to resolve %s, %v", local, err)
+	}
+	same := abs == absLocal
+	if fi, err := os.Stat(abs); err == nil {
+		if fiLocal, err := os.Stat(absLocal); err == nil {
+			same = same || os.SameFile(fi, fiLocal)
+		}
+	}
+	if same {
+		return fmt.Errorf("%w, cfg file %s is also the local cfg file, set $%s to another one",
+			util.ErrInvalidSpec, fpath, LOCAL_CFG_FILE_ENV)
+	}
+	return nil
+}
+
+func parseOverride(src, key, value, sep string) *cfgOverride {
+	toks := strings.Split(key, sep)
+	if len(toks) < 2 {
+		return nil
+	}
+	return &cfgOverride{
+		src:    src,
+		key:    key,
+		entry:  toks[0],
+		fields: toks[1:],
+		value:  value,
+	}
+}
+
+// Parse command line, read the local cfg file and env, then resolve the
+// bootstrap cfg. To be called first thing in main, before logger is set
+// up with the resolved level.
+func InitLayers() error {
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	layersMutex.Lock()
+	overrides = nil
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, CFG_ENV_PREFIX) {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		key := strings.TrimPrefix(kv[:i], CFG_ENV_PREFIX)
+		if o := parseOverride(CFG_SRC_ENV, key, kv[i+1:], "_"); o != nil {
+			overrides = append(overrides, o)
+		}
+	}
+	for _, s := range cfgFlags {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			layersMutex.Unlock()
+			return fmt.Errorf("Invalid -%s %q, expect Entry.Field=value", CFG_FLAG_NAME, s)
+		}
+		o := parseOverride(CFG_SRC_FLAG, s[:i], s[i+1:], ".")
+		if o == nil {
+			layersMutex.Unlock()
+			return fmt.Errorf("Invalid -%s %q, expect Entry.Field=value", CFG_FLAG_NAME, s)
+		}
+		overrides = append(overrides, o)
+	}
+	layersMutex.Unlock()
+	if err := SetLocalCfgFile(GetLocalCfgFile()); err != nil {
+		return err
+	}
+	if err := RegisterLayeredCfg(Bootstrap, BootstrapDef); err != nil {
+		return err
+	}
+	// Brackets of IPv6 are fine to give
+	ip, err := util.ParseHost(Bootstrap.CfgServerIP)
+	if err != nil {
+		return fmt.Errorf("Invalid CfgServerIP, %v", err)
+	}
+	Bootstrap.CfgServerIP = ip
+	CfgServerPort = Bootstrap.CfgServerPort
+	return nil
+}
+
+// Entries of the file are taken as the local layer, a missing file is the
+// same as an empty one.
+func SetLocalCfgFile(fpath string) error {
+	c := make(map[string]json.RawMessage)
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Fail to read local cfg %s, %v", fpath, err)
+	} else if err == nil {
+		if err := json.Unmarshal(buf, &c); err != nil {
+			return fmt.Errorf("Fail to unmarshal local cfg %s, %v", fpath, err)
+		}
+	}
+	layersMutex.Lock()
+	defer layersMutex.Unlock()
+	localFile = c
+	return nil
+}
+
+// Generic value of the override as decoded by json, nested in the fields
+// it goes through.
+func (o *cfgOverride) toGeneric(t reflect.Type) (interface{}, error) {
+	keys := make([]string, 0, len(o.fields))
+	for _, name := range o.fields {
+		if t.Kind() != reflect.Struct || t == durationType {
+			return nil, fmt.Errorf("%s %s, %s not a struct", o.src, o.key, t)
+		}
+		i := findField(t, name)
+		if i < 0 {
+			return nil, fmt.Errorf("%s %s, unknown field %q", o.src, o.key, name)
+		}
+		keys = append(keys, fieldKey(t.Field(i)))
+		t = t.Field(i).Type
+	}
+	var in interface{}
+	switch {
+	case t == durationType || t.Kind() == reflect.String:
+		in = o.value
+	case t.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(o.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s, %v", o.src, o.key, err)
+		}
+		in = b
+	case isSimpleType(t):
+		in = json.Number(o.value)
+	default:
+		dec := json.NewDecoder(bytes.NewReader([]byte(o.value)))
+		dec.UseNumber()
+		if err := dec.Decode(&in); err != nil {
+			return nil, fmt.Errorf("%s %s, %v", o.src, o.key, err)
+		}
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		in = map[string]interface{}{keys[i]: in}
+	}
+	return in, nil
+}
+
+// Fields given by in, nested structs down to their fields.
+func recordOrigins(in interface{}, t reflect.Type, prefix, src string,
+	origins map[string]string) {
+	m, ok := in.(map[string]interface{})
+	if !ok || t.Kind() != reflect.Struct || t == durationType {
+		return
+	}
+	for key, val := range m {
+		i := findField(t, key)
+		if i < 0 {
+			continue
+		}
+		f := t.Field(i)
+		name := f.Name
+		if prefix != "" {
+			name = prefix + "." + f.Name
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			recordOrigins(val, f.Type, name, src, origins)
+		} else {
+			origins[name] = src
+		}
+	}
+}
+
+func decodeGeneric(buf []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var in interface{}
+	err := dec.Decode(&in)
+	return in, err
+}
+
+// Under layersMutex.
+func (le *layeredEntry) resolve(path string) (interface{}, map[string]string, error) {
+	c := loadFromCfgDef(le.cDef)
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	origins := make(map[string]string)
+	apply := func(in interface{}, src string, strict bool) error {
+		if err := decodeValue(in, v, t.Name(), strict); err != nil {
+			return fmt.Errorf("Fail to apply %s layer of %s, %v", src, path, err)
+		}
+		recordOrigins(in, t, "", src, origins)
+		return nil
+	}
+	for _, layer := range []struct {
+		src string
+		buf []byte
+	}{
+		{CFG_SRC_SERVER, le.server},
+		{CFG_SRC_FILE, localFile[path]},
+	} {
+		if layer.buf == nil {
+			continue
+		}
+		in, err := decodeGeneric(layer.buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Fail to decode %s layer of %s, %v",
+				layer.src, path, err)
+		}
+		if err := apply(in, layer.src, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Env before flags, as overrides are parsed in that order
+	for _, o := range overrides {
+		if !strings.EqualFold(o.entry, t.Name()) {
+			continue
+		}
+		in, err := o.toGeneric(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := apply(in, o.src, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, ok := cfgSchema[path]; ok {
+		if err := validateCfgEntry(path, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c, origins, nil
+}
+
+// Resolve c from the layers now and whenever it's pulled from cfg server,
+// cDef being the compiled default.
+func RegisterLayeredCfg(c interface{}, cDef interface{}) error {
+	mustPtr(c, cDef)
+	v := reflect.ValueOf(c).Elem()
+	mustSame(v, reflect.ValueOf(cDef).Elem())
+	mustCfgStruct(v)
+	path := composeCfgEntryPath(v)
+	layersMutex.Lock()
+	defer layersMutex.Unlock()
+	if _, ok := layers[path]; ok {
+		panic(fmt.Errorf("Cfg entry %s already layered", path))
+	}
+	le := &layeredEntry{c: c, cDef: cDef}
+	cNew, origins, err := le.resolve(path)
+	if err != nil {
+		return err
+	}
+	copyCfgEntry(reflect.ValueOf(cNew), reflect.ValueOf(c))
+	le.origins = origins
+	layers[path] = le
+	return nil
+}
+
+// Resolve into cNew with buf as the server layer, false if path not layered.
+// The server layer is kept only if resolved fine.
+func resolveWithServer(path string, buf []byte, cNew interface{}) (bool, error) {
+	layersMutex.Lock()
+	defer layersMutex.Unlock()
+	le, ok := layers[path]
+	if !ok {
+		return false, nil
+	}
+	server := le.server
+	le.server = buf
+	c, origins, err := le.resolve(path)
+	if err != nil {
+		le.server = server
+		return true, err
+	}
+	copyCfgEntry(reflect.ValueOf(c), reflect.ValueOf(cNew))
+	le.origins = origins
+	return true, nil
+}
+
+func collectOrigins(entry string, v reflect.Value, prefix string,
+	origins map[string]string, out *[]*CfgValueOrigin) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if fieldKey(f) == "" {
+			continue
+		}
+		name := f.Name
+		if prefix != "" {
+			name = prefix + "." + f.Name
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			collectOrigins(entry, v.Field(i), name, origins, out)
+			continue
+		}
+		src, ok := origins[name]
+		if !ok {
+			src = CFG_SRC_DEFAULT
+		}
+		buf, err := encodeValue(v.Field(i))
+		if err != nil {
+			buf = nil
+		}
+		*out = append(*out, &CfgValueOrigin{entry, name, buf, src})
+	}
+}
+
+// Effective values of layered entries and where each comes from, sorted by
+// entry and field.
+func GetCfgOrigins() []*CfgValueOrigin {
+	layersMutex.Lock()
+	defer layersMutex.Unlock()
+	paths := make([]string, 0, len(layers))
+	for path := range layers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	out := make([]*CfgValueOrigin, 0)
+	for _, path := range paths {
+		le := layers[path]
+		collectOrigins(path, reflect.ValueOf(le.c).Elem(), "", le.origins, &out)
+	}
+	return out
+}
+
+func LogCfgOrigins() {
+	for _, o := range GetCfgOrigins() {
+		log.Info("Cfg %s %s = %s, from %s", o.Entry, o.Field, o.Value, o.Source)
+	}
+}
@@ -0,0 +1,118 @@
+package cfgmgr
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"pegasus/util"
+)
+
+var testLayeredCfg = new(testCfg)
+var testLayeredOnce sync.Once
+
+func writeTestFile(t *testing.T, fpath, content string) {
+	if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatalf("Fail to write %s, %v", fpath, err)
+	}
+}
+
+// File layer on top of the server layer, field by field.
+func TestResolveLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfglayers")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := registerTestCfg()
+	fpath := filepath.Join(dir, "local_cfg.json")
+	writeTestFile(t, fpath, `{"`+path+`": {"Cnt": 7, "Nested": {"Timeout": "3s"}}}`)
+	if err := SetLocalCfgFile(fpath); err != nil {
+		t.Fatalf("Fail to set local cfg file, %v", err)
+	}
+	defer SetLocalCfgFile(filepath.Join(dir, "missing.json"))
+	testLayeredOnce.Do(func() {
+		if err := RegisterLayeredCfg(testLayeredCfg, testCfgDef); err != nil {
+			t.Fatalf("Fail to register layered cfg, %v", err)
+		}
+	})
+
+	cNew := new(testCfg)
+	server := `{"Name": "srv", "Cnt": 5, "Nested": {"Addr": "10.0.0.1", "Timeout": "1m"}}`
+	if ok, err := resolveWithServer(path, []byte(server), cNew); !ok || err != nil {
+		t.Fatalf("Fail to resolve with server layer, %v %v", ok, err)
+	}
+	expect := loadFromCfgDef(testCfgDef).(*testCfg)
+	expect.Name, expect.Cnt = "srv", 7
+	expect.Nested = testNestedCfg{Addr: "10.0.0.1", Timeout: 3 * time.Second}
+	if !reflect.DeepEqual(cNew, expect) {
+		t.Fatalf("Resolve into %+v, expect %+v", cNew, expect)
+	}
+	sources := map[string]string{
+		"Name":           CFG_SRC_SERVER,
+		"Cnt":            CFG_SRC_FILE,
+		"Small":          CFG_SRC_DEFAULT,
+		"Tags":           CFG_SRC_DEFAULT,
+		"Nested.Addr":    CFG_SRC_SERVER,
+		"Nested.Timeout": CFG_SRC_FILE,
+	}
+	for _, o := range GetCfgOrigins() {
+		if o.Entry != path {
+			continue
+		}
+		if src, ok := sources[o.Field]; ok && src != o.Source {
+			t.Fatalf("Get %s from %s, expect %s", o.Field, o.Source, src)
+		}
+	}
+
+	// Server layer failing validation is refused, the last good one kept
+	_, err = resolveWithServer(path, []byte(`{"Name": ""}`), new(testCfg))
+	if !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Resolve with invalid server layer, get %v, expect invalid", err)
+	}
+	layersMutex.Lock()
+	kept := string(layers[path].server)
+	layersMutex.Unlock()
+	if kept != server {
+		t.Fatalf("Get server layer %s after refused one, expect %s", kept, server)
+	}
+}
+
+func TestCheckNotLocalCfgFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfglayers")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Fail to get working dir, %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Fail to change dir, %v", err)
+	}
+	defer os.Chdir(wd)
+
+	// Data dir "." of cfg server
+	if err := CheckNotLocalCfgFile(filepath.Join(".", "cfg.json")); err != nil {
+		t.Fatalf("Cfg file refused with default local cfg file, %v", err)
+	}
+	os.Setenv(LOCAL_CFG_FILE_ENV, "./cfg.json")
+	defer os.Unsetenv(LOCAL_CFG_FILE_ENV)
+	if err := CheckNotLocalCfgFile("cfg.json"); !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Check cfg file same as local one, get %v, expect invalid", err)
+	}
+	writeTestFile(t, "cfg.json", "{}")
+	if err := os.Symlink(filepath.Join(dir, "cfg.json"), "link.json"); err != nil {
+		t.Fatalf("Fail to link, %v", err)
+	}
+	os.Setenv(LOCAL_CFG_FILE_ENV, "link.json")
+	if err := CheckNotLocalCfgFile(filepath.Join(dir, "cfg.json")); !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Check cfg file linked as local one, get %v, expect invalid", err)
+	}
+}
@@ -0,0 +1,262 @@
+package cfgmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/uri"
+	"pegasus/util"
+	"sync"
+	"time"
+)
+
+const (
+	LEADER_DEF_LEASE = 10 * time.Second
+	LEADER_FILE      = "leader.json"
+)
+
+// Lease of leadership granted by cfg server. Token is bumped whenever
+// leadership is granted anew, so that requests of a former leader could
+// be told and refused.
+type Leadership struct {
+	Holder  string
+	Addr    string
+	Token   uint64
+	LeaseMs int64
+	Expire  time.Time
+}
+
+type leaderStore struct {
+	mutex sync.Mutex
+	dir   string
+	// Latest token granted, kept in dir so that it never goes back
+	token uint64
+	cur   *Leadership
+	ckpt  *projCheckpointStore
+}
+
+var leader = &leaderStore{ckpt: new(projCheckpointStore)}
+
+// Keep tokens and project checkpoints in dir, restored on start along with
+// the holder of the latest token.
+func SetLeaderDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Fail to create leader dir %s, %v", dir, err)
+	}
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	leader.dir = dir
+	buf, err := ioutil.ReadFile(filepath.Join(dir, LEADER_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Fail to read leader token, %v", err)
+	} else if err == nil {
+		l := new(Leadership)
+		if err := json.Unmarshal(buf, l); err != nil {
+			return fmt.Errorf("Fail to unmarshal leader token, %v", err)
+		}
+		leader.token = l.Token
+		leader.restore(l)
+	}
+	if err := leader.ckpt.load(dir); err != nil {
+		return err
+	}
+	log.Info("Leader token %d restored from %s", leader.token, dir)
+	return nil
+}
+
+// Under leader.mutex. The holder could be alive and renewing, so it's given
+// a full lease from now before anyone else could take over, renewals are
+// not saved.
+func (s *leaderStore) restore(l *Leadership) {
+	if l.Holder == "" {
+		return
+	}
+	lease := time.Duration(l.LeaseMs) * time.Millisecond
+	if lease == 0 {
+		lease = LEADER_DEF_LEASE
+	}
+	if expire := time.Now().Add(lease); l.Expire.Before(expire) {
+		l.Expire = expire
+	}
+	s.cur = l
+	log.Info("Leadership of %s(%s) restored, token %d", l.Holder, l.Addr, l.Token)
+}
+
+// Under leader.mutex
+func (s *leaderStore) saveToken(l *Leadership) error {
+	if s.dir == "" {
+		return nil
+	}
+	buf, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, LEADER_FILE), buf)
+}
+
+// Under leader.mutex, ErrConflict unless token is the latest granted.
+func (s *leaderStore) checkToken(token uint64) error {
+	if token != s.token {
+		return fmt.Errorf("%w, token %d fenced by %d", util.ErrConflict, token, s.token)
+	}
+	return nil
+}
+
+// Grant leadership to req.Holder if no one else holds it, or renew it if
+// held by req.Holder already, the token is kept then. Respond with the current leadership either
+// way, the candidate tells by Holder and Token.
+func GrantLeadership(req *Leadership) (*Leadership, error) {
+	if req.Holder == "" {
+		return nil, fmt.Errorf("%w, leader holder missing", util.ErrInvalidSpec)
+	}
+	lease := time.Duration(req.LeaseMs) * time.Millisecond
+	if lease == 0 {
+		lease = LEADER_DEF_LEASE
+	} else if lease < REGISTRY_MIN_LEASE || lease > REGISTRY_MAX_LEASE {
+		return nil, fmt.Errorf("%w, lease %v out of [%v, %v]", util.ErrInvalidSpec,
+			lease, REGISTRY_MIN_LEASE, REGISTRY_MAX_LEASE)
+	}
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	now := time.Now()
+	cur := leader.cur
+	if cur != nil && cur.Holder == req.Holder && cur.Token == leader.token {
+		// Renew even if just expired, no one else is granted since
+		cur.Expire = now.Add(lease)
+		l := *cur
+		return &l, nil
+	}
+	if cur != nil && now.Before(cur.Expire) {
+		l := *cur
+		return &l, nil
+	}
+	l := &Leadership{
+		Holder:  req.Holder,
+		Addr:    req.Addr,
+		Token:   leader.token + 1,
+		LeaseMs: int64(lease / time.Millisecond),
+		Expire:  now.Add(lease),
+	}
+	if err := leader.saveToken(l); err != nil {
+		return nil, fmt.Errorf("%w, fail to save leader token, %v", util.ErrInternal, err)
+	}
+	leader.token = l.Token
+	leader.cur = l
+	log.Info("Leadership granted to %s(%s), token %d", l.Holder, l.Addr, l.Token)
+	c := *l
+	return &c, nil
+}
+
+// ErrNotFound if no leader or the lease expired.
+func GetLeadership() (*Leadership, error) {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	if leader.cur == nil || time.Now().After(leader.cur.Expire) {
+		return nil, fmt.Errorf("%w, no leader", util.ErrNotFound)
+	}
+	l := *leader.cur
+	return &l, nil
+}
+
+// Leadership held by a component, renewed at a third of the lease.
+type LeaderLease struct {
+	ip    string
+	req   *Leadership
+	token uint64
+	lost  chan struct{}
+}
+
+// Campaign gives up by the deadline of ctx, which should be well within
+// the renewal interval, lest a hanging cfg server holds renewal up.
+func campaign(ctx context.Context, ip string, req *Leadership) (*Leadership, error) {
+	s, err := util.HttpPostDataContext(ctx, makeCfgServerUrl(ip, uri.LeaderCampaignUri), req)
+	if err != nil {
+		return nil, err
+	}
+	l := new(Leadership)
+	if err := json.Unmarshal([]byte(s), l); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal leadership, %v", err)
+	}
+	return l, nil
+}
+
+// Campaign on the cfg server at ip until leadership is granted to holder,
+// standing by as long as someone else holds it.
+func WaitForLeadership(ip, holder, addr string) *LeaderLease {
+	req := &Leadership{
+		Holder:  holder,
+		Addr:    addr,
+		LeaseMs: int64(LEADER_DEF_LEASE / time.Millisecond),
+	}
+	interval := LEADER_DEF_LEASE / 3
+	standby := ""
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), LEADER_DEF_LEASE/4)
+		l, err := campaign(ctx, ip, req)
+		cancel()
+		if err != nil {
+			log.Error("Fail to campaign for leader, %v", err)
+		} else if l.Holder == holder {
+			log.Info("Become leader, token %d", l.Token)
+			lease := &LeaderLease{ip: ip, req: req, token: l.Token, lost: make(chan struct{})}
+			go lease.renew(start)
+			return lease
+		} else if l.Holder != standby {
+			standby = l.Holder
+			log.Info("Stand by, leader is %s(%s), token %d", l.Holder, l.Addr, l.Token)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Lost once another holder is granted, or the lease is not renewed in time,
+// in which case a standby could have taken over already. A renewal counts
+// from when it is sent, and one not answered by the lease expiry fails.
+func (l *LeaderLease) renew(renewed time.Time) {
+	lease := time.Duration(l.req.LeaseMs) * time.Millisecond
+	for {
+		expire := renewed.Add(lease)
+		if wait := time.Until(expire); wait < lease/3 {
+			time.Sleep(wait)
+		} else {
+			time.Sleep(lease / 3)
+		}
+		start := time.Now()
+		deadline := start.Add(lease / 4)
+		if expire.Before(deadline) {
+			deadline = expire
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		cur, err := campaign(ctx, l.ip, l.req)
+		cancel()
+		if err == nil && cur.Holder == l.req.Holder && cur.Token == l.token {
+			renewed = start
+			continue
+		}
+		if err == nil {
+			log.Error("Leadership of token %d lost to %s, token %d",
+				l.token, cur.Holder, cur.Token)
+		} else if time.Since(renewed) < lease {
+			log.Error("Fail to renew leadership, %v", err)
+			continue
+		} else {
+			log.Error("Fail to renew leadership within %v, %v", lease, err)
+		}
+		close(l.lost)
+		return
+	}
+}
+
+func (l *LeaderLease) Token() uint64 {
+	return l.token
+}
+
+// Closed once leadership is lost, the holder should stop acting as leader.
+func (l *LeaderLease) Lost() <-chan struct{} {
+	return l.lost
+}
@@ -0,0 +1,247 @@
+package cfgmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pegasus/uri"
+	"pegasus/util"
+)
+
+// Keep the leader token in a temp dir, with no one holding leadership.
+func setTestLeaderDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cfgleader")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir, %v", err)
+	}
+	leader.mutex.Lock()
+	leader.token, leader.cur = 0, nil
+	leader.mutex.Unlock()
+	if err := SetLeaderDir(dir); err != nil {
+		t.Fatalf("Fail to set leader dir, %v", err)
+	}
+	return func() {
+		leader.mutex.Lock()
+		leader.dir, leader.token, leader.cur = "", 0, nil
+		leader.ckpt = new(projCheckpointStore)
+		leader.mutex.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+func mustGrant(t *testing.T, holder string) *Leadership {
+	l, err := GrantLeadership(&Leadership{Holder: holder, Addr: holder + ":9000"})
+	if err != nil {
+		t.Fatalf("Fail to campaign as %s, %v", holder, err)
+	}
+	return l
+}
+
+// Drop leadership in memory and restore it from the leader dir, as cfg
+// server restarts.
+func restartTestLeader(t *testing.T) {
+	leader.mutex.Lock()
+	dir := leader.dir
+	leader.token, leader.cur = 0, nil
+	leader.ckpt = new(projCheckpointStore)
+	leader.mutex.Unlock()
+	if err := SetLeaderDir(dir); err != nil {
+		t.Fatalf("Fail to restore leader dir, %v", err)
+	}
+}
+
+// Let the lease of the current leader run out.
+func expireLeadership() {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	leader.cur.Expire = time.Now().Add(-time.Millisecond)
+}
+
+func TestGrantLeadership(t *testing.T) {
+	defer setTestLeaderDir(t)()
+	if _, err := GetLeadership(); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Get leadership before any granted, get %v, expect not found", err)
+	}
+
+	// Grant
+	l := mustGrant(t, "a")
+	if l.Holder != "a" || l.Token != 1 || l.LeaseMs != int64(LEADER_DEF_LEASE/time.Millisecond) {
+		t.Fatalf("Get %+v, expect granted to a with token 1", l)
+	}
+	if l := mustGrant(t, "b"); l.Holder != "a" || l.Token != 1 {
+		t.Fatalf("Campaign as b while held, get %+v, expect a", l)
+	}
+
+	// Renew
+	time.Sleep(time.Millisecond)
+	renewed := mustGrant(t, "a")
+	if renewed.Token != 1 || !renewed.Expire.After(l.Expire) {
+		t.Fatalf("Renew as a, get %+v, expect token 1 expiring after %v", renewed, l.Expire)
+	}
+
+	// Renewal just after expiry keeps the token
+	expireLeadership()
+	if _, err := GetLeadership(); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Get expired leadership, get %v, expect not found", err)
+	}
+	if l := mustGrant(t, "a"); l.Holder != "a" || l.Token != 1 {
+		t.Fatalf("Renew as a after expiry, get %+v, expect token 1", l)
+	}
+	if l, err := GetLeadership(); err != nil || l.Holder != "a" {
+		t.Fatalf("Get leadership after renewal, get %+v %v, expect a", l, err)
+	}
+
+	// Takeover once expired, the former leader is fenced
+	expireLeadership()
+	if l := mustGrant(t, "b"); l.Holder != "b" || l.Token != 2 {
+		t.Fatalf("Campaign as b after expiry, get %+v, expect b with token 2", l)
+	}
+	if l := mustGrant(t, "a"); l.Holder != "b" || l.Token != 2 {
+		t.Fatalf("Renew as a after takeover, get %+v, expect b", l)
+	}
+	if err := ClearProjCheckpoint(1); !errors.Is(err, util.ErrConflict) {
+		t.Fatalf("Clear checkpoint with token 1, get %v, expect conflict", err)
+	}
+	if err := ClearProjCheckpoint(2); err != nil {
+		t.Fatalf("Fail to clear checkpoint with token 2, %v", err)
+	}
+
+	// Token never goes back across restart, and the holder keeps it
+	restartTestLeader(t)
+	if l := mustGrant(t, "a"); l.Holder != "b" || l.Token != 2 {
+		t.Fatalf("Campaign as a after restart, get %+v, expect b", l)
+	}
+	if l := mustGrant(t, "b"); l.Holder != "b" || l.Token != 2 {
+		t.Fatalf("Renew as b after restart, get %+v, expect token 2", l)
+	}
+	expireLeadership()
+	if l := mustGrant(t, "a"); l.Holder != "a" || l.Token != 3 {
+		t.Fatalf("Campaign as a after b expired, get %+v, expect token 3", l)
+	}
+}
+
+func TestGrantLeadershipInvalid(t *testing.T) {
+	defer setTestLeaderDir(t)()
+	cases := []*Leadership{
+		{Addr: "a:9000"},
+		{Holder: "a", LeaseMs: 10},
+		{Holder: "a", LeaseMs: int64(time.Hour / time.Millisecond)},
+	}
+	for _, req := range cases {
+		if _, err := GrantLeadership(req); !errors.Is(err, util.ErrInvalidSpec) {
+			t.Fatalf("Campaign with %+v, get %v, expect invalid", req, err)
+		}
+	}
+	if _, err := GetLeadership(); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Get leadership after invalid campaigns, get %v, expect not found", err)
+	}
+}
+
+// Serve handlers as cfg server on a random port of 127.0.0.1, with
+// CfgServerPort set to it until stopped.
+func startTestCfgServer(t *testing.T, handlers map[string]http.HandlerFunc) (string, func()) {
+	mux := http.NewServeMux()
+	for path, h := range handlers {
+		mux.HandleFunc(path, h)
+	}
+	s := httptest.NewServer(mux)
+	ip, port, err := util.SplitAddr(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Fail to split test server addr, %v", err)
+	}
+	portOld := CfgServerPort
+	CfgServerPort = port
+	return ip, func() {
+		s.Close()
+		CfgServerPort = portOld
+	}
+}
+
+func testCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	req := new(Leadership)
+	if err := util.HttpFitRequestInto(r, req); err != nil {
+		util.WriteResp(w, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err), nil)
+		return
+	}
+	l, err := GrantLeadership(req)
+	util.WriteResp(w, err, l)
+}
+
+// Campaign as holder with a lease of 1s, renewed from now on.
+func mustCampaign(t *testing.T, ip, holder string) *LeaderLease {
+	req := &Leadership{Holder: holder, Addr: holder + ":9000", LeaseMs: 1000}
+	start := time.Now()
+	l, err := campaign(context.Background(), ip, req)
+	if err != nil || l.Holder != holder {
+		t.Fatalf("Fail to campaign as %s, get %+v %v", holder, l, err)
+	}
+	lease := &LeaderLease{ip: ip, req: req, token: l.Token, lost: make(chan struct{})}
+	go lease.renew(start)
+	return lease
+}
+
+// The leader keeps renewing with the same token while cfg server restarts.
+func TestLeaderLeaseAcrossRestart(t *testing.T) {
+	defer setTestLeaderDir(t)()
+	ip, stop := startTestCfgServer(t, map[string]http.HandlerFunc{
+		uri.LeaderCampaignUri: testCampaignHandler,
+	})
+	defer stop()
+	lease := mustCampaign(t, ip, "a")
+
+	restartTestLeader(t)
+	if l := mustGrant(t, "b"); l.Holder != "a" {
+		t.Fatalf("Campaign as b after restart, get %+v, expect a", l)
+	}
+	select {
+	case <-lease.Lost():
+		t.Fatalf("Leadership of token %d lost across restart", lease.Token())
+	case <-time.After(1500 * time.Millisecond):
+	}
+	cur, err := GetLeadership()
+	if err != nil || cur.Holder != "a" || cur.Token != lease.Token() {
+		t.Fatalf("Get leadership %+v %v, expect a with token %d", cur, err, lease.Token())
+	}
+
+	// Renewal stops once taken over, before the server is stopped
+	expireLeadership()
+	mustGrant(t, "b")
+	<-lease.Lost()
+}
+
+// Renewal hanging on cfg server fails, leadership is lost by the lease
+// expiry rather than held on to.
+func TestLeaderLeaseHang(t *testing.T) {
+	defer setTestLeaderDir(t)()
+	hang := make(chan struct{})
+	var granted int32
+	ip, stop := startTestCfgServer(t, map[string]http.HandlerFunc{
+		uri.LeaderCampaignUri: func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&granted, 1) > 1 {
+				<-hang
+			}
+			testCampaignHandler(w, r)
+		},
+	})
+	defer stop()
+	// Release the hanging handler before the server is stopped
+	defer close(hang)
+	start := time.Now()
+	lease := mustCampaign(t, ip, "a")
+	select {
+	case <-lease.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Leadership of token %d held on with renewal hanging", lease.Token())
+	}
+	if d := time.Since(start); d < time.Second || d > 1200*time.Millisecond {
+		t.Fatalf("Leadership lost after %v, expect by the lease of 1s", d)
+	}
+}
@@ -3,12 +3,15 @@ package cfgmgr
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"pegasus/log"
 	"pegasus/uri"
 	"pegasus/util"
 	"reflect"
 	"strings"
+	"sync"
 )
 
 const (
@@ -18,11 +21,15 @@ const (
 type config map[string]interface{}
 
 type configSchemaEntry struct {
-	cDef interface{}
+	cDef       interface{}
+	validators []CfgValidator
 }
 
 var conf = config{}
 
+// Guards conf and revision
+var confMutex sync.Mutex
+
 var cfgSchema = make(map[string]*configSchemaEntry)
 
 func mustPtr(cList ...interface{}) {
@@ -49,36 +56,6 @@ func mustSame(v, vDef reflect.Value) {
 	}
 }
 
-func isSimpleType(v reflect.Value) bool {
-	switch v.Kind() {
-	case reflect.Bool:
-		return true
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return true
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return true
-	case reflect.Float32, reflect.Float64:
-		return true
-	case reflect.String:
-		return true
-	}
-	return false
-}
-
-func mustSimpleStruct(v reflect.Value) {
-	name := v.Type().Name()
-	if v.Kind() != reflect.Struct {
-		panic(fmt.Errorf("%s not a struct", name))
-	}
-	for i := 0; i < v.NumField(); i++ {
-		f := v.Field(i)
-		if !isSimpleType(f) {
-			fname := f.Type().Field(i).Name
-			panic(fmt.Errorf("%s, field %s not simple type", name, fname))
-		}
-	}
-}
-
 func composeCfgEntryPath(v reflect.Value) string {
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -93,7 +70,7 @@ func RegisterCfgEntry(c interface{}, cDef interface{}) {
 	v := reflect.ValueOf(c).Elem()
 	vDef := reflect.ValueOf(cDef).Elem()
 	mustSame(v, vDef)
-	mustSimpleStruct(v)
+	mustCfgStruct(v)
 	path := composeCfgEntryPath(v)
 	log.Info("Register cfg entry %s", path)
 	if _, ok := cfgSchema[path]; ok {
@@ -105,8 +82,8 @@ func RegisterCfgEntry(c interface{}, cDef interface{}) {
 	cfgSchema[path] = entry
 }
 
-func dumpCfgEntry() {
-	for path, c := range conf {
+func dumpCfgEntry(c config) {
+	for path, c := range c {
 		v := reflect.ValueOf(c).Elem()
 		t, k := v.Type(), v.Kind()
 		log.Info("path %s, cfg entry %s, kind %v", path, t.Name(), k.String())
@@ -118,6 +95,7 @@ func dumpCfgEntry() {
 	}
 }
 
+// The loaded cfg takes effect as a whole, or not at all on error.
 func LoadCfgFromFile(path string) error {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0755)
 	if err != nil {
@@ -125,39 +103,42 @@ func LoadCfgFromFile(path string) error {
 		return err
 	}
 	defer f.Close()
-	c := config{}
+	c := make(map[string]json.RawMessage)
 	if err := json.NewDecoder(f).Decode(&c); err != nil {
 		log.Error("Fail to unmarshal config file %s, %v", path, err)
 		return err
 	}
+	cNew := config{}
 	for path, entry := range cfgSchema {
-		if _, ok := c[path]; ok {
+		if buf, ok := c[path]; ok {
 			log.Info("Load cfg %s from file content", path)
-			if cNew, err := loadFromCfg(c[path], entry.cDef); err != nil {
+			if cEntry, err := loadFromCfg(buf, entry.cDef); err != nil {
 				log.Error("Fail to load %s, %v", path, err)
 				return err
 			} else {
-				conf[path] = cNew
+				cNew[path] = cEntry
 			}
 		} else {
 			log.Info("Load cfg %s from default value", path)
-			conf[path] = loadFromCfgDef(entry.cDef)
+			cNew[path] = loadFromCfgDef(entry.cDef)
 		}
 	}
-	dumpCfgEntry()
+	for path, c := range cNew {
+		if err := validateCfgEntry(path, c); err != nil {
+			log.Error("Fail to validate %s, %v", path, err)
+			return err
+		}
+	}
+	dumpCfgEntry(cNew)
+	setConf(cNew, AUTHOR_FILE)
 	return nil
 }
 
-func loadFromCfg(cIn interface{}, cDef interface{}) (interface{}, error) {
-	buf, err := json.Marshal(cIn)
-	if err != nil {
-		log.Error("Fail to marshal %v, %v", cIn, err)
-		return nil, err
-	}
-	v := reflect.New(reflect.ValueOf(cDef).Elem().Type())
-	c := v.Interface()
-	if err = json.Unmarshal(buf, c); err != nil {
-		log.Error("Fail to unmarshal %s from %v, %v", v.Type().Name(), cIn, err)
+// Fields missing from buf take the default, field by field for nested
+// structs as well.
+func loadFromCfg(buf []byte, cDef interface{}) (interface{}, error) {
+	c := loadFromCfgDef(cDef)
+	if err := decodeCfgEntry(buf, c, false); err != nil {
 		return nil, err
 	}
 	return c, nil
@@ -166,18 +147,18 @@ func loadFromCfg(cIn interface{}, cDef interface{}) (interface{}, error) {
 func loadFromCfgDef(cDef interface{}) interface{} {
 	vsrc := reflect.ValueOf(cDef)
 	vdst := reflect.New(vsrc.Elem().Type())
-	copySimpleStruct(vsrc, vdst)
+	copyCfgEntry(vsrc, vdst)
 	return vdst.Interface()
 }
 
-func copySimpleStruct(vsrc, vdst reflect.Value) {
-	vsrc, vdst = vsrc.Elem(), vdst.Elem()
-	for i := 0; i < vsrc.Type().NumField(); i++ {
-		vdst.Field(i).Set(vsrc.Field(i))
-	}
+// Deep copy, slices and maps are not shared between the two.
+func copyCfgEntry(vsrc, vdst reflect.Value) {
+	vdst.Elem().Set(deepCopy(vsrc.Elem()))
 }
 
 func SaveCfgToJson(path string) error {
+	confMutex.Lock()
+	defer confMutex.Unlock()
 	return saveCfgToJson(path, conf)
 }
 
@@ -189,31 +170,73 @@ func SaveDefaultCfgToJson(path string) error {
 	return saveCfgToJson(path, c)
 }
 
+// Readers of path see either the old content or the new, never a part.
+func writeFileAtomic(path string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Fail to create temp file for %s, %v", path, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("Fail to write %s, %v", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Fail to sync %s, %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Fail to close %s, %v", f.Name(), err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("Fail to chmod %s, %v", f.Name(), err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func saveCfgToJson(path string, c config) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0755)
+	entries, err := encodeConf(c)
 	if err != nil {
-		log.Error("Fail to open %s, %v", path, err)
+		log.Error("Fail to encode config, %v", err)
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(c); err != nil {
+	buf, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
 		log.Error("Fail to marshal config, %v", err)
 		return err
 	}
+	if err := writeFileAtomic(path, append(buf, '\n')); err != nil {
+		log.Error("Fail to save config to %s, %v", path, err)
+		return err
+	}
 	return nil
 }
 
 func GetCfg(path string) (interface{}, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
 	c, ok := conf[path]
 	if !ok {
-		return nil, fmt.Errorf("Config path %s not found", path)
+		return nil, fmt.Errorf("%w, config path %s", util.ErrNotFound, path)
 	} else {
 		return c, nil
 	}
 }
 
+// Fill c with the loaded cfg entry of the same type.
+func GetCfgEntry(c interface{}) error {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("Should pass in pointer")
+	}
+	cLoaded, err := GetCfg(composeCfgEntryPath(v))
+	if err != nil {
+		return err
+	}
+	copyCfgEntry(reflect.ValueOf(cLoaded), v)
+	return nil
+}
+
 func PullCfg(ip string, c interface{}) error {
 	v := reflect.ValueOf(c)
 	if v.Kind() != reflect.Ptr {
@@ -231,7 +254,10 @@ func PullCfg(ip string, c interface{}) error {
 		return err
 	}
 	log.Info("PullCfg for %s, get:\n%s", v.Elem().Type().Name(), s)
-	if err := json.Unmarshal([]byte(s), c); err != nil {
+	if ok, err := resolveWithServer(composeCfgEntryPath(v), []byte(s), c); ok {
+		return err
+	}
+	if err := decodeCfgEntry([]byte(s), c, false); err != nil {
 		return err
 	}
 	return nil
@@ -2,6 +2,7 @@ package cfgmgr
 
 import (
 	"fmt"
+	"net"
 	"pegasus/log"
 	"pegasus/uri"
 	"pegasus/util"
@@ -9,10 +10,48 @@ import (
 )
 
 const (
-	CfgServerPort = 10086
-	PingResp      = "Pong"
+	PingResp = "Pong"
 )
 
+// Set from the bootstrap cfg by InitLayers
+var CfgServerPort = BootstrapDef.CfgServerPort
+
+// Where a component listens and how others reach it.
+type NetCfg struct {
+	// Listen on all interfaces if empty
+	BindIP string
+	// Registered for others to reach, BindIP if it's a specific one, or the
+	// address cfg server sees by /echoip, which is wrong behind NAT
+	AdvertiseIP string
+	// Random if 0
+	Port int
+}
+
+// Needed before cfg server could be reached, so resolved from the layers
+// below it only.
+type BootstrapCfg struct {
+	// IP or DNS name
+	CfgServerIP   string
+	CfgServerPort int
+	// Cfg server listens on CfgServerBindIP:CfgServerPort
+	CfgServerBindIP string
+	Master          NetCfg
+	Worker          NetCfg
+	LogLevel        string
+	LogDir          string
+	// Cfg server keeps cfg.json, the audit log and snapshots here
+	DataDir string
+}
+
+var Bootstrap = new(BootstrapCfg)
+var BootstrapDef = &BootstrapCfg{
+	CfgServerIP:   "127.0.0.1",
+	CfgServerPort: 10086,
+	LogLevel:      "Info",
+	LogDir:        "./temp",
+	DataDir:       ".",
+}
+
 func pingCfgServer(ip string) error {
 	u := &util.HttpUrl{
 		IP:   ip,
@@ -27,7 +66,7 @@ func pingCfgServer(ip string) error {
 	if s != PingResp {
 		return fmt.Errorf("Ping failed, get %q, expect %q", s, PingResp)
 	}
-	log.Info("Ping cfg server %s:%d succeed!", u.IP, u.Port)
+	log.Info("Ping cfg server %s succeed!", u.Host())
 	return nil
 }
 
@@ -58,3 +97,21 @@ func DiscoverIpFromCfg(ip string) (string, error) {
 	}
 	return s, err
 }
+
+// IP others reach the component at, asking cfg server at ip as the last
+// resort.
+func GetAdvertiseIP(ip string, nc *NetCfg) (string, error) {
+	if nc.AdvertiseIP != "" {
+		return util.ParseHost(nc.AdvertiseIP)
+	}
+	if nc.BindIP != "" {
+		ip, err := util.ParseHost(nc.BindIP)
+		if err != nil {
+			return "", err
+		}
+		if !net.ParseIP(ip).IsUnspecified() {
+			return ip, nil
+		}
+	}
+	return DiscoverIpFromCfg(ip)
+}
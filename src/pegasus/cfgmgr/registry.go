@@ -0,0 +1,405 @@
+package cfgmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"pegasus/log"
+	"pegasus/uri"
+	"pegasus/util"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SERVICE_ROLE_MASTER = "master"
+	SERVICE_ROLE_WORKER = "worker"
+	// Meta of master, the leader token it's granted
+	SERVICE_META_TOKEN = "token"
+)
+
+const (
+	REGISTRY_DEF_LEASE      = 15 * time.Second
+	REGISTRY_MIN_LEASE      = time.Second
+	REGISTRY_MAX_LEASE      = 5 * time.Minute
+	REGISTRY_SWEEP_INTERVAL = time.Second
+	REGISTRY_WATCH_TIMEOUT  = 30 * time.Second
+)
+
+// A component registered on cfg server, gone once the lease expires
+// without renewal.
+type ServiceInstance struct {
+	// Assigned by cfg server as role@addr
+	Id      string
+	Role    string
+	Addr    string
+	Version string
+	Meta    map[string]string
+	// REGISTRY_DEF_LEASE if 0
+	LeaseMs    int64
+	Registered time.Time
+	Expire     time.Time
+}
+
+// Leader token of a master instance, 0 if not given.
+func (inst *ServiceInstance) LeaderToken() uint64 {
+	token, err := strconv.ParseUint(inst.Meta[SERVICE_META_TOKEN], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return token
+}
+
+type ServiceSnapshot struct {
+	Revision  uint64
+	Instances []*ServiceInstance
+}
+
+type registryStore struct {
+	mutex sync.Mutex
+	// Bumped on every change of instances, not on renewal
+	revision uint64
+	changed  chan struct{}
+	insts    map[string]*ServiceInstance
+}
+
+var registry = &registryStore{
+	changed: make(chan struct{}),
+	insts:   make(map[string]*ServiceInstance),
+}
+
+// Under registry.mutex
+func (s *registryStore) bump() {
+	s.revision++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func ServiceId(role, addr string) string {
+	return role + "@" + addr
+}
+
+func copyInstance(inst *ServiceInstance) *ServiceInstance {
+	c := *inst
+	c.Meta = make(map[string]string, len(inst.Meta))
+	for k, v := range inst.Meta {
+		c.Meta[k] = v
+	}
+	return &c
+}
+
+// Register inst, or replace the one of the same role and addr.
+func AddService(inst *ServiceInstance) (*ServiceInstance, error) {
+	if inst.Role == "" {
+		return nil, fmt.Errorf("%w, service role missing", util.ErrInvalidSpec)
+	}
+	host, port, err := util.SplitAddr(inst.Addr)
+	if err == nil {
+		host, err = util.ParseHost(host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w, service addr %q, %v", util.ErrInvalidSpec, inst.Addr, err)
+	}
+	lease := time.Duration(inst.LeaseMs) * time.Millisecond
+	if lease == 0 {
+		lease = REGISTRY_DEF_LEASE
+	} else if lease < REGISTRY_MIN_LEASE || lease > REGISTRY_MAX_LEASE {
+		return nil, fmt.Errorf("%w, lease %v out of [%v, %v]", util.ErrInvalidSpec,
+			lease, REGISTRY_MIN_LEASE, REGISTRY_MAX_LEASE)
+	}
+	c := copyInstance(inst)
+	// The same addr however it's given
+	c.Addr = util.JoinAddr(host, port)
+	c.Id = ServiceId(c.Role, c.Addr)
+	c.LeaseMs = int64(lease / time.Millisecond)
+	c.Registered = time.Now()
+	c.Expire = c.Registered.Add(lease)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.insts[c.Id] = c
+	registry.bump()
+	log.Info("Service %s registered, version %s, lease %v", c.Id, c.Version, lease)
+	return copyInstance(c), nil
+}
+
+// ErrNotFound if expired already, the owner should register again.
+func RenewService(id string) (*ServiceInstance, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	inst, ok := registry.insts[id]
+	if !ok || time.Now().After(inst.Expire) {
+		return nil, fmt.Errorf("%w, service %s", util.ErrNotFound, id)
+	}
+	inst.Expire = time.Now().Add(time.Duration(inst.LeaseMs) * time.Millisecond)
+	return copyInstance(inst), nil
+}
+
+func RemoveService(id string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.insts[id]; !ok {
+		return fmt.Errorf("%w, service %s", util.ErrNotFound, id)
+	}
+	delete(registry.insts, id)
+	registry.bump()
+	log.Info("Service %s deregistered", id)
+	return nil
+}
+
+// Instances of role alive, all roles if role is empty. Sorted by role, the
+// latest registered first.
+func SnapshotServices(role string) *ServiceSnapshot {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	now := time.Now()
+	snap := &ServiceSnapshot{
+		Revision:  registry.revision,
+		Instances: make([]*ServiceInstance, 0),
+	}
+	for _, inst := range registry.insts {
+		if (role == "" || inst.Role == role) && now.Before(inst.Expire) {
+			snap.Instances = append(snap.Instances, copyInstance(inst))
+		}
+	}
+	sortInstances(snap.Instances)
+	return snap
+}
+
+func sortInstances(insts []*ServiceInstance) {
+	sort.Slice(insts, func(i, j int) bool {
+		if insts[i].Role != insts[j].Role {
+			return insts[i].Role < insts[j].Role
+		}
+		if !insts[i].Registered.Equal(insts[j].Registered) {
+			return insts[i].Registered.After(insts[j].Registered)
+		}
+		return insts[i].Id < insts[j].Id
+	})
+}
+
+// Same as WaitForChange, on the registry revision.
+func WaitForServiceChange(ctx context.Context, rev uint64) uint64 {
+	for {
+		registry.mutex.Lock()
+		cur, changed := registry.revision, registry.changed
+		registry.mutex.Unlock()
+		if cur != rev {
+			return cur
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return cur
+		}
+	}
+}
+
+// Drop instances with lease expired, to be run by cfg server.
+func SweepServices() {
+	for {
+		time.Sleep(REGISTRY_SWEEP_INTERVAL)
+		sweepServices(time.Now())
+	}
+}
+
+func sweepServices(now time.Time) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	expired := false
+	for id, inst := range registry.insts {
+		if now.After(inst.Expire) {
+			delete(registry.insts, id)
+			expired = true
+			log.Info("Service %s expired", id)
+		}
+	}
+	if expired {
+		registry.bump()
+	}
+}
+
+func makeCfgServerUrl(ip, u string) *util.HttpUrl {
+	return &util.HttpUrl{
+		IP:    ip,
+		Port:  CfgServerPort,
+		Uri:   u,
+		Query: make(url.Values),
+	}
+}
+
+func postService(ip string, inst *ServiceInstance) (*ServiceInstance, error) {
+	s, err := util.HttpPostData(makeCfgServerUrl(ip, uri.RegistryUri), inst)
+	if err != nil {
+		return nil, err
+	}
+	reg := new(ServiceInstance)
+	if err := json.Unmarshal([]byte(s), reg); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal service instance, %v", err)
+	}
+	return reg, nil
+}
+
+// Registration on cfg server kept alive by renewal.
+type ServiceLease struct {
+	ip   string
+	inst *ServiceInstance
+	// Guards id, given by cfg server and changed as registered again
+	mutex sync.Mutex
+	id    string
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Register inst on the cfg server at ip and renew its lease at a third of
+// it, registering again if it's lost, such as after cfg server restarts.
+func RegisterService(ip string, inst *ServiceInstance) (*ServiceLease, error) {
+	reg, err := postService(ip, inst)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to register service %s, %v", inst.Role, err)
+	}
+	l := &ServiceLease{
+		ip:   ip,
+		inst: inst,
+		id:   reg.Id,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.renew(time.Duration(reg.LeaseMs) * time.Millisecond)
+	return l, nil
+}
+
+func (l *ServiceLease) Id() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.id
+}
+
+func (l *ServiceLease) renew(lease time.Duration) {
+	defer close(l.done)
+	for {
+		select {
+		case <-time.After(lease / 3):
+		case <-l.stop:
+			return
+		}
+		id := l.Id()
+		u := makeCfgServerUrl(l.ip, uri.RegistryLeaseUri)
+		u.Query.Set(uri.RegistryIdKey, id)
+		_, err := util.HttpPostData(u, nil)
+		if err == nil {
+			continue
+		}
+		log.Error("Fail to renew service %s, %v", id, err)
+		if !errors.Is(err, util.ErrNotFound) {
+			continue
+		}
+		if r, err := postService(l.ip, l.inst); err != nil {
+			log.Error("Fail to register service %s again, %v", id, err)
+		} else {
+			log.Info("Service %s registered again", r.Id)
+			l.mutex.Lock()
+			l.id = r.Id
+			l.mutex.Unlock()
+			lease = time.Duration(r.LeaseMs) * time.Millisecond
+		}
+	}
+}
+
+// Stop renewal and deregister, once renewal in flight is done so that it
+// could not register again afterwards.
+func (l *ServiceLease) Close() error {
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+	u := makeCfgServerUrl(l.ip, uri.RegistryUri)
+	u.Query.Set(uri.RegistryIdKey, l.Id())
+	_, err := util.HttpDelete(u)
+	return err
+}
+
+func getServices(ctx context.Context, u *util.HttpUrl) (*ServiceSnapshot, error) {
+	s, err := util.HttpGetContext(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	snap := new(ServiceSnapshot)
+	if err := json.Unmarshal([]byte(s), snap); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal services, %v", err)
+	}
+	return snap, nil
+}
+
+// Instances of role alive on the cfg server at ip, the latest first.
+func ListServices(ip, role string) ([]*ServiceInstance, error) {
+	u := makeCfgServerUrl(ip, uri.RegistryUri)
+	u.Query.Set(uri.RegistryRoleKey, role)
+	snap, err := getServices(context.Background(), u)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Instances, nil
+}
+
+// The latest registered instance of role, ErrNotFound if none alive.
+func ResolveService(ip, role string) (*ServiceInstance, error) {
+	insts, err := ListServices(ip, role)
+	if err != nil {
+		return nil, err
+	}
+	if len(insts) == 0 {
+		return nil, fmt.Errorf("%w, no %s registered", util.ErrNotFound, role)
+	}
+	return insts[0], nil
+}
+
+// Instances of role once the registry revision moves from rev, or the
+// same ones on timeout of the long poll.
+func pollServices(ctx context.Context, ip, role string, rev uint64) (*ServiceSnapshot, error) {
+	u := makeCfgServerUrl(ip, uri.RegistryWatchUri)
+	u.Query.Set(uri.RegistryRoleKey, role)
+	u.Query.Set(uri.CfgRevKey, strconv.FormatUint(rev, 10))
+	u.Query.Set(uri.CfgTimeoutKey, REGISTRY_WATCH_TIMEOUT.String())
+	ctx, cancel := context.WithTimeout(ctx, REGISTRY_WATCH_TIMEOUT+10*time.Second)
+	defer cancel()
+	return getServices(ctx, u)
+}
+
+// Long poll the instances of role, cb is called with the ones alive on
+// every change. Watching goes on until the returned stop is called.
+func WatchServices(ip, role string, cb func([]*ServiceInstance)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var rev uint64
+		backoff := time.Second
+		for ctx.Err() == nil {
+			snap, err := pollServices(ctx, ip, role, rev)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error("Fail to watch services, retry in %v, %v", backoff, err)
+				util.SleepContext(ctx, backoff)
+				backoff *= 2
+				if backoff > CFG_WATCH_MAX_BACKOFF {
+					backoff = CFG_WATCH_MAX_BACKOFF
+				}
+				continue
+			}
+			backoff = time.Second
+			if snap.Revision != rev {
+				rev = snap.Revision
+				cb(snap.Instances)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,239 @@
+package cfgmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"pegasus/uri"
+	"pegasus/util"
+)
+
+// Drop all instances registered by former tests.
+func resetTestRegistry() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.insts = make(map[string]*ServiceInstance)
+	registry.bump()
+}
+
+func mustAddService(t *testing.T, role, addr string) *ServiceInstance {
+	inst, err := AddService(&ServiceInstance{Role: role, Addr: addr, LeaseMs: 1000})
+	if err != nil {
+		t.Fatalf("Fail to register %s at %s, %v", role, addr, err)
+	}
+	return inst
+}
+
+// Serve the registry as cfg server does.
+func startTestRegistry(t *testing.T) (string, func()) {
+	return startTestCfgServer(t, map[string]http.HandlerFunc{
+		uri.RegistryUri: func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			switch r.Method {
+			case http.MethodPost:
+				inst := new(ServiceInstance)
+				if err := util.HttpFitRequestInto(r, inst); err != nil {
+					util.WriteResp(w, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err), nil)
+					return
+				}
+				reg, err := AddService(inst)
+				util.WriteResp(w, err, reg)
+			case http.MethodDelete:
+				util.WriteResp(w, RemoveService(r.Form.Get(uri.RegistryIdKey)), nil)
+			default:
+				util.WriteResp(w, nil, SnapshotServices(r.Form.Get(uri.RegistryRoleKey)))
+			}
+		},
+		uri.RegistryLeaseUri: func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			inst, err := RenewService(r.Form.Get(uri.RegistryIdKey))
+			util.WriteResp(w, err, inst)
+		},
+		uri.RegistryWatchUri: func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			rev, _ := strconv.ParseUint(r.Form.Get(uri.CfgRevKey), 10, 64)
+			WaitForServiceChange(r.Context(), rev)
+			util.WriteResp(w, nil, SnapshotServices(r.Form.Get(uri.RegistryRoleKey)))
+		},
+	})
+}
+
+func TestAddService(t *testing.T) {
+	resetTestRegistry()
+	invalid := []*ServiceInstance{
+		{Addr: "10.0.0.1:9000"},
+		{Role: SERVICE_ROLE_MASTER, Addr: "10.0.0.1"},
+		{Role: SERVICE_ROLE_MASTER, Addr: "10.0.0.1:9000", LeaseMs: 10},
+		{Role: SERVICE_ROLE_MASTER, Addr: "10.0.0.1:9000", LeaseMs: int64(time.Hour / time.Millisecond)},
+	}
+	for _, inst := range invalid {
+		if _, err := AddService(inst); !errors.Is(err, util.ErrInvalidSpec) {
+			t.Fatalf("Register %+v, get %v, expect invalid", inst, err)
+		}
+	}
+
+	rev := SnapshotServices("").Revision
+	inst, err := AddService(&ServiceInstance{Role: SERVICE_ROLE_MASTER, Addr: "10.0.0.1:9000"})
+	if err != nil {
+		t.Fatalf("Fail to register master, %v", err)
+	}
+	if inst.Id != "master@10.0.0.1:9000" || inst.LeaseMs != int64(REGISTRY_DEF_LEASE/time.Millisecond) {
+		t.Fatalf("Get %+v, expect id master@10.0.0.1:9000 with default lease", inst)
+	}
+	time.Sleep(time.Millisecond)
+	latest := mustAddService(t, SERVICE_ROLE_MASTER, "10.0.0.2:9000")
+	mustAddService(t, SERVICE_ROLE_WORKER, "10.0.0.3:9000")
+	snap := SnapshotServices(SERVICE_ROLE_MASTER)
+	if snap.Revision != rev+3 || len(snap.Instances) != 2 || snap.Instances[0].Id != latest.Id {
+		t.Fatalf("Get %+v, expect 2 masters at revision %d, the latest first", snap, rev+3)
+	}
+	if snap := SnapshotServices(""); len(snap.Instances) != 3 {
+		t.Fatalf("Get %d instances of all roles, expect 3", len(snap.Instances))
+	}
+
+	// Renewal keeps the revision
+	if _, err := RenewService(inst.Id); err != nil {
+		t.Fatalf("Fail to renew %s, %v", inst.Id, err)
+	}
+	if snap := SnapshotServices(""); snap.Revision != rev+3 {
+		t.Fatalf("Get revision %d after renewal, expect %d", snap.Revision, rev+3)
+	}
+	// Registered again replaces the former one
+	time.Sleep(time.Millisecond)
+	if _, err := AddService(&ServiceInstance{Role: SERVICE_ROLE_MASTER, Addr: "10.0.0.1:9000",
+		Meta: map[string]string{SERVICE_META_TOKEN: "2"}}); err != nil {
+		t.Fatalf("Fail to register master again, %v", err)
+	}
+	snap = SnapshotServices(SERVICE_ROLE_MASTER)
+	if len(snap.Instances) != 2 || snap.Instances[0].Id != inst.Id || snap.Instances[0].LeaderToken() != 2 {
+		t.Fatalf("Get %+v, expect %s with token 2 replaced", snap.Instances, inst.Id)
+	}
+}
+
+func TestServiceLeaseExpire(t *testing.T) {
+	resetTestRegistry()
+	inst := mustAddService(t, SERVICE_ROLE_WORKER, "10.0.0.1:9000")
+	alive := mustAddService(t, SERVICE_ROLE_WORKER, "10.0.0.2:9000")
+	if _, err := RenewService(alive.Id); err != nil {
+		t.Fatalf("Fail to renew %s, %v", alive.Id, err)
+	}
+
+	// Out of snapshots once expired, before swept
+	registry.mutex.Lock()
+	registry.insts[inst.Id].Expire = time.Now().Add(-time.Millisecond)
+	registry.mutex.Unlock()
+	snap := SnapshotServices(SERVICE_ROLE_WORKER)
+	if len(snap.Instances) != 1 || snap.Instances[0].Id != alive.Id {
+		t.Fatalf("Get %+v with %s expired, expect %s only", snap.Instances, inst.Id, alive.Id)
+	}
+	if _, err := RenewService(inst.Id); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Renew expired %s, get %v, expect not found", inst.Id, err)
+	}
+
+	sweepServices(time.Now())
+	registry.mutex.Lock()
+	_, expired := registry.insts[inst.Id]
+	_, kept := registry.insts[alive.Id]
+	registry.mutex.Unlock()
+	if expired || !kept {
+		t.Fatalf("Swept %s %v, %s %v, expect only the expired one", inst.Id, !expired, alive.Id, !kept)
+	}
+	if snap2 := SnapshotServices(""); snap2.Revision != snap.Revision+1 {
+		t.Fatalf("Get revision %d after sweep, expect %d", snap2.Revision, snap.Revision+1)
+	}
+	sweepServices(alive.Expire.Add(time.Millisecond))
+	if snap := SnapshotServices(""); len(snap.Instances) != 0 {
+		t.Fatalf("Get %+v after all expired, expect none", snap.Instances)
+	}
+}
+
+// Registered through cfg server, deregistered by the id it's given.
+func TestDeregisterService(t *testing.T) {
+	resetTestRegistry()
+	ip, stop := startTestRegistry(t)
+	defer stop()
+	lease, err := RegisterService(ip, &ServiceInstance{Role: SERVICE_ROLE_WORKER,
+		Addr: "10.0.0.1:9000", LeaseMs: 1000})
+	if err != nil {
+		t.Fatalf("Fail to register service, %v", err)
+	}
+	mustAddService(t, SERVICE_ROLE_WORKER, "10.0.0.2:9000")
+	inst, err := ResolveService(ip, SERVICE_ROLE_WORKER)
+	if err != nil || inst.Id == lease.Id() {
+		t.Fatalf("Resolve worker, get %+v %v, expect the latest 10.0.0.2:9000", inst, err)
+	}
+
+	if err := lease.Close(); err != nil {
+		t.Fatalf("Fail to deregister %s, %v", lease.Id(), err)
+	}
+	insts, err := ListServices(ip, SERVICE_ROLE_WORKER)
+	if err != nil || len(insts) != 1 || insts[0].Id != inst.Id {
+		t.Fatalf("List workers, get %+v %v, expect %s only", insts, err, inst.Id)
+	}
+	if err := RemoveService(lease.Id()); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Deregister %s again, get %v, expect not found", lease.Id(), err)
+	}
+	if err := RemoveService(inst.Id); err != nil {
+		t.Fatalf("Fail to deregister %s, %v", inst.Id, err)
+	}
+	if _, err := ResolveService(ip, SERVICE_ROLE_WORKER); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Resolve worker with none registered, get %v, expect not found", err)
+	}
+}
+
+func TestWatchServices(t *testing.T) {
+	resetTestRegistry()
+	ip, stopServer := startTestRegistry(t)
+	defer stopServer()
+	mustAddService(t, SERVICE_ROLE_MASTER, "10.0.0.1:9000")
+
+	// Long poll returns once the revision moves
+	snap, err := pollServices(context.Background(), ip, SERVICE_ROLE_MASTER, 0)
+	if err != nil || len(snap.Instances) != 1 {
+		t.Fatalf("Poll masters, get %+v %v, expect 1", snap, err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		AddService(&ServiceInstance{Role: SERVICE_ROLE_WORKER, Addr: "10.0.0.2:9000"})
+	}()
+	start := time.Now()
+	snap2, err := pollServices(context.Background(), ip, SERVICE_ROLE_MASTER, snap.Revision)
+	if err != nil || snap2.Revision == snap.Revision || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Poll masters since %d, get %+v %v, expect the next revision", snap.Revision, snap2, err)
+	}
+
+	insts := make(chan []*ServiceInstance, 8)
+	stop := WatchServices(ip, SERVICE_ROLE_MASTER, func(i []*ServiceInstance) { insts <- i })
+	expectWatched := func(cnt int) {
+		select {
+		case i := <-insts:
+			if len(i) != cnt {
+				t.Fatalf("Watch masters, get %+v, expect %d", i, cnt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Watch masters, get none in 1s, expect %d", cnt)
+		}
+	}
+	expectWatched(1)
+	time.Sleep(time.Millisecond)
+	latest := mustAddService(t, SERVICE_ROLE_MASTER, "10.0.0.3:9000")
+	expectWatched(2)
+	if err := RemoveService(latest.Id); err != nil {
+		t.Fatalf("Fail to deregister %s, %v", latest.Id, err)
+	}
+	expectWatched(1)
+
+	// Nothing called back once stopped, long poll in flight or not
+	stop()
+	mustAddService(t, SERVICE_ROLE_MASTER, "10.0.0.4:9000")
+	select {
+	case i := <-insts:
+		t.Fatalf("Watch masters after stopped, get %+v", i)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,79 @@
+package cfgmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pegasus/util"
+	"strings"
+)
+
+const (
+	SECRET_ENV_PREFIX = "PEGASUS_SECRET_"
+	SECRETS_FILE      = "./secrets.json"
+	SECRETS_FILE_ENV  = "PEGASUS_SECRETS_FILE"
+)
+
+// Name of a secret, kept in cfg in place of the secret itself, so that cfg
+// server never holds, serves or logs it. Resolved by Value on the component
+// that needs it, from $PEGASUS_SECRET_<NAME>, such as PEGASUS_SECRET_DB_PASSWORD
+// for db.password, or else the local secrets file, a JSON object of names
+// to secrets.
+type Secret string
+
+func GetSecretsFile() string {
+	if fpath := os.Getenv(SECRETS_FILE_ENV); fpath != "" {
+		return fpath
+	}
+	return SECRETS_FILE
+}
+
+func (s Secret) envKey() string {
+	return SECRET_ENV_PREFIX + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, string(s))
+}
+
+// Read on each call so that secrets rotated in the file are picked up.
+func readSecretsFile(fpath string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Fail to read secrets file %s, %v", fpath, err)
+	}
+	secrets := make(map[string]string)
+	// Error of json could quote the content
+	if err := json.Unmarshal(buf, &secrets); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal secrets file %s, expect object of strings", fpath)
+	}
+	return secrets, nil
+}
+
+// ErrNotFound if the secret is in neither env nor the secrets file, empty
+// name for no secret at all.
+func (s Secret) Value() (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if v, ok := os.LookupEnv(s.envKey()); ok {
+		return v, nil
+	}
+	fpath := GetSecretsFile()
+	secrets, err := readSecretsFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := secrets[string(s)]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("%w, secret %q in neither $%s nor %s", util.ErrNotFound,
+		string(s), s.envKey(), fpath)
+}
@@ -0,0 +1,55 @@
+package cfgmgr
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pegasus/util"
+)
+
+func TestSecretValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "secrets.json")
+	buf := []byte(`{"db.password": "from-file", "mq.token": "mq-file"}`)
+	if err := ioutil.WriteFile(fpath, buf, 0600); err != nil {
+		t.Fatalf("Fail to write %s, %v", fpath, err)
+	}
+	os.Setenv(SECRETS_FILE_ENV, fpath)
+	defer os.Unsetenv(SECRETS_FILE_ENV)
+	os.Setenv("PEGASUS_SECRET_DB_PASSWORD", "from-env")
+	defer os.Unsetenv("PEGASUS_SECRET_DB_PASSWORD")
+
+	cases := map[Secret]string{
+		"db.password": "from-env",
+		"mq.token":    "mq-file",
+		"":            "",
+	}
+	for s, expect := range cases {
+		v, err := s.Value()
+		if err != nil {
+			t.Fatalf("Fail to resolve secret %q, %v", s, err)
+		}
+		if v != expect {
+			t.Fatalf("Resolve secret %q as %q, expect %q", s, v, expect)
+		}
+	}
+	if _, err := Secret("mq.password").Value(); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Resolve missing secret, get %v, expect not found", err)
+	}
+	if err := ioutil.WriteFile(fpath, []byte(`{"db.password": top-secret`), 0600); err != nil {
+		t.Fatalf("Fail to write %s, %v", fpath, err)
+	}
+	if _, err := Secret("mq.token").Value(); err == nil {
+		t.Fatalf("Resolve from bad secrets file, expect error")
+	} else if strings.Contains(err.Error(), "top-secret") {
+		t.Fatalf("Secrets file content in error %q", err.Error())
+	}
+}
@@ -0,0 +1,303 @@
+package cfgmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pegasus/log"
+	"pegasus/util"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CFG_SNAPSHOT_EXT = ".json"
+	CFG_SNAPSHOT_FMT = "%08d" + CFG_SNAPSHOT_EXT
+)
+
+// Saved for every revision, never modified afterwards.
+type CfgRevision struct {
+	Revision uint64
+	Ts       time.Time
+	Author   string
+	Entries  map[string]json.RawMessage
+}
+
+type CfgRevisionMeta struct {
+	Revision uint64
+	Ts       time.Time
+	Author   string
+}
+
+type CfgFieldDiff struct {
+	Path  string
+	Field string
+	From  interface{}
+	To    interface{}
+}
+
+// Guarded by confMutex
+type snapshotStore struct {
+	dir   string
+	metas []*CfgRevisionMeta
+}
+
+var snapshots = new(snapshotStore)
+
+func (s *snapshotStore) fpath(rev uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf(CFG_SNAPSHOT_FMT, rev))
+}
+
+func (s *snapshotStore) save(rev uint64, author string, c config) {
+	if s.dir == "" {
+		return
+	}
+	fpath := s.fpath(rev)
+	if _, err := os.Stat(fpath); err == nil {
+		log.Error("Cfg snapshot %s exists, keep it", fpath)
+		return
+	}
+	entries, err := encodeConf(c)
+	if err != nil {
+		log.Error("Fail to encode cfg snapshot %d, %v", rev, err)
+		return
+	}
+	snap := &CfgRevision{
+		Revision: rev,
+		Ts:       time.Now(),
+		Author:   author,
+		Entries:  entries,
+	}
+	buf, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		log.Error("Fail to marshal cfg snapshot %d, %v", rev, err)
+		return
+	}
+	if err := writeFileAtomic(fpath, buf); err != nil {
+		log.Error("Fail to save cfg snapshot %d, %v", rev, err)
+		return
+	}
+	s.metas = append(s.metas, &CfgRevisionMeta{
+		Revision: rev,
+		Ts:       snap.Ts,
+		Author:   author,
+	})
+}
+
+func (s *snapshotStore) load(rev uint64) (*CfgRevision, error) {
+	if s.dir == "" {
+		return nil, fmt.Errorf("%w, cfg snapshots not kept", util.ErrNotFound)
+	}
+	buf, err := ioutil.ReadFile(s.fpath(rev))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w, cfg revision %d", util.ErrNotFound, rev)
+	} else if err != nil {
+		return nil, fmt.Errorf("Fail to read cfg snapshot %d, %v", rev, err)
+	}
+	snap := new(CfgRevision)
+	if err := json.Unmarshal(buf, snap); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal cfg snapshot %d, %v", rev, err)
+	}
+	return snap, nil
+}
+
+// Registered entries of the snapshot, defaults for the ones missing.
+func loadConfFromSnapshot(snap *CfgRevision) (config, error) {
+	c := config{}
+	for path, entry := range cfgSchema {
+		buf, ok := snap.Entries[path]
+		if !ok {
+			c[path] = loadFromCfgDef(entry.cDef)
+			continue
+		}
+		cEntry, err := loadFromCfg(buf, entry.cDef)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to load %s of revision %d, %v",
+				path, snap.Revision, err)
+		}
+		c[path] = cEntry
+	}
+	return c, nil
+}
+
+// Keep a snapshot in dir for every revision. Revisions carry on from the
+// latest snapshot found, which is also taken as the current cfg, so that
+// edits of the cfg file made in between count as a change. Should be
+// called after entries are registered and before the cfg file is loaded.
+func SetSnapshotDir(dir string) error {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Fail to create cfg snapshot dir %s, %v", dir, err)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Fail to read cfg snapshot dir %s, %v", dir, err)
+	}
+	snapshots.dir = dir
+	snapshots.metas = nil
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasSuffix(name, CFG_SNAPSHOT_EXT) {
+			continue
+		}
+		rev, err := strconv.ParseUint(strings.TrimSuffix(name, CFG_SNAPSHOT_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		snap, err := snapshots.load(rev)
+		if err != nil {
+			log.Error("Skip cfg snapshot %s, %v", name, err)
+			continue
+		}
+		snapshots.metas = append(snapshots.metas, &CfgRevisionMeta{
+			Revision: rev,
+			Ts:       snap.Ts,
+			Author:   snap.Author,
+		})
+	}
+	sort.Slice(snapshots.metas, func(i, j int) bool {
+		return snapshots.metas[i].Revision < snapshots.metas[j].Revision
+	})
+	if len(snapshots.metas) == 0 {
+		return nil
+	}
+	latest := snapshots.metas[len(snapshots.metas)-1].Revision
+	snap, err := snapshots.load(latest)
+	if err != nil {
+		return err
+	}
+	c, err := loadConfFromSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	conf, revision = c, latest
+	log.Info("Cfg revision %d restored from %s", revision, dir)
+	return nil
+}
+
+// Latest first.
+func ListRevisions(limit int) []*CfgRevisionMeta {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	metas := make([]*CfgRevisionMeta, 0)
+	for i := len(snapshots.metas) - 1; i >= 0; i-- {
+		if limit > 0 && len(metas) >= limit {
+			break
+		}
+		metas = append(metas, snapshots.metas[i])
+	}
+	return metas
+}
+
+func decodeEntries(snap *CfgRevision) (map[string]interface{}, error) {
+	entries := make(map[string]interface{})
+	for path, buf := range snap.Entries {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			return nil, fmt.Errorf("Fail to unmarshal %s of revision %d, %v",
+				path, snap.Revision, err)
+		}
+		entries[path] = fields
+	}
+	return entries, nil
+}
+
+func joinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+// Objects, nested structs and maps alike, are compared key by key, other
+// values including arrays as a whole.
+func diffValues(path, field string, from, to interface{}, diffs []*CfgFieldDiff) []*CfgFieldDiff {
+	mFrom, okFrom := from.(map[string]interface{})
+	mTo, okTo := to.(map[string]interface{})
+	if (okFrom || okTo) && (okFrom || from == nil) && (okTo || to == nil) {
+		for key, v := range mFrom {
+			diffs = diffValues(path, joinField(field, key), v, mTo[key], diffs)
+		}
+		for key, v := range mTo {
+			if _, ok := mFrom[key]; !ok {
+				diffs = diffValues(path, joinField(field, key), nil, v, diffs)
+			}
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(from, to) {
+		diffs = append(diffs, &CfgFieldDiff{path, field, from, to})
+	}
+	return diffs
+}
+
+// Fields that differ between the two revisions, sorted by path and field.
+// Fields of nested structs and keys of maps are given as "Field.Key". From
+// or To is nil if the entry or field is missing in that revision.
+func DiffRevisions(from, to uint64) ([]*CfgFieldDiff, error) {
+	confMutex.Lock()
+	snapFrom, errFrom := snapshots.load(from)
+	snapTo, errTo := snapshots.load(to)
+	confMutex.Unlock()
+	if errFrom != nil {
+		return nil, errFrom
+	}
+	if errTo != nil {
+		return nil, errTo
+	}
+	eFrom, err := decodeEntries(snapFrom)
+	if err != nil {
+		return nil, err
+	}
+	eTo, err := decodeEntries(snapTo)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]*CfgFieldDiff, 0)
+	for path, fFrom := range eFrom {
+		diffs = diffValues(path, "", fFrom, eTo[path], diffs)
+	}
+	for path, fTo := range eTo {
+		if _, ok := eFrom[path]; !ok {
+			diffs = diffValues(path, "", nil, fTo, diffs)
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Path != diffs[j].Path {
+			return diffs[i].Path < diffs[j].Path
+		}
+		return diffs[i].Field < diffs[j].Field
+	})
+	return diffs, nil
+}
+
+// Take the cfg of rev as a new revision, history is kept as is. The
+// revision is left unchanged if the cfg is the same already.
+func Rollback(rev uint64, author string) (uint64, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	snap, err := snapshots.load(rev)
+	if err != nil {
+		return 0, err
+	}
+	c, err := loadConfFromSnapshot(snap)
+	if err != nil {
+		return 0, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err)
+	}
+	for path, cEntry := range c {
+		if err := validateCfgEntry(path, cEntry); err != nil {
+			return 0, err
+		}
+	}
+	if !reflect.DeepEqual(conf, c) {
+		log.Info("Roll cfg back to revision %d", rev)
+		commitConf(c, author)
+	}
+	return revision, nil
+}
@@ -0,0 +1,136 @@
+package cfgmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"pegasus/util"
+)
+
+// Keep snapshots of testCfg in a temp dir, removed by the returned func.
+func setTestSnapshotDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cfgsnapshots")
+	if err != nil {
+		t.Fatalf("Fail to create temp dir, %v", err)
+	}
+	if err := SetSnapshotDir(dir); err != nil {
+		t.Fatalf("Fail to set snapshot dir, %v", err)
+	}
+	path := resetTestConf()
+	return path, func() {
+		confMutex.Lock()
+		snapshots.dir, snapshots.metas = "", nil
+		confMutex.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+func mustUpdateCfg(t *testing.T, path, body string) uint64 {
+	rev, err := UpdateCfg(path, []byte(body), "alice")
+	if err != nil {
+		t.Fatalf("Fail to update %s with %s, %v", path, body, err)
+	}
+	return rev
+}
+
+func TestDiffRevisions(t *testing.T) {
+	path, cleanup := setTestSnapshotDir(t)
+	defer cleanup()
+	from := mustUpdateCfg(t, path, `{"Cnt": 3}`)
+	to := mustUpdateCfg(t, path, `{"Cnt": 3, "Tags": ["a", "b"],
+		"Labels": {"k": "v2", "n": "1"}, "Nested": {"Timeout": "5s"}}`)
+
+	diffs, err := DiffRevisions(from, to)
+	if err != nil {
+		t.Fatalf("Fail to diff %d %d, %v", from, to, err)
+	}
+	expect := []*CfgFieldDiff{
+		{path, "Labels.k", "v", "v2"},
+		{path, "Labels.n", nil, "1"},
+		{path, "Nested.Timeout", "1s", "5s"},
+		{path, "Tags", []interface{}{"a"}, []interface{}{"a", "b"}},
+	}
+	if !reflect.DeepEqual(diffs, expect) {
+		buf, _ := json.Marshal(diffs)
+		t.Fatalf("Get diffs %s", buf)
+	}
+	if diffs, err := DiffRevisions(to, to); err != nil || len(diffs) != 0 {
+		t.Fatalf("Diff revision with itself, get %v %v, expect none", diffs, err)
+	}
+	if _, err := DiffRevisions(from, to+1); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Diff with missing revision, get %v, expect not found", err)
+	}
+
+	// Keys removed from a map show up one by one
+	cur := mustUpdateCfg(t, path, `{"Labels": {}}`)
+	diffs, err = DiffRevisions(to, cur)
+	if err != nil {
+		t.Fatalf("Fail to diff %d %d, %v", to, cur, err)
+	}
+	expect = []*CfgFieldDiff{
+		{path, "Labels.k", "v2", nil},
+		{path, "Labels.n", "1", nil},
+	}
+	if !reflect.DeepEqual(diffs, expect) {
+		buf, _ := json.Marshal(diffs)
+		t.Fatalf("Get diffs %s", buf)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	path, cleanup := setTestSnapshotDir(t)
+	defer cleanup()
+	target := mustUpdateCfg(t, path, `{"Cnt": 3}`)
+	cur := mustUpdateCfg(t, path, `{"Cnt": 5, "Labels": {"n": "1"},
+		"Nested": {"Timeout": "5s"}}`)
+
+	rev, err := Rollback(target, "bob")
+	if err != nil {
+		t.Fatalf("Fail to roll back to %d, %v", target, err)
+	}
+	if rev != cur+1 {
+		t.Fatalf("Get revision %d after rollback, expect %d", rev, cur+1)
+	}
+	c := getTestConf(path)
+	expect := loadFromCfgDef(testCfgDef).(*testCfg)
+	expect.Cnt = 3
+	if !reflect.DeepEqual(c, expect) {
+		t.Fatalf("Get %+v after rollback, expect %+v", c, expect)
+	}
+	recs := GetAuditRecs(path, 1)
+	if len(recs) != 1 || recs[0].Author != "bob" || recs[0].Revision != rev {
+		t.Fatalf("Get audit records %+v, expect one by bob", recs)
+	}
+	metas := ListRevisions(1)
+	if len(metas) != 1 || metas[0].Revision != rev || metas[0].Author != "bob" {
+		t.Fatalf("Get revisions %+v, expect %d by bob", metas, rev)
+	}
+	if r, err := Rollback(target, "bob"); err != nil || r != rev {
+		t.Fatalf("Roll back to same cfg, get %d %v, expect %d", r, err, rev)
+	}
+	if _, err := Rollback(rev+1, "bob"); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Roll back to missing revision, get %v, expect not found", err)
+	}
+
+	// Snapshot no longer valid against the schema
+	bad := &CfgRevision{
+		Revision: rev + 1,
+		Ts:       time.Now(),
+		Entries:  map[string]json.RawMessage{path: json.RawMessage(`{"Cnt": 0}`)},
+	}
+	buf, _ := json.Marshal(bad)
+	if err := ioutil.WriteFile(snapshots.fpath(bad.Revision), buf, 0644); err != nil {
+		t.Fatalf("Fail to write snapshot, %v", err)
+	}
+	if _, err := Rollback(bad.Revision, "bob"); !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Roll back to invalid revision, get %v, expect invalid", err)
+	}
+	if c := getTestConf(path); c.Cnt != 3 || GetRevision() != rev {
+		t.Fatalf("Refused rollback took effect, get %+v", c)
+	}
+}
@@ -0,0 +1,90 @@
+package cfgmgr
+
+import (
+	"fmt"
+	"pegasus/util"
+	"reflect"
+	"strings"
+)
+
+// Fields tagged `cfg:"required"` must not be left zero.
+const (
+	CFG_TAG          = "cfg"
+	CFG_TAG_REQUIRED = "required"
+)
+
+type CfgValidator func(c interface{}) error
+
+// Validators run on every load and update of the entry registered with
+// the same type as c.
+func RegisterCfgValidator(c interface{}, validator CfgValidator) {
+	mustPtr(c)
+	path := composeCfgEntryPath(reflect.ValueOf(c))
+	entry, ok := cfgSchema[path]
+	if !ok {
+		panic(fmt.Errorf("Cfg entry %s not registered", path))
+	}
+	entry.validators = append(entry.validators, validator)
+}
+
+func getIntField(c interface{}, field string) (int64, error) {
+	f := reflect.ValueOf(c).Elem().FieldByName(field)
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(f.Uint()), nil
+	}
+	return 0, fmt.Errorf("Field %s not an integer", field)
+}
+
+// Validator for an integer field within [min, max].
+func IntRange(field string, min, max int64) CfgValidator {
+	return func(c interface{}) error {
+		n, err := getIntField(c, field)
+		if err != nil {
+			return err
+		}
+		if n < min || n > max {
+			return fmt.Errorf("%s %d out of range [%d, %d]", field, n, min, max)
+		}
+		return nil
+	}
+}
+
+func isRequired(f reflect.StructField) bool {
+	for _, opt := range strings.Split(f.Tag.Get(CFG_TAG), ",") {
+		if opt == CFG_TAG_REQUIRED {
+			return true
+		}
+	}
+	return false
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func validateCfgEntry(path string, c interface{}) error {
+	entry, ok := cfgSchema[path]
+	if !ok {
+		return fmt.Errorf("%w, config path %s", util.ErrNotFound, path)
+	}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if isRequired(f) && isEmpty(v.Field(i)) {
+			return fmt.Errorf("%w, %s field %s required", util.ErrInvalidSpec, path, f.Name)
+		}
+	}
+	for _, validator := range entry.validators {
+		if err := validator(c); err != nil {
+			return fmt.Errorf("%w, %s %v", util.ErrInvalidSpec, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package cfgmgr
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"pegasus/util"
+)
+
+type testNestedCfg struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+type testCfg struct {
+	Name   string `cfg:"required"`
+	Cnt    int
+	Small  int8
+	Tags   []string
+	Labels map[string]string
+	Nested testNestedCfg
+}
+
+var testCfgDef = &testCfg{
+	Name:   "test",
+	Cnt:    2,
+	Tags:   []string{"a"},
+	Labels: map[string]string{"k": "v"},
+	Nested: testNestedCfg{Addr: "127.0.0.1", Timeout: time.Second},
+}
+
+var testCfgOnce sync.Once
+
+// Path of testCfg, registered once for all tests of the package.
+func registerTestCfg() string {
+	testCfgOnce.Do(func() {
+		RegisterCfgEntry(new(testCfg), testCfgDef)
+		RegisterCfgValidator(new(testCfg), IntRange("Cnt", 1, 64))
+	})
+	return composeCfgEntryPath(reflect.ValueOf(testCfgDef))
+}
+
+// Take the default of testCfg as the current cfg.
+func resetTestConf() string {
+	path := registerTestCfg()
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	conf = config{path: loadFromCfgDef(testCfgDef)}
+	return path
+}
+
+func getTestConf(path string) *testCfg {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	return conf[path].(*testCfg)
+}
+
+func TestIntRange(t *testing.T) {
+	validator := IntRange("Cnt", 1, 64)
+	for cnt, ok := range map[int]bool{0: false, 1: true, 32: true, 64: true, 65: false, -1: false} {
+		err := validator(&testCfg{Cnt: cnt})
+		if ok != (err == nil) {
+			t.Fatalf("Validate Cnt %d, get %v, expect ok %v", cnt, err, ok)
+		}
+	}
+	if err := IntRange("Name", 1, 64)(&testCfg{}); err == nil {
+		t.Fatalf("Validate string field as integer, expect error")
+	}
+}
+
+func TestValidateCfgEntry(t *testing.T) {
+	path := registerTestCfg()
+	c := loadFromCfgDef(testCfgDef).(*testCfg)
+	if err := validateCfgEntry(path, c); err != nil {
+		t.Fatalf("Fail to validate default, %v", err)
+	}
+	c.Name = ""
+	if err := validateCfgEntry(path, c); !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Validate empty required field, get %v, expect invalid", err)
+	}
+	c.Name, c.Cnt = "test", 100
+	if err := validateCfgEntry(path, c); !errors.Is(err, util.ErrInvalidSpec) {
+		t.Fatalf("Validate Cnt out of range, get %v, expect invalid", err)
+	}
+	if err := validateCfgEntry("no.such.Cfg", c); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Validate unregistered path, get %v, expect not found", err)
+	}
+}
+
+func TestUpdateCfg(t *testing.T) {
+	path := resetTestConf()
+	rev := GetRevision()
+	newRev, err := UpdateCfg(path, []byte(`{"Cnt": 8, "Nested": {"Timeout": "5s"}}`), "alice")
+	if err != nil {
+		t.Fatalf("Fail to update %s, %v", path, err)
+	}
+	if newRev != rev+1 {
+		t.Fatalf("Get revision %d after update, expect %d", newRev, rev+1)
+	}
+	c := getTestConf(path)
+	if c.Cnt != 8 || c.Nested.Timeout != 5*time.Second {
+		t.Fatalf("Get %+v after update", c)
+	}
+	if c.Name != "test" || c.Nested.Addr != "127.0.0.1" || len(c.Tags) != 1 {
+		t.Fatalf("Fields not given changed, get %+v", c)
+	}
+	recs := GetAuditRecs(path, 1)
+	if len(recs) != 1 || recs[0].Author != "alice" || recs[0].Revision != newRev {
+		t.Fatalf("Get audit records %+v, expect one by alice", recs)
+	}
+
+	// Same cfg keeps the revision
+	if r, err := UpdateCfg(path, []byte(`{"Cnt": 8}`), "alice"); err != nil || r != newRev {
+		t.Fatalf("Update with same cfg, get revision %d %v, expect %d", r, err, newRev)
+	}
+
+	cases := map[string]string{
+		"required":     `{"Name": ""}`,
+		"range":        `{"Cnt": 0}`,
+		"unknown":      `{"Count": 8}`,
+		"type":         `{"Cnt": "8"}`,
+		"overflow":     `{"Small": 300}`,
+		"nested":       `{"Nested": {"Port": 80}}`,
+		"bad duration": `{"Nested": {"Timeout": "5 parsecs"}}`,
+	}
+	for name, body := range cases {
+		if _, err := UpdateCfg(path, []byte(body), "bob"); !errors.Is(err, util.ErrInvalidSpec) {
+			t.Fatalf("Update with %s error, get %v, expect invalid", name, err)
+		}
+	}
+	if c := getTestConf(path); c.Cnt != 8 || c.Name != "test" || GetRevision() != newRev {
+		t.Fatalf("Refused update took effect, get %+v", c)
+	}
+	if _, err := UpdateCfg("no.such.Cfg", []byte(`{}`), "bob"); !errors.Is(err, util.ErrNotFound) {
+		t.Fatalf("Update unregistered path, get %v, expect not found", err)
+	}
+}
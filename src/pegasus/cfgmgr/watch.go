@@ -0,0 +1,303 @@
+package cfgmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"pegasus/log"
+	"pegasus/uri"
+	"pegasus/util"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CFG_FILE_CHECK_INTERVAL = 2 * time.Second
+	CFG_WATCH_TIMEOUT       = 30 * time.Second
+	CFG_WATCH_MAX_BACKOFF   = 32 * time.Second
+)
+
+// Bumped on every change of conf, under confMutex
+var revision uint64
+var confChanged = make(chan struct{})
+
+type CfgSnapshot struct {
+	Revision uint64
+	Entries  map[string]interface{}
+}
+
+func bumpRevision() {
+	revision++
+	close(confChanged)
+	confChanged = make(chan struct{})
+	log.Info("Cfg revision %d", revision)
+}
+
+func setConf(c config, author string) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	if !reflect.DeepEqual(conf, c) {
+		commitConf(c, author)
+	}
+}
+
+// Take c as a new revision, under confMutex. Changes are audited except
+// for the initial load.
+func commitConf(c config, author string) {
+	cOld := conf
+	conf = c
+	bumpRevision()
+	snapshots.save(revision, author, conf)
+	if len(cOld) == 0 {
+		return
+	}
+	for path, cNew := range c {
+		if !reflect.DeepEqual(cOld[path], cNew) {
+			audit.record(&AuditRec{
+				Revision: revision,
+				Ts:       time.Now(),
+				Author:   author,
+				Path:     path,
+				Old:      cOld[path],
+				New:      cNew,
+			})
+		}
+	}
+}
+
+func GetRevision() uint64 {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	return revision
+}
+
+// Update one entry with the fields given in buf, the rest are kept. The
+// result is validated against the entry's schema before taking effect.
+func UpdateCfg(path string, buf []byte, author string) (uint64, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	cOld, ok := conf[path]
+	if !ok {
+		return 0, fmt.Errorf("%w, config path %s", util.ErrNotFound, path)
+	}
+	cNew := loadFromCfgDef(cOld)
+	if err := decodeCfgEntry(buf, cNew, true); err != nil {
+		return 0, fmt.Errorf("%w, fail to decode %s, %v", util.ErrInvalidSpec, path, err)
+	}
+	if err := validateCfgEntry(path, cNew); err != nil {
+		return 0, err
+	}
+	if !reflect.DeepEqual(cOld, cNew) {
+		c := config{}
+		for p, cEntry := range conf {
+			c[p] = cEntry
+		}
+		c[path] = cNew
+		commitConf(c, author)
+	}
+	return revision, nil
+}
+
+// Wait until revision moves away from rev, which is also the case if cfg
+// server restarted and rev is from before.
+func WaitForChange(ctx context.Context, rev uint64) uint64 {
+	for {
+		confMutex.Lock()
+		cur, changed := revision, confChanged
+		confMutex.Unlock()
+		if cur != rev {
+			return cur
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return cur
+		}
+	}
+}
+
+// All entries if paths is empty.
+func SnapshotCfg(paths []string) (*CfgSnapshot, error) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	snap := &CfgSnapshot{
+		Revision: revision,
+		Entries:  make(map[string]interface{}),
+	}
+	if len(paths) == 0 {
+		for path, c := range conf {
+			snap.Entries[path] = c
+		}
+		return snap, nil
+	}
+	for _, path := range paths {
+		c, ok := conf[path]
+		if !ok {
+			return nil, fmt.Errorf("%w, config path %s", util.ErrNotFound, path)
+		}
+		snap.Entries[path] = c
+	}
+	return snap, nil
+}
+
+// Reload the file once it's modified, keep the current cfg if the new
+// content is bad.
+func WatchCfgFile(path string) {
+	var lastMod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+	}
+	for {
+		time.Sleep(CFG_FILE_CHECK_INTERVAL)
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Error("Fail to stat cfg file %s, %v", path, err)
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+		log.Info("Cfg file %s modified, reload", path)
+		if err := LoadCfgFromFile(path); err != nil {
+			log.Error("Fail to reload %s, keep current cfg, %v", path, err)
+		}
+	}
+}
+
+type CfgChangeCallback func(cOld, cNew interface{})
+
+type subscription struct {
+	c         interface{}
+	callbacks []CfgChangeCallback
+}
+
+var subsMutex sync.Mutex
+var subs = make(map[string]*subscription)
+
+// Keep c up to date with cfg server once WatchCfg is started, cb is called
+// after c is updated in place. cb could be nil.
+func Subscribe(c interface{}, cb CfgChangeCallback) {
+	mustPtr(c)
+	path := composeCfgEntryPath(reflect.ValueOf(c))
+	subsMutex.Lock()
+	defer subsMutex.Unlock()
+	sub, ok := subs[path]
+	if !ok {
+		sub = &subscription{c: c}
+		subs[path] = sub
+	} else if sub.c != c {
+		panic(fmt.Errorf("Cfg entry %s subscribed with another instance", path))
+	}
+	if cb != nil {
+		sub.callbacks = append(sub.callbacks, cb)
+	}
+}
+
+func getSubscribedPaths() []string {
+	subsMutex.Lock()
+	defer subsMutex.Unlock()
+	paths := make([]string, 0, len(subs))
+	for path := range subs {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func applyCfgEntry(path string, buf []byte) error {
+	subsMutex.Lock()
+	sub, ok := subs[path]
+	subsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	v := reflect.ValueOf(sub.c)
+	cNew := reflect.New(v.Elem().Type())
+	if ok, err := resolveWithServer(path, buf, cNew.Interface()); ok {
+		if err != nil {
+			return err
+		}
+	} else if err := decodeCfgEntry(buf, cNew.Interface(), false); err != nil {
+		return fmt.Errorf("Fail to unmarshal %s, %v", path, err)
+	}
+	if reflect.DeepEqual(v.Elem().Interface(), cNew.Elem().Interface()) {
+		return nil
+	}
+	cOld := loadFromCfgDef(sub.c)
+	copyCfgEntry(cNew, v)
+	log.Info("Cfg %s changed, from %+v to %+v", path, cOld, sub.c)
+	for _, cb := range sub.callbacks {
+		cb(cOld, cNew.Interface())
+	}
+	return nil
+}
+
+func pollCfg(ip string, rev uint64, paths []string) (uint64, error) {
+	u := &util.HttpUrl{
+		IP:    ip,
+		Port:  CfgServerPort,
+		Uri:   uri.CfgWatchUri,
+		Query: make(url.Values),
+	}
+	u.Query.Set(uri.CfgRevKey, strconv.FormatUint(rev, 10))
+	u.Query.Set(uri.CfgTimeoutKey, CFG_WATCH_TIMEOUT.String())
+	for _, path := range paths {
+		u.Query.Add(uri.CfgPathKey, path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CFG_WATCH_TIMEOUT+10*time.Second)
+	defer cancel()
+	s, err := util.HttpGetContext(ctx, u)
+	if err != nil {
+		return rev, err
+	}
+	snap := struct {
+		Revision uint64
+		Entries  map[string]json.RawMessage
+	}{}
+	if err := json.Unmarshal([]byte(s), &snap); err != nil {
+		return rev, fmt.Errorf("Fail to unmarshal cfg snapshot, %v", err)
+	}
+	if snap.Revision == rev {
+		return rev, nil
+	}
+	for path, buf := range snap.Entries {
+		if err := applyCfgEntry(path, buf); err != nil {
+			return rev, err
+		}
+	}
+	return snap.Revision, nil
+}
+
+// Revision of cfg server last applied by WatchCfg, 0 before the first poll.
+var appliedRevision uint64
+
+func GetAppliedRevision() uint64 {
+	return atomic.LoadUint64(&appliedRevision)
+}
+
+// Long poll cfg server for changes of subscribed entries.
+func WatchCfg(ip string) {
+	go func() {
+		var rev uint64
+		backoff := time.Second
+		for {
+			var err error
+			if rev, err = pollCfg(ip, rev, getSubscribedPaths()); err != nil {
+				log.Error("Fail to watch cfg, retry in %v, %v", backoff, err)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > CFG_WATCH_MAX_BACKOFF {
+					backoff = CFG_WATCH_MAX_BACKOFF
+				}
+				continue
+			}
+			atomic.StoreUint64(&appliedRevision, rev)
+			backoff = time.Second
+		}
+	}()
+}
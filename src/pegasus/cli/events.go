@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pegasus/uri"
+	"pegasus/util"
+	"time"
+)
+
+const (
+	EVENT_PROJ_STARTED  = "proj_started"
+	EVENT_PROJ_FINISHED = "proj_finished"
+	EVENT_JOB_STARTED   = "job_started"
+	EVENT_JOB_FINISHED  = "job_finished"
+	EVENT_RESET         = "reset"
+
+	EVENT_RECONNECT_INTERVAL = 1 * time.Second
+)
+
+var errProjFinished = errors.New("Project finished")
+
+// Same as master's Event, only the fields in use.
+type MasterEvent struct {
+	Seq    uint64
+	Ts     time.Time
+	Type   string
+	ProjId string
+	JobId  string
+	Tid    string
+	Worker string
+	ErrMsg string
+	Proj   *ProjMeta
+	Job    *JobMeta
+	Task   *TaskMeta
+}
+
+func (mgr *progressMgr) findJobMeta(jobId string) int {
+	for i, jmeta := range mgr.pmeta.JobMetas {
+		if jmeta.JobId == jobId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (mgr *progressMgr) upsertJobMeta(jmeta *JobMeta, keepTasks bool) *JobMeta {
+	i := mgr.findJobMeta(jmeta.JobId)
+	if i < 0 {
+		if jmeta.TaskMetas == nil {
+			jmeta.TaskMetas = make([]*TaskMeta, 0)
+		}
+		mgr.pmeta.JobMetas = append(mgr.pmeta.JobMetas, jmeta)
+		return jmeta
+	}
+	if keepTasks {
+		jmeta.TaskMetas = mgr.pmeta.JobMetas[i].TaskMetas
+	}
+	mgr.pmeta.JobMetas[i] = jmeta
+	return jmeta
+}
+
+func upsertTaskMeta(jmeta *JobMeta, tmeta *TaskMeta) {
+	for i, m := range jmeta.TaskMetas {
+		if m.Tid == tmeta.Tid {
+			jmeta.TaskMetas[i] = tmeta
+			return
+		}
+	}
+	jmeta.TaskMetas = append(jmeta.TaskMetas, tmeta)
+}
+
+func (mgr *progressMgr) applyEvent(evt *MasterEvent) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	pmeta := mgr.pmeta
+	switch evt.Type {
+	case EVENT_PROJ_STARTED, EVENT_PROJ_FINISHED:
+		if evt.Proj != nil {
+			pmeta.Name, pmeta.StartTs = evt.Proj.Name, evt.Proj.StartTs
+			pmeta.EndTs, pmeta.ErrMsg = evt.Proj.EndTs, evt.Proj.ErrMsg
+			pmeta.Finished = evt.Proj.Finished
+		}
+	case EVENT_JOB_STARTED, EVENT_JOB_FINISHED:
+		if evt.Job != nil {
+			mgr.upsertJobMeta(evt.Job, false)
+		}
+	default:
+		// Task events carry the job without task metas
+		if evt.Job != nil {
+			jmeta := mgr.upsertJobMeta(evt.Job, true)
+			if evt.Task != nil && evt.Task.Dispatched {
+				upsertTaskMeta(jmeta, evt.Task)
+			}
+		}
+	}
+}
+
+func (mgr *progressMgr) handleMasterEvent(sse *util.SseEvent) error {
+	mgr.lastEventId = sse.Id
+	if sse.Type == EVENT_RESET {
+		// Missed some events, start over from the status
+		if err := mgr.fetch(); err != nil {
+			return err
+		}
+	} else {
+		evt := new(MasterEvent)
+		if err := json.Unmarshal([]byte(sse.Data), evt); err != nil {
+			return fmt.Errorf("Fail to unmarshal event %s, %v", sse.Id, err)
+		}
+		if evt.ProjId != mgr.projId {
+			return nil
+		}
+		saveTo(sse.Data)
+		mgr.applyEvent(evt)
+	}
+	if err := mgr.handleEvents(); err != nil {
+		return err
+	}
+	if mgr.finished() {
+		return errProjFinished
+	}
+	return nil
+}
+
+// Watch events of the project until it finishes, resume from the last event
+// after reconnect.
+func (mgr *progressMgr) watch() {
+	u := &util.HttpUrl{
+		IP:   mgr.ip,
+		Port: mgr.port,
+		Uri:  uri.MasterProjectEventsUri,
+	}
+	// From the very beginning, the project may have started already
+	mgr.lastEventId = "0"
+	for {
+		err := util.HttpGetEvents(context.Background(), u, mgr.lastEventId,
+			mgr.handleMasterEvent)
+		if errors.Is(err, errProjFinished) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\nEvent stream broken, reconnect, %v\n", err)
+		time.Sleep(EVENT_RECONNECT_INTERVAL)
+	}
+}
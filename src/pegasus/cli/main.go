@@ -5,32 +5,24 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"pegasus/cfgmgr"
 	"pegasus/lianjia"
+	"pegasus/pki"
 	"pegasus/uri"
 	"pegasus/util"
-	"strconv"
-	"strings"
 )
 
 func getMasterAddr() (ip string, port int, err error) {
-	url := &util.HttpUrl{
-		IP:   "127.0.0.1",
-		Port: 10086,
-		Uri:  uri.CfgMasterUri,
-	}
-	addr, err := util.HttpGet(url)
-	if err != nil {
+	inst, err := cfgmgr.ResolveService(cfgmgr.Bootstrap.CfgServerIP, cfgmgr.SERVICE_ROLE_MASTER)
+	if errors.Is(err, util.ErrNotFound) {
+		err = fmt.Errorf("Master not started yet, %v", err)
 		return
-	}
-	toks := strings.Split(addr, ":")
-	if len(toks) != 2 {
-		err = fmt.Errorf("master addr %s invalid", addr)
+	} else if err != nil {
 		return
 	}
-	ip = toks[0]
-	port, err = strconv.Atoi(toks[1])
+	ip, port, err = util.SplitAddr(inst.Addr)
 	if err != nil {
-		err = fmt.Errorf("master addr %s invalid", addr)
+		err = fmt.Errorf("master addr %s invalid", inst.Addr)
 		return
 	}
 	return
@@ -74,6 +66,12 @@ func startProj(ip string, port int) (string, error) {
 }
 
 func main() {
+	if err := cfgmgr.InitLayers(); err != nil {
+		panic(err)
+	}
+	if err := pki.InitFromLocalCfg(); err != nil {
+		panic(err)
+	}
 	masterIP, masterPort, err := getMasterAddr()
 	if err != nil {
 		panic(err)
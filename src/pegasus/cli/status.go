@@ -16,8 +16,7 @@ import (
 )
 
 const (
-	MONITOR_STATUS_INTERVAL = 1 * time.Second
-	SHOW_STATUS_INTERVAL    = 1 * time.Second
+	SHOW_STATUS_INTERVAL = 1 * time.Second
 )
 
 func isTerminal() bool {
@@ -48,6 +47,7 @@ type JobMeta struct {
 }
 
 type TaskMeta struct {
+	Tid        string
 	Kind       string
 	Desc       string
 	StartTs    time.Time
@@ -305,6 +305,8 @@ type progressMgr struct {
 	events    []projEvent
 	lastJobid string
 	lastLine  string
+	// Seq of the last event handled from master
+	lastEventId string
 }
 
 func (mgr *progressMgr) init(ip string, port int, projId string) *progressMgr {
@@ -325,12 +327,22 @@ func (mgr *progressMgr) fetch() error {
 		return err
 	}
 	saveTo(data)
-	if err := json.Unmarshal([]byte(data), mgr.pmeta); err != nil {
+	pmeta := new(ProjMeta)
+	if err := json.Unmarshal([]byte(data), pmeta); err != nil {
 		return fmt.Errorf("Fail to unmarshal proj status, %v", err)
 	}
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.pmeta = pmeta
 	return nil
 }
 
+func (mgr *progressMgr) finished() bool {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	return mgr.pmeta.Finished
+}
+
 func (mgr *progressMgr) handleEvents() error {
 	mgr.mutex.Lock()
 	defer mgr.mutex.Unlock()
@@ -381,16 +393,6 @@ func (mgr *progressMgr) newEvent(jmeta *JobMeta) projEvent {
 	return evt
 }
 
-func (mgr *progressMgr) update() error {
-	if err := mgr.fetch(); err != nil {
-		return err
-	}
-	if err := mgr.handleEvents(); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (mgr *progressMgr) show() bool {
 	msg, finished := mgr.formatShowMsg()
 	mgr.clearLastLine()
@@ -483,18 +485,7 @@ func (mgr *progressMgr) run() {
 			}
 		}
 	}()
-	ticker := time.NewTicker(MONITOR_STATUS_INTERVAL)
-	for _ = range ticker.C {
-		if err := mgr.fetch(); err != nil {
-			panic(err)
-		}
-		if err := mgr.update(); err != nil {
-			panic(err)
-		}
-		if mgr.pmeta.Finished {
-			break
-		}
-	}
+	mgr.watch()
 	wg.Wait()
 	if mgr.pmeta != nil {
 		msg := boldText(fmt.Sprintf("Project done, taken %s.", mgr.cost()))
@@ -4,20 +4,48 @@ import (
 	"database/sql"
 	"fmt"
 	"pegasus/log"
+	"pegasus/util"
 
 	"github.com/go-gorp/gorp"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 const (
 	MYSQL_NAME = "mysql"
-	MYSQL_DSN  = "root:root@tcp(127.0.0.1:3306)/%s?charset=utf8mb4"
 )
 
+// DSN with the password resolved, addr for logs.
+func makeMysqlDsn(c *DbCfg, dbName string) (dsn, addr string, err error) {
+	passwd, err := c.Password.Value()
+	if err != nil {
+		return "", "", fmt.Errorf("Fail to resolve db password, %v", err)
+	}
+	mc := mysql.NewConfig()
+	mc.User = c.User
+	mc.Passwd = passwd
+	mc.Net = "tcp"
+	mc.Addr = util.JoinAddr(c.Host, c.Port)
+	mc.DBName = dbName
+	mc.Params = c.Params
+	return mc.FormatDSN(), fmt.Sprintf("%s@%s/%s", c.User, mc.Addr, dbName), nil
+}
+
 func OpenMysqlDatabase(dbName string) (*Database, error) {
+	c, err := getDbCfg()
+	if err != nil {
+		return nil, err
+	}
+	if c.DbName != "" {
+		dbName = c.DbName
+	}
+	dsn, addr, err := makeMysqlDsn(c, dbName)
+	if err != nil {
+		return nil, err
+	}
 	d := &Database{
 		driverName: MYSQL_NAME,
-		dsn:        fmt.Sprintf(MYSQL_DSN, dbName),
+		dsn:        dsn,
+		addr:       addr,
 		dbName:     dbName,
 	}
 	if err := d.open(); err != nil {
@@ -28,16 +56,18 @@ func OpenMysqlDatabase(dbName string) (*Database, error) {
 
 type Database struct {
 	driverName string
-	dsn        string
-	dbName     string
-	db         *sql.DB
+	// With the password, never logged
+	dsn    string
+	addr   string
+	dbName string
+	db     *sql.DB
 }
 
 func (d *Database) open() (err error) {
-	log.Info("Open database %s for %s", d.driverName, d.dbName)
+	log.Info("Open database %s at %s", d.driverName, d.addr)
 	d.db, err = sql.Open(d.driverName, d.dsn)
 	if err != nil {
-		log.Error("Fail to open %s, %s, %v", d.driverName, d.dsn, err)
+		log.Error("Fail to open %s at %s, %v", d.driverName, d.addr, err)
 		return err
 	}
 	if err := d.prepareDb(d.dbName); err != nil {
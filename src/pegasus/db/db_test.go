@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"pegasus/util"
+)
+
+func TestMakeMysqlDsn(t *testing.T) {
+	os.Setenv("PEGASUS_SECRET_DB_PASSWORD", "p@ss")
+	defer os.Unsetenv("PEGASUS_SECRET_DB_PASSWORD")
+	c := &DbCfg{
+		Host:     "::1",
+		Port:     3307,
+		User:     "pegasus",
+		Password: "db.password",
+		Params:   map[string]string{"charset": "utf8mb4"},
+	}
+	dsn, addr, err := makeMysqlDsn(c, "lianjia")
+	if err != nil {
+		t.Fatalf("Fail to make dsn, %v", err)
+	}
+	expect := "pegasus:p@ss@tcp([::1]:3307)/lianjia?charset=utf8mb4"
+	if dsn != expect {
+		t.Fatalf("Get dsn %q, expect %q", dsn, expect)
+	}
+	if strings.Contains(addr, "p@ss") {
+		t.Fatalf("Password in addr %q for logs", addr)
+	}
+	c.Password = "db.missing"
+	if _, _, err := makeMysqlDsn(c, "lianjia"); err == nil {
+		t.Fatalf("Make dsn with missing password, expect error")
+	}
+}
+
+func TestOpenBeforeInit(t *testing.T) {
+	if _, err := OpenMysqlDatabase("lianjia"); !errors.Is(err, util.ErrInternal) {
+		t.Fatalf("Open db before cfg pulled, get %v, expect internal error", err)
+	}
+}
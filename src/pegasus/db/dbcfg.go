@@ -0,0 +1,68 @@
+package db
+
+import (
+	"fmt"
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/util"
+	"sync/atomic"
+)
+
+// Connection to MySQL, the password is given by the name of a secret, see
+// cfgmgr.Secret.
+type DbCfg struct {
+	Host     string `cfg:"required"`
+	Port     int
+	User     string `cfg:"required"`
+	Password cfgmgr.Secret
+	// Taken over the one opened by name if set
+	DbName string
+	// Such as charset and timeouts, see github.com/go-sql-driver/mysql
+	Params map[string]string
+}
+
+var DCfg = new(DbCfg)
+var DCfgDef = &DbCfg{
+	Host:     "127.0.0.1",
+	Port:     3306,
+	User:     "root",
+	Password: "db.password",
+	Params:   map[string]string{"charset": "utf8mb4"},
+}
+
+// Copy of DCfg, replaced as a whole on change so that databases opened
+// concurrently never see a partial update.
+var dbCfg atomic.Value
+
+// Error until pulled from cfg server by InitDb, the compiled default is
+// never taken silently.
+func getDbCfg() (*DbCfg, error) {
+	if c, ok := dbCfg.Load().(*DbCfg); ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w, db cfg not pulled from cfg server, InitDb first", util.ErrInternal)
+}
+
+func RegisterCfg() {
+	cfgmgr.RegisterCfgEntry(DCfg, DCfgDef)
+	cfgmgr.RegisterCfgValidator(DCfg, cfgmgr.IntRange("Port", 1, 65535))
+}
+
+// getDbCfg is kept up to date once cfgmgr.WatchCfg is started, taking effect
+// as databases are opened again.
+func InitDb(cfgserver string) error {
+	RegisterCfg()
+	if err := cfgmgr.RegisterLayeredCfg(DCfg, DCfgDef); err != nil {
+		return err
+	}
+	if err := cfgmgr.PullCfg(cfgserver, DCfg); err != nil {
+		return err
+	}
+	c := *DCfg
+	dbCfg.Store(&c)
+	log.Info("db cfg %+v", c)
+	cfgmgr.Subscribe(DCfg, func(cOld, cNew interface{}) {
+		dbCfg.Store(cNew.(*DbCfg))
+	})
+	return nil
+}
@@ -10,11 +10,16 @@ import (
 	"pegasus/util"
 )
 
-var cfgServerIP = "127.0.0.1"
+// From bootstrap cfg
+var cfgServerIP string
 
 func initLogger() error {
+	level, err := log.GetLogLevel(cfgmgr.Bootstrap.LogLevel)
+	if err != nil {
+		return err
+	}
 	consoleLogger := &log.ConsoleLogger{
-		Level: log.LevelInfo,
+		Level: level,
 	}
 	if err := log.RegisterLogger(consoleLogger); err != nil {
 		return err
@@ -33,38 +38,32 @@ func getCfg() {
 	fmt.Printf("DummyCfg, Field1 %d, Field2 %s\n", c.Field1, c.Field2)
 }
 
-func registerAsMaster() {
-	url := &util.HttpUrl{
-		IP:   cfgServerIP,
-		Port: 10086,
-		Uri:  uri.CfgMasterUri,
+func registerService() {
+	inst := &cfgmgr.ServiceInstance{
+		Role: "dummy",
+		Addr: "127.0.0.1:1",
 	}
-	if _, err := util.HttpPostStr(url, ""); err != nil {
-		log.Error("Fail to register as master, %v", err)
+	if _, err := cfgmgr.RegisterService(cfgServerIP, inst); err != nil {
+		log.Error("Fail to register service, %v", err)
 	} else {
-		log.Info("Register as master succeed!")
+		log.Info("Register service succeed!")
 	}
 }
 
 func getMasterAddr() string {
-	url := &util.HttpUrl{
-		IP:   cfgServerIP,
-		Port: 10086,
-		Uri:  uri.CfgMasterUri,
-	}
-	if s, err := util.HttpGet(url); err != nil {
+	if inst, err := cfgmgr.ResolveService(cfgServerIP, cfgmgr.SERVICE_ROLE_MASTER); err != nil {
 		log.Error("Fail to get master addr, %v", err)
 		return ""
 	} else {
-		log.Info("Get master addr as %s", s)
-		return s
+		log.Info("Get master addr as %s", inst.Addr)
+		return inst.Addr
 	}
 }
 
 func postData() {
 	u := &util.HttpUrl{
 		IP:   cfgServerIP,
-		Port: 10086,
+		Port: cfgmgr.CfgServerPort,
 		Uri:  uri.CfgTestUri,
 	}
 	u.Query = make(url.Values)
@@ -75,7 +74,7 @@ func postData() {
 func echoIp() {
 	u := &util.HttpUrl{
 		IP:   cfgServerIP,
-		Port: 10086,
+		Port: cfgmgr.CfgServerPort,
 		Uri:  uri.CfgEchoIpUri,
 	}
 	if s, err := util.HttpGet(u); err != nil {
@@ -86,9 +85,13 @@ func echoIp() {
 }
 
 func main() {
+	if err := cfgmgr.InitLayers(); err != nil {
+		panic(err)
+	}
+	cfgServerIP = cfgmgr.Bootstrap.CfgServerIP
 	initLogger()
 	cfgmgr.WaitForCfgServerUp(cfgServerIP)
-	registerAsMaster()
+	registerService()
 	getMasterAddr()
 	postData()
 	echoIp()
@@ -2,11 +2,10 @@ package lianjia
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"pegasus/log"
-	"pegasus/rate"
 	"pegasus/task"
-	"pegasus/util"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,6 +17,8 @@ import (
 const (
 	JOB_KIND_GET_APARTMENTS  = "Lianjia Crawler: Get apartments"
 	TASK_KIND_GET_APARTMENTS = JOB_KIND_GET_APARTMENTS
+
+	TASKLET_TIMEOUT_GET_APARTMENTS = 30 * time.Second
 )
 
 type Apartment struct {
@@ -132,9 +133,9 @@ func (job *JobGetApartments) GetNextTask(tid string) *task.TaskSpec {
 
 func (job *JobGetApartments) ReduceTasks(reports []*task.TaskReport) error {
 	for _, report := range reports {
-		apartments := new(RegionApartments)
-		if err := util.FitDataInto(report.Output, &apartments); err != nil {
-			return err
+		apartments, ok := report.Output.(*RegionApartments)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		job.apartments[apartments.RegionAbbr] = apartments.Apartments
 	}
@@ -157,6 +158,14 @@ func (job *JobGetApartments) GetTaskGen() task.TaskGenerator {
 	return TaskGenGetApartments
 }
 
+func (job *JobGetApartments) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &TspecGetApartments{},
+		Output:  &RegionApartments{},
+		Version: 1,
+	}
+}
+
 func (job *JobGetApartments) GetReport() string {
 	cnt := 0
 	for _, a := range job.apartments {
@@ -170,12 +179,26 @@ type TspecGetApartments struct {
 	RegionInfo *Region
 }
 
+func (spec *TspecGetApartments) Validate() error {
+	if spec.RegionInfo == nil || spec.RegionInfo.Abbr == "" {
+		return fmt.Errorf("No region given")
+	}
+	if spec.RegionInfo.MaxPage <= 0 {
+		return fmt.Errorf("Region %q max page %d invalid", spec.RegionInfo.Abbr,
+			spec.RegionInfo.MaxPage)
+	}
+	return nil
+}
+
 func TaskGenGetApartments(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskGetApartments)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(TspecGetApartments)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*TspecGetApartments)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.region = spec.RegionInfo
 	tsk.desc = spec.Desc
 	return tsk, nil
@@ -218,6 +241,10 @@ func (tsk *taskGetApartments) GetTaskletCnt() int {
 	return tsk.maxPage
 }
 
+func (tsk *taskGetApartments) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_GET_APARTMENTS
+}
+
 func (tsk *taskGetApartments) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.curPage > tsk.maxPage {
 		return nil
@@ -231,8 +258,18 @@ func (tsk *taskGetApartments) GetNextTasklet(taskletid string) task.Tasklet {
 	return t
 }
 
-func (tsk *taskGetApartments) ReduceTasklets(tasklets []task.Tasklet) {
+func (tsk *taskGetApartments) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
 	set := make(map[string]bool)
+	if prev != nil {
+		output, ok := prev.(*RegionApartments)
+		if !ok {
+			return fmt.Errorf("Unexpected previous output %T", prev)
+		}
+		for _, apartment := range output.Apartments {
+			set[apartment.Aid] = true
+			tsk.apartments = append(tsk.apartments, apartment)
+		}
+	}
 	for _, t := range tasklets {
 		tasklet := t.(*taskletGetApartments)
 		for _, apartment := range tasklet.apartments {
@@ -244,6 +281,7 @@ func (tsk *taskGetApartments) ReduceTasklets(tasklets []task.Tasklet) {
 			tsk.apartments = append(tsk.apartments, apartment)
 		}
 	}
+	return nil
 }
 
 func (tsk *taskGetApartments) SetError(err error) {
@@ -272,17 +310,17 @@ func (t *taskletGetApartments) GetTaskletId() string {
 	return t.tid
 }
 
-func (t *taskletGetApartments) Execute(ctx task.TaskletCtx) error {
+func (t *taskletGetApartments) Execute(ctx context.Context, c task.TaskletCtx) error {
 	link := regionPgLink(t.region, t.page)
 	log.Info("Get apartments from %q", link)
-	resp, err := rate.GetHtml(link)
+	resp, err := getHtml(ctx, link)
 	if err != nil {
-		return fmt.Errorf("Fail to get apartments from %q, %v", link, err)
+		return fmt.Errorf("Fail to get apartments from %q, %w", link, err)
 	}
 	doc := soup.HTMLParse(resp)
 	tags, err := findAll(&doc, 0, 0, "div", "class", "info clear")
 	if err != nil {
-		return fmt.Errorf("Fail to get apartment list")
+		return task.NewPermanentErr(fmt.Errorf("Fail to get apartment list"))
 	}
 	t.apartments = make([]*Apartment, 0, len(tags))
 	for _, tag := range tags {
@@ -1,6 +1,7 @@
 package lianjia
 
 import (
+	"context"
 	"testing"
 
 	"pegasus/log"
@@ -23,7 +24,7 @@ func TestGetApartments(t *testing.T) {
 		page: 2,
 	}
 	ctx := new(dummyTaskletCtx)
-	if err := tasklet.Execute(ctx); err != nil {
+	if err := tasklet.Execute(context.Background(), ctx); err != nil {
 		t.Fatalf("tasklet execute fail, %v", err)
 	}
 	t.Logf("get apartments %d", len(tasklet.apartments))
@@ -40,7 +41,7 @@ func TestGetOneApartment(t *testing.T) {
 		page: 2,
 	}
 	link := regionPgLink(tasklet.region, tasklet.page)
-	resp, err := rate.GetHtml(link)
+	resp, err := rate.GetHtml(context.Background(), link)
 	if err != nil {
 		t.Fatalf("Fail to get apartments from %q, %v", link, err)
 	}
@@ -1,16 +1,19 @@
 package lianjia
 
 import (
+	"context"
 	"fmt"
 	"pegasus/log"
-	"pegasus/rate"
 	"pegasus/task"
+	"time"
 
 	"github.com/anaskhan96/soup"
 )
 
 const (
 	JOB_KIND_DISTRICTS = "Lianjia Crawler: Get districts"
+
+	GET_DISTRICTS_TIMEOUT = 30 * time.Second
 )
 
 type District struct {
@@ -52,7 +55,9 @@ func (job *JobDistricts) Init(env interface{}) error {
 func (job *JobDistricts) getAllDistricts() ([]*District, error) {
 	districts := make([]*District, 0)
 	link := ERSHOUFANG_LINK
-	resp, err := rate.GetHtml(link)
+	ctx, cancel := context.WithTimeout(context.Background(), GET_DISTRICTS_TIMEOUT)
+	defer cancel()
+	resp, err := getHtml(ctx, link)
 	if err != nil {
 		return nil, fmt.Errorf("Fail to get from %q, %v", link, err)
 	}
@@ -116,6 +121,10 @@ func (job *JobDistricts) GetTaskGen() task.TaskGenerator {
 	return nil
 }
 
+func (job *JobDistricts) GetTaskTypes() *task.TaskTypes {
+	return nil
+}
+
 func (job *JobDistricts) GetReport() string {
 	return fmt.Sprintf("Get %d districts.", len(job.districts))
 }
@@ -0,0 +1,91 @@
+package lianjia
+
+import (
+	"fmt"
+	"testing"
+
+	"pegasus/task"
+	"pegasus/util"
+)
+
+const BENCH_APARTMENT_CNT = 10000
+
+func makeUpdateDbSpec(cnt int) *task.TaskSpec {
+	apartments := make([]*Apartment, cnt)
+	for i := range apartments {
+		apartments[i] = &Apartment{
+			Location: fmt.Sprintf("南方新村 %d", i),
+			Aid:      fmt.Sprintf("1071043%05d", i),
+			Price:    72433,
+			Size:     "55.79",
+			Total:    404,
+			Nts:      1630972800,
+			Uts:      1630972800,
+			Subway:   1,
+			Station:  "莲花路",
+			Smeter:   500,
+			Floor:    "高",
+			Tfloor:   6,
+			Year:     1994,
+			Withlift: "无",
+			Visitcnt: 13,
+		}
+	}
+	return &task.TaskSpec{
+		Tid:  "tsk-bench-0",
+		Kind: TASK_KIND_UPDATE_DB,
+		Spec: &TspecUpdateDb{
+			Region:     "gumei",
+			Apartments: apartments,
+		},
+	}
+}
+
+func benchmarkPayload(b *testing.B, mime string, compress bool) {
+	// Registered by taskreg as the project is, which the package can't import
+	types := new(JobUpdateDb).GetTaskTypes()
+	util.RegisterPayloadTypes(types.Spec, types.Output)
+	tspec := makeUpdateDbSpec(BENCH_APARTMENT_CNT)
+	size := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := util.EncodePayload(tspec, mime, compress)
+		if err != nil {
+			b.Fatalf("Fail to encode, %v", err)
+		}
+		size = len(buf)
+		decoded := new(task.TaskSpec)
+		if err := util.DecodePayload(buf, mime, compress, decoded); err != nil {
+			b.Fatalf("Fail to decode, %v", err)
+		}
+		// Typed already as gob, or decoded into the type as by taskreg
+		spec, ok := decoded.Spec.(*TspecUpdateDb)
+		if !ok {
+			spec = new(TspecUpdateDb)
+			if err := util.FitDataIntoStrict(decoded.Spec, spec); err != nil {
+				b.Fatalf("Fail to decode spec, %v", err)
+			}
+		}
+		if len(spec.Apartments) != BENCH_APARTMENT_CNT {
+			b.Fatalf("Get %d apartments, expect %d", len(spec.Apartments),
+				BENCH_APARTMENT_CNT)
+		}
+	}
+	b.ReportMetric(float64(size), "bytes/payload")
+}
+
+func BenchmarkPayloadJson(b *testing.B) {
+	benchmarkPayload(b, util.MIME_JSON, false)
+}
+
+func BenchmarkPayloadJsonGzip(b *testing.B) {
+	benchmarkPayload(b, util.MIME_JSON, true)
+}
+
+func BenchmarkPayloadGob(b *testing.B) {
+	benchmarkPayload(b, util.MIME_GOB, false)
+}
+
+func BenchmarkPayloadGobGzip(b *testing.B) {
+	benchmarkPayload(b, util.MIME_GOB, true)
+}
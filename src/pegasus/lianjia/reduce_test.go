@@ -0,0 +1,54 @@
+package lianjia
+
+import (
+	"reflect"
+	"testing"
+
+	"pegasus/task"
+)
+
+// Output of the previous attempt merges with that of tasklets done in the
+// resumed one.
+func TestReduceUpdateDbResume(t *testing.T) {
+	tsk := &taskUpdateDb{region: "gumei"}
+	prev := &UpdateDbStats{Region: "gumei", Inserted: 3, Updated: 1}
+	tasklets := []task.Tasklet{
+		&taskletUpdateDb{stats: UpdateDbStats{Inserted: 2, Updated: 5}},
+		&taskletUpdateDb{stats: UpdateDbStats{Inserted: 1}},
+	}
+	if err := tsk.ReduceTasklets(prev, tasklets); err != nil {
+		t.Fatalf("Fail to reduce tasklets, %v", err)
+	}
+	expect := &UpdateDbStats{Region: "gumei", Inserted: 6, Updated: 6}
+	if output := tsk.GetOutput(); !reflect.DeepEqual(output, expect) {
+		t.Fatalf("Get output %+v, expect %+v", output, expect)
+	}
+	if err := new(taskUpdateDb).ReduceTasklets([]int{1}, nil); err == nil {
+		t.Fatalf("Reduce with previous output of wrong type, expect error")
+	}
+}
+
+func TestReduceRegionMaxpageResume(t *testing.T) {
+	tsk := &taskRegionMaxpage{regions: []*Region{
+		{Abbr: "gumei"},
+		{Abbr: "jinhui"},
+		{Abbr: "xinzhuang"},
+	}}
+	// Done in the resumed attempt
+	tsk.regions[2].MaxPage = 9
+	prev := []*Region{
+		{Abbr: "gumei", MaxPage: 3},
+		{Abbr: "jinhui"},
+		{Abbr: "xinzhuang"},
+	}
+	if err := tsk.ReduceTasklets(prev, nil); err != nil {
+		t.Fatalf("Fail to reduce tasklets, %v", err)
+	}
+	maxpages := make([]int, 0, len(tsk.regions))
+	for _, r := range tsk.GetOutput().([]*Region) {
+		maxpages = append(maxpages, r.MaxPage)
+	}
+	if expect := []int{3, 0, 9}; !reflect.DeepEqual(maxpages, expect) {
+		t.Fatalf("Get maxpages %v, expect %v", maxpages, expect)
+	}
+}
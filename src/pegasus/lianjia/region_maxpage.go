@@ -1,15 +1,16 @@
 package lianjia
 
 import (
+	"context"
 	"fmt"
 	"pegasus/log"
-	"pegasus/rate"
 	"pegasus/task"
 	"pegasus/util"
 	"pegasus/workgroup"
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/anaskhan96/soup"
 )
@@ -17,6 +18,8 @@ import (
 const (
 	JOB_KIND_REGION_MAXPAGE  = "Lianjia Crawler: Get region maxpage"
 	TASK_KIND_REGION_MAXPAGE = JOB_KIND_REGION_MAXPAGE
+
+	TASKLET_TIMEOUT_REGION_MAXPAGE = 30 * time.Second
 )
 
 type JobRegionMaxpage struct {
@@ -36,7 +39,7 @@ func (job *JobRegionMaxpage) AppendInput(input interface{}) {
 
 func (job *JobRegionMaxpage) Init(env interface{}) error {
 	job.taskSize = len(job.regions)
-	job.grpSize = workgroup.WgCfg.WorkerExecutorCnt
+	job.grpSize = workgroup.GetWgCfg().WorkerExecutorCnt
 	if job.grpSize <= 0 {
 		return fmt.Errorf("WorkerExecutorCnt <= 0")
 	}
@@ -78,9 +81,9 @@ func (job *JobRegionMaxpage) GetNextTask(tid string) *task.TaskSpec {
 
 func (job *JobRegionMaxpage) ReduceTasks(reports []*task.TaskReport) error {
 	for _, report := range reports {
-		regions := make([]*Region, 0)
-		if err := util.FitDataInto(report.Output, &regions); err != nil {
-			return err
+		regions, ok := report.Output.([]*Region)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		for _, r := range regions {
 			region, ok := job.regionTbl[r.Abbr]
@@ -122,6 +125,14 @@ func (job *JobRegionMaxpage) GetTaskGen() task.TaskGenerator {
 	return TaskGenRegionMaxpage
 }
 
+func (job *JobRegionMaxpage) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &TspecRegionMaxpage{},
+		Output:  []*Region{},
+		Version: 1,
+	}
+}
+
 func (job *JobRegionMaxpage) GetReport() string {
 	return fmt.Sprintf("Get %d regions, total pages %d.", len(job.regions), job.totalPages)
 }
@@ -130,12 +141,22 @@ type TspecRegionMaxpage struct {
 	Regions []*Region
 }
 
+func (spec *TspecRegionMaxpage) Validate() error {
+	if len(spec.Regions) == 0 {
+		return fmt.Errorf("No regions given")
+	}
+	return nil
+}
+
 func TaskGenRegionMaxpage(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskRegionMaxpage)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(TspecRegionMaxpage)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*TspecRegionMaxpage)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.regions = spec.Regions
 	s := make([]string, len(tsk.regions))
 	for i, r := range tsk.regions {
@@ -180,6 +201,10 @@ func (tsk *taskRegionMaxpage) GetTaskletCnt() int {
 	return tsk.totalRegion
 }
 
+func (tsk *taskRegionMaxpage) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_REGION_MAXPAGE
+}
+
 func (tsk *taskRegionMaxpage) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.nextRegion >= tsk.totalRegion {
 		return nil
@@ -192,8 +217,24 @@ func (tsk *taskRegionMaxpage) GetNextTasklet(taskletid string) task.Tasklet {
 	return t
 }
 
-func (tsk *taskRegionMaxpage) ReduceTasklets(tasklets []task.Tasklet) {
-	return
+func (tsk *taskRegionMaxpage) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
+	if prev == nil {
+		return nil
+	}
+	regions, ok := prev.([]*Region)
+	if !ok {
+		return fmt.Errorf("Unexpected previous output %T", prev)
+	}
+	maxpages := make(map[string]int, len(regions))
+	for _, r := range regions {
+		maxpages[r.Abbr] = r.MaxPage
+	}
+	for _, r := range tsk.regions {
+		if maxpage := maxpages[r.Abbr]; maxpage > 0 {
+			r.MaxPage = maxpage
+		}
+	}
+	return nil
 }
 
 func (tsk *taskRegionMaxpage) SetError(err error) {
@@ -217,19 +258,20 @@ func (t *taskletRegionMaxpage) GetTaskletId() string {
 	return t.tid
 }
 
-func (t *taskletRegionMaxpage) Execute(ctx task.TaskletCtx) error {
+func (t *taskletRegionMaxpage) Execute(ctx context.Context, c task.TaskletCtx) error {
 	link := regionLink(t.region)
 	log.Info("Get region maxpage from link %q", link)
-	resp, err := rate.GetHtml(link)
+	resp, err := getHtml(ctx, link)
 	if err != nil {
-		return fmt.Errorf("Fail to get region maxpage from %q, %v", link, err)
+		return fmt.Errorf("Fail to get region maxpage from %q, %w", link, err)
 	}
 	//fpath := fmt.Sprintf("/tmp/lianjia/%s", t.region.Abbr)
 	//fp, _ := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, 0755)
 	//defer fp.Close()
 	//fp.Write([]byte(resp))
 	if err := t.parse(resp); err != nil {
-		return fmt.Errorf("Fail to get region maxpage from %q, %v", link, err)
+		err = fmt.Errorf("Fail to get region maxpage from %q, %v", link, err)
+		return task.NewPermanentErr(err)
 	}
 	return nil
 }
@@ -1,13 +1,14 @@
 package lianjia
 
 import (
+	"context"
 	"fmt"
 	"pegasus/log"
-	"pegasus/rate"
 	"pegasus/task"
 	"pegasus/util"
 	"pegasus/workgroup"
 	"strings"
+	"time"
 
 	"github.com/anaskhan96/soup"
 )
@@ -15,6 +16,8 @@ import (
 const (
 	JOB_KIND_REGIONS  = "Lianjia Crawler: Get regions"
 	TASK_KIND_REGIONS = JOB_KIND_REGIONS
+
+	TASKLET_TIMEOUT_REGIONS = 30 * time.Second
 )
 
 type Region struct {
@@ -63,7 +66,7 @@ func (job *JobRegions) Init(env interface{}) error {
 		return fmt.Errorf("Fail to get proj env on init")
 	}
 	job.taskSize = len(job.districts)
-	job.grpSize = workgroup.WgCfg.WorkerExecutorCnt
+	job.grpSize = workgroup.GetWgCfg().WorkerExecutorCnt
 	if job.grpSize <= 0 {
 		return fmt.Errorf("WorkerExecutorCnt <= 0")
 	}
@@ -102,9 +105,9 @@ func (job *JobRegions) GetNextTask(tid string) *task.TaskSpec {
 
 func (job *JobRegions) ReduceTasks(reports []*task.TaskReport) error {
 	for _, report := range reports {
-		regions := make([]*Region, 0)
-		if err := util.FitDataInto(report.Output, &regions); err != nil {
-			return err
+		regions, ok := report.Output.([]*Region)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		for _, r := range regions {
 			if len(r.Dists) == 0 {
@@ -161,6 +164,14 @@ func (job *JobRegions) GetTaskGen() task.TaskGenerator {
 	return TaskGenRegions
 }
 
+func (job *JobRegions) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &TspecRegions{},
+		Output:  []*Region{},
+		Version: 1,
+	}
+}
+
 func (job *JobRegions) GetReport() string {
 	return fmt.Sprintf("Get %d regions.", len(job.regions))
 }
@@ -169,12 +180,22 @@ type TspecRegions struct {
 	Districts []*District
 }
 
+func (spec *TspecRegions) Validate() error {
+	if len(spec.Districts) == 0 {
+		return fmt.Errorf("No districts given")
+	}
+	return nil
+}
+
 func TaskGenRegions(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskRegions)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(TspecRegions)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*TspecRegions)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.districts = spec.Districts
 	names := make([]string, len(tsk.districts))
 	for i, d := range tsk.districts {
@@ -220,6 +241,10 @@ func (tsk *taskRegions) GetTaskletCnt() int {
 	return tsk.totalDist
 }
 
+func (tsk *taskRegions) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_REGIONS
+}
+
 func (tsk *taskRegions) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.nextDist >= tsk.totalDist {
 		return nil
@@ -232,11 +257,19 @@ func (tsk *taskRegions) GetNextTasklet(taskletid string) task.Tasklet {
 	return t
 }
 
-func (tsk *taskRegions) ReduceTasklets(tasklets []task.Tasklet) {
+func (tsk *taskRegions) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
+	if prev != nil {
+		regions, ok := prev.([]*Region)
+		if !ok {
+			return fmt.Errorf("Unexpected previous output %T", prev)
+		}
+		tsk.regions = append(tsk.regions, regions...)
+	}
 	for _, t := range tasklets {
 		tasklet := t.(*taskletRegions)
 		tsk.regions = append(tsk.regions, tasklet.regions...)
 	}
+	return nil
 }
 
 func (tsk *taskRegions) SetError(err error) {
@@ -296,15 +329,16 @@ func (t *taskletRegions) parse(resp string) error {
 	return nil
 }
 
-func (t *taskletRegions) Execute(ctx task.TaskletCtx) error {
+func (t *taskletRegions) Execute(ctx context.Context, c task.TaskletCtx) error {
 	link := distLink(t.district)
 	log.Info("Get regions from link %q", link)
-	resp, err := rate.GetHtml(link)
+	resp, err := getHtml(ctx, link)
 	if err != nil {
-		return fmt.Errorf("Fail to get regions from %q, %v", link, err)
+		return fmt.Errorf("Fail to get regions from %q, %w", link, err)
 	}
 	if err := t.parse(resp); err != nil {
-		return fmt.Errorf("Fail to get regions from %q, %v", link, err)
+		err = fmt.Errorf("Fail to get regions from %q, %v", link, err)
+		return task.NewPermanentErr(err)
 	}
 	return nil
 }
@@ -2,13 +2,38 @@ package lianjia
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"pegasus/log"
+	"pegasus/rate"
+	"pegasus/task"
+	"strings"
 
 	"github.com/anaskhan96/soup"
 	"golang.org/x/net/html"
 )
 
+// Lianjia answers with a human verification page instead of an error
+// status once the client ip is blocked.
+var bannedMarkers = []string{
+	"hip.lianjia.com/captcha",
+	"人机认证",
+}
+
+func getHtml(ctx context.Context, link string) (string, error) {
+	resp, err := rate.GetHtml(ctx, link)
+	if err != nil {
+		return "", err
+	}
+	for _, marker := range bannedMarkers {
+		if strings.Contains(resp, marker) {
+			err = fmt.Errorf("Human verification required for %q", link)
+			return "", task.NewBannedErr(err)
+		}
+	}
+	return resp, nil
+}
+
 func render(tag *soup.Root) string {
 	buf := bytes.NewBuffer(nil)
 	html.Render(buf, tag.Pointer)
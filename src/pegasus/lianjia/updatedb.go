@@ -1,13 +1,14 @@
 package lianjia
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"pegasus/log"
 	"pegasus/task"
-	"pegasus/util"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-gorp/gorp"
 )
@@ -15,6 +16,8 @@ import (
 const (
 	JOB_KIND_UPDATE_DB  = "Lianjia Crawler: Update database"
 	TASK_KIND_UPDATE_DB = JOB_KIND_UPDATE_DB
+
+	TASKLET_TIMEOUT_UPDATE_DB = 10 * time.Minute
 )
 
 type UpdateDbStats struct {
@@ -81,9 +84,9 @@ func (job *JobUpdateDb) GetNextTask(tid string) *task.TaskSpec {
 func (job *JobUpdateDb) ReduceTasks(reports []*task.TaskReport) error {
 	job.stats = make(map[string]*UpdateDbStats)
 	for _, report := range reports {
-		stats := new(UpdateDbStats)
-		if err := util.FitDataInto(report.Output, stats); err != nil {
-			return err
+		stats, ok := report.Output.(*UpdateDbStats)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		job.stats[stats.Region] = stats
 	}
@@ -106,6 +109,14 @@ func (job *JobUpdateDb) GetTaskGen() task.TaskGenerator {
 	return TaskGenUpdateDb
 }
 
+func (job *JobUpdateDb) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &TspecUpdateDb{},
+		Output:  &UpdateDbStats{},
+		Version: 1,
+	}
+}
+
 func (job *JobUpdateDb) GetReport() string {
 	var total, inserted, updated int
 	for _, stats := range job.stats {
@@ -122,12 +133,22 @@ type TspecUpdateDb struct {
 	Apartments []*Apartment
 }
 
+func (spec *TspecUpdateDb) Validate() error {
+	if spec.Region == "" {
+		return fmt.Errorf("No region given")
+	}
+	return nil
+}
+
 func TaskGenUpdateDb(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskUpdateDb)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(TspecUpdateDb)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*TspecUpdateDb)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.region = spec.Region
 	tsk.apartments = spec.Apartments
 	tsk.desc = fmt.Sprintf("Update db for %s", tsk.region)
@@ -170,6 +191,10 @@ func (tsk *taskUpdateDb) GetTaskletCnt() int {
 	return 1
 }
 
+func (tsk *taskUpdateDb) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_UPDATE_DB
+}
+
 func (tsk *taskUpdateDb) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.done {
 		return nil
@@ -183,13 +208,22 @@ func (tsk *taskUpdateDb) GetNextTasklet(taskletid string) task.Tasklet {
 	return t
 }
 
-func (tsk *taskUpdateDb) ReduceTasklets(tasklets []task.Tasklet) {
+func (tsk *taskUpdateDb) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
 	tsk.stats.Region = tsk.region
+	if prev != nil {
+		stats, ok := prev.(*UpdateDbStats)
+		if !ok {
+			return fmt.Errorf("Unexpected previous output %T", prev)
+		}
+		tsk.stats.Inserted += stats.Inserted
+		tsk.stats.Updated += stats.Updated
+	}
 	for _, t := range tasklets {
 		tasklet := t.(*taskletUpdateDb)
 		tsk.stats.Inserted += tasklet.stats.Inserted
 		tsk.stats.Updated += tasklet.stats.Updated
 	}
+	return nil
 }
 
 func (tsk *taskUpdateDb) SetError(err error) {
@@ -209,6 +243,7 @@ type taskletUpdateDb struct {
 	region            string
 	apartments        []*Apartment
 	dbmap             *gorp.DbMap
+	executor          gorp.SqlExecutor
 	dataTblName       string
 	dataChangeTblName string
 	metaChangeTblName string
@@ -219,12 +254,13 @@ func (t *taskletUpdateDb) GetTaskletId() string {
 	return t.tid
 }
 
-func (t *taskletUpdateDb) Execute(ctx task.TaskletCtx) error {
+func (t *taskletUpdateDb) Execute(ctx context.Context, c task.TaskletCtx) error {
 	dbmap, err := getDbmap()
 	if err != nil {
 		return fmt.Errorf("Fail to get dbmap, %v", err)
 	}
 	t.dbmap = dbmap
+	t.executor = dbmap.WithContext(ctx)
 	defer putDbmap()
 	if err := t.addTables(); err != nil {
 		return fmt.Errorf("Fail to add tables, %v", err)
@@ -249,7 +285,7 @@ func (t *taskletUpdateDb) addTables() error {
 }
 
 func (t *taskletUpdateDb) updateApartments() (err error) {
-	objbuf := new(objBuf).init(t.dbmap)
+	objbuf := new(objBuf).init(t.executor)
 	oldApartments, err := t.getOldApartments()
 	if err != nil {
 		return err
@@ -278,7 +314,7 @@ func (t *taskletUpdateDb) updateApartments() (err error) {
 func (t *taskletUpdateDb) getOldApartments() (map[string]*Apartment, error) {
 	var apartments []*Apartment
 	query := fmt.Sprintf("SELECT * FROM %s", t.dataTblName)
-	_, err := t.dbmap.Select(&apartments, query)
+	_, err := t.executor.Select(&apartments, query)
 	if err != nil {
 		log.Error("Fail to get apartments, %v", err)
 		return nil, err
@@ -398,11 +434,11 @@ type objBuf struct {
 	nextUpdate int
 	objsInsert []interface{}
 	objsUpdate []interface{}
-	dbmap      *gorp.DbMap
+	dbmap      gorp.SqlExecutor
 	method     int
 }
 
-func (buf *objBuf) init(dbmap *gorp.DbMap) *objBuf {
+func (buf *objBuf) init(dbmap gorp.SqlExecutor) *objBuf {
 	buf.nextInsert = 0
 	buf.nextUpdate = 0
 	buf.objsInsert = make([]interface{}, OBJ_BUF_SIZE)
@@ -503,7 +539,7 @@ func RunTasklet() {
 		region:     "test",
 		apartments: testApartments,
 	}
-	if err := tasklet.Execute(nil); err != nil {
+	if err := tasklet.Execute(context.Background(), nil); err != nil {
 		panic(err)
 	}
 }
@@ -2,6 +2,7 @@ package log
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -28,6 +29,16 @@ const (
 	LevelAlloff
 )
 
+// Case insensitive, as given by GetLogLevelStr.
+func GetLogLevel(s string) (int, error) {
+	for _, level := range []int{LevelDebug, LevelInfo, LevelError, LevelAlloff} {
+		if strings.EqualFold(s, GetLogLevelStr(level)) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q", s)
+}
+
 func GetLogLevelStr(level int) string {
 	switch level {
 	case LevelDebug:
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/uri"
+	"pegasus/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_PROJ_STARTED    = "proj_started"
+	EVENT_PROJ_FINISHED   = "proj_finished"
+	EVENT_JOB_STARTED     = "job_started"
+	EVENT_JOB_FINISHED    = "job_finished"
+	EVENT_TASK_DISPATCHED = "task_dispatched"
+	EVENT_TASK_STATUS     = "task_status"
+	EVENT_TASK_REPORTED   = "task_reported"
+	EVENT_TASK_REASSIGNED = "task_reassigned"
+	EVENT_TASK_FAILED     = "task_failed"
+	EVENT_WORKER_STATUS   = "worker_status"
+	// Sent instead of the missed events when a client falls too far behind,
+	// the client should refetch the project status.
+	EVENT_RESET = "reset"
+
+	EVENT_RING_SIZE      = 4096
+	EVENT_PING_INTERVAL  = 15 * time.Second
+	EVENT_LAST_ID_HEADER = "Last-Event-ID"
+)
+
+var events = new(eventBus).init()
+
+type Event struct {
+	Seq    uint64
+	Ts     time.Time
+	Type   string
+	ProjId string
+	JobId  string    `json:",omitempty"`
+	Tid    string    `json:",omitempty"`
+	Worker string    `json:",omitempty"`
+	From   string    `json:",omitempty"`
+	To     string    `json:",omitempty"`
+	ErrMsg string    `json:",omitempty"`
+	Proj   *ProjMeta `json:",omitempty"`
+	Job    *JobMeta  `json:",omitempty"`
+	Task   *TaskMeta `json:",omitempty"`
+}
+
+// Keep the latest events in a ring, so that clients could resume from the
+// last seq they got after reconnect.
+type eventBus struct {
+	mutex  sync.Mutex
+	seq    uint64
+	projId string
+	ring   []*Event
+	notify chan struct{}
+}
+
+func (bus *eventBus) init() *eventBus {
+	bus.ring = make([]*Event, EVENT_RING_SIZE)
+	bus.notify = make(chan struct{})
+	return bus
+}
+
+func (bus *eventBus) setProj(projId string) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.projId = projId
+}
+
+func (bus *eventBus) publish(evt *Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.seq++
+	evt.Seq = bus.seq
+	evt.Ts = time.Now()
+	evt.ProjId = bus.projId
+	bus.ring[evt.Seq%EVENT_RING_SIZE] = evt
+	close(bus.notify)
+	bus.notify = make(chan struct{})
+}
+
+// Return events after seq, and a channel closed on the next publish. Return
+// false if some of the events are already dropped from the ring.
+func (bus *eventBus) since(seq uint64) ([]*Event, <-chan struct{}, bool) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if seq > bus.seq {
+		// Seq from a previous run of master
+		return nil, bus.notify, false
+	}
+	if bus.seq-seq > EVENT_RING_SIZE {
+		return nil, bus.notify, false
+	}
+	evts := make([]*Event, 0, bus.seq-seq)
+	for s := seq + 1; s <= bus.seq; s++ {
+		evts = append(evts, bus.ring[s%EVENT_RING_SIZE])
+	}
+	return evts, bus.notify, true
+}
+
+// Events to send after seq, a single reset in place of those dropped, or
+// if seq is from a previous run of master.
+func (bus *eventBus) next(seq uint64) ([]*Event, <-chan struct{}) {
+	evts, notify, ok := bus.since(seq)
+	if !ok {
+		last := bus.lastSeq()
+		evts = []*Event{{Seq: last, Ts: time.Now(), Type: EVENT_RESET}}
+	}
+	return evts, notify
+}
+
+func (bus *eventBus) lastSeq() uint64 {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	return bus.seq
+}
+
+func publishJobEvent(typ string, jmeta *JobMeta) {
+	if jmeta == nil {
+		return
+	}
+	events.publish(&Event{
+		Type:   typ,
+		JobId:  jmeta.JobId,
+		ErrMsg: jmeta.ErrMsg,
+		Job:    jmeta,
+	})
+}
+
+func publishTaskEvent(typ string, tid, worker, errMsg string) {
+	jmeta, tmeta := jobctx.snapshotTaskMeta(tid)
+	if jmeta == nil {
+		return
+	}
+	events.publish(&Event{
+		Type:   typ,
+		JobId:  jmeta.JobId,
+		Tid:    tid,
+		Worker: worker,
+		ErrMsg: errMsg,
+		Job:    jmeta,
+		Task:   tmeta,
+	})
+}
+
+func publishWorkerEvent(w *Worker, from, to string) {
+	events.publish(&Event{
+		Type:   EVENT_WORKER_STATUS,
+		Worker: w.Label,
+		From:   from,
+		To:     to,
+	})
+}
+
+func getLastEventId(r *http.Request) (uint64, bool, error) {
+	s := r.Header.Get(EVENT_LAST_ID_HEADER)
+	if s == "" {
+		if err := r.ParseForm(); err != nil {
+			return 0, false, err
+		}
+		s = r.Form.Get(uri.MasterEventsSinceKey)
+	}
+	if s == "" {
+		return 0, false, nil
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid last event id %q, %v", s, err)
+	}
+	return seq, true, nil
+}
+
+func writeEvent(w http.ResponseWriter, evt *Event) error {
+	buf, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.Seq, evt.Type, buf)
+	return err
+}
+
+// Stream events as server-sent events. Without Last-Event-ID, only events
+// published from now on are sent.
+func projEventsHandler(w http.ResponseWriter, r *http.Request) {
+	seq, resume, err := getLastEventId(r)
+	if err != nil {
+		server.FmtResp(w, err, nil)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		server.FmtResp(w, fmt.Errorf("%w, streaming not supported", util.ErrInternal), nil)
+		return
+	}
+	if !resume {
+		seq = events.lastSeq()
+	}
+	w.Header().Set("Content-Type", util.MIME_EVENT_STREAM)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Info("Stream events to %s from seq %d", r.RemoteAddr, seq)
+	ctx := r.Context()
+	ping := time.NewTicker(EVENT_PING_INTERVAL)
+	defer ping.Stop()
+	for {
+		evts, notify := events.next(seq)
+		for _, evt := range evts {
+			if err := writeEvent(w, evt); err != nil {
+				log.Info("Stop streaming events to %s, %v", r.RemoteAddr, err)
+				return
+			}
+			seq = evt.Seq
+		}
+		flusher.Flush()
+		if err := waitForEvents(ctx, notify, ping.C, w, flusher); err != nil {
+			log.Info("Stop streaming events to %s, %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+func waitForEvents(ctx context.Context, notify <-chan struct{},
+	ping <-chan time.Time, w http.ResponseWriter, flusher http.Flusher) error {
+	for {
+		select {
+		case <-notify:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ping:
+			// Comment line, keeps idle connection from being cut
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func publishN(bus *eventBus, n int) {
+	for i := 0; i < n; i++ {
+		bus.publish(&Event{Type: EVENT_TASK_STATUS})
+	}
+}
+
+func TestEventBusSince(t *testing.T) {
+	bus := new(eventBus).init()
+	if evts, _, ok := bus.since(0); !ok || len(evts) != 0 {
+		t.Fatalf("Since 0 of empty bus, get %d events, ok %v", len(evts), ok)
+	}
+	publishN(bus, 3)
+	evts, notify, ok := bus.since(1)
+	if !ok || len(evts) != 2 || evts[0].Seq != 2 || evts[1].Seq != 3 {
+		t.Fatalf("Since 1, get %d events, ok %v", len(evts), ok)
+	}
+	publishN(bus, 1)
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("Notify not closed on publish")
+	}
+
+	// Ring holds exactly the latest EVENT_RING_SIZE events
+	bus = new(eventBus).init()
+	publishN(bus, EVENT_RING_SIZE+10)
+	last := uint64(EVENT_RING_SIZE + 10)
+	evts, _, ok = bus.since(last - EVENT_RING_SIZE)
+	if !ok || len(evts) != EVENT_RING_SIZE {
+		t.Fatalf("Since a full ring back, get %d events, ok %v", len(evts), ok)
+	}
+	for i, evt := range evts {
+		if evt.Seq != last-EVENT_RING_SIZE+1+uint64(i) {
+			t.Fatalf("Event %d with seq %d out of order", i, evt.Seq)
+		}
+	}
+	if _, _, ok := bus.since(last - EVENT_RING_SIZE - 1); ok {
+		t.Fatalf("Since beyond the ring, expect dropped")
+	}
+	if evts, _, ok := bus.since(last); !ok || len(evts) != 0 {
+		t.Fatalf("Since the last, get %d events, ok %v", len(evts), ok)
+	}
+	// Seq from a previous run of master
+	if _, _, ok := bus.since(last + 1); ok {
+		t.Fatalf("Since a seq ahead, expect dropped")
+	}
+}
+
+func TestEventBusNext(t *testing.T) {
+	bus := new(eventBus).init()
+	publishN(bus, EVENT_RING_SIZE+2)
+	last := uint64(EVENT_RING_SIZE + 2)
+	for _, seq := range []uint64{0, last + 100} {
+		evts, _ := bus.next(seq)
+		if len(evts) != 1 || evts[0].Type != EVENT_RESET || evts[0].Seq != last {
+			t.Fatalf("Next of %d, expect a single reset at %d, get %+v", seq, last, evts)
+		}
+		// Resume from the reset without another one
+		if evts, _ = bus.next(evts[0].Seq); len(evts) != 0 {
+			t.Fatalf("Next of reset, get %d events", len(evts))
+		}
+	}
+	evts, _ := bus.next(last - 1)
+	if len(evts) != 1 || evts[0].Type != EVENT_TASK_STATUS {
+		t.Fatalf("Next of %d, get %+v", last-1, evts)
+	}
+}
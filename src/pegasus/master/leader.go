@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/task"
+	"pegasus/taskreg"
+	"pegasus/util"
+	"time"
+)
+
+const (
+	// Worker label of tasks taken from the checkpoint
+	CHECKPOINT_LABEL = "checkpoint"
+	// Wait for workers to follow before resuming a project
+	RESUME_MAX_WAIT = 30 * time.Second
+)
+
+var leaderLease *cfgmgr.LeaderLease
+
+// Stand by until leadership is granted. Stop once it's lost, a standby
+// could have taken over the project already.
+func becomeLeader() {
+	log.Info("Campaign for leader as %s", masterSelf.Name)
+	leaderLease = cfgmgr.WaitForLeadership(cfgServerIP, masterSelf.Name, masterSelf.masterAddr)
+	go func() {
+		<-leaderLease.Lost()
+		panic(fmt.Errorf("Leadership of token %d lost, stop as master", leaderLease.Token()))
+	}()
+}
+
+// Tasks of the same kind and spec are taken as the same across masters.
+func checkpointKey(tspec *task.TaskSpec) string {
+	buf, err := json.Marshal(tspec.Spec)
+	if err != nil {
+		log.Error("Fail to marshal spec of task %q, no checkpoint, %v", tspec.Tid, err)
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(tspec.Kind + "\n"))
+	h.Write(buf)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func logCheckpointErr(err error) {
+	if errors.Is(err, util.ErrConflict) {
+		log.Error("Checkpoint refused, leadership taken over, %v", err)
+	} else {
+		log.Error("Fail to save checkpoint, %v", err)
+	}
+}
+
+func startCheckpoint(projId, projName, config string, startTs time.Time) {
+	ckpt := &cfgmgr.ProjCheckpoint{
+		Token:    leaderLease.Token(),
+		ProjId:   projId,
+		ProjName: projName,
+		Config:   config,
+		StartTs:  startTs,
+	}
+	if err := cfgmgr.PostProjCheckpoint(cfgServerIP, ckpt); err != nil {
+		logCheckpointErr(err)
+	}
+}
+
+func checkpointTaskReport(key string, report *task.TaskReport) {
+	if key == "" {
+		return
+	}
+	err := cfgmgr.PostProjCheckpointReport(cfgServerIP, leaderLease.Token(), key, report)
+	if err != nil {
+		logCheckpointErr(err)
+	}
+}
+
+func clearCheckpoint() {
+	if err := cfgmgr.DeleteProjCheckpoint(cfgServerIP, leaderLease.Token()); err != nil {
+		logCheckpointErr(err)
+	}
+}
+
+// Feed the report of a task done before takeover as if it's just reported.
+func reuseTaskReport(tspec *task.TaskSpec, saved *task.TaskReport) {
+	log.Info("Task %q done before takeover, reuse its report", tspec.Tid)
+	report := *saved
+	report.Tid = tspec.Tid
+	if saved.Status != nil {
+		status := *saved.Status
+		status.Tid = tspec.Tid
+		report.Status = &status
+	}
+	jobctx.incDispatched()
+	jobctx.updateTaskMetaForWorker(tspec.Tid, CHECKPOINT_LABEL)
+	jobctx.addTaskReport(&report)
+	publishTaskEvent(EVENT_TASK_REPORTED, tspec.Tid, CHECKPOINT_LABEL, "")
+	jobctx.incDone()
+}
+
+func decodeCheckpointReports(ckpt *cfgmgr.ProjCheckpoint) map[string]*task.TaskReport {
+	reports := make(map[string]*task.TaskReport, len(ckpt.Reports))
+	for key, buf := range ckpt.Reports {
+		report := new(task.TaskReport)
+		if err := json.Unmarshal(buf, report); err != nil {
+			log.Error("Skip bad report in checkpoint, %v", err)
+			continue
+		}
+		if err := taskreg.DecodeTaskReport(report); err != nil {
+			log.Error("Skip report of task %q in checkpoint, %v", report.Tid, err)
+			continue
+		}
+		reports[key] = report
+	}
+	return reports
+}
+
+// Take over the project the former leader left, if any. Tasks reported
+// done in the checkpoint are not dispatched again.
+func resumeFromCheckpoint() error {
+	ckpt, err := cfgmgr.FetchProjCheckpoint(cfgServerIP)
+	if errors.Is(err, util.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Fail to fetch checkpoint, %v", err)
+	}
+	proj := taskreg.GetProj(ckpt.ProjName)
+	if proj == nil {
+		log.Error("Project %q of checkpoint not supported, drop it", ckpt.ProjName)
+		clearCheckpoint()
+		return nil
+	}
+	reports := decodeCheckpointReports(ckpt)
+	log.Info("Resume project %q from checkpoint, %d tasks done", ckpt.ProjId, len(reports))
+	go func() {
+		wmgr.waitForWorkers(RESUME_MAX_WAIT)
+		if err := resumeProj(proj, ckpt, reports); err != nil {
+			log.Error("Fail to resume project %q, %v", ckpt.ProjId, err)
+		}
+	}()
+	return nil
+}
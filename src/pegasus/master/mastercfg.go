@@ -1 +1,36 @@
 package main
+
+import (
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/workgroup"
+	"sync/atomic"
+)
+
+// Copy of workgroup.MCfg, replaced as a whole on change so that readers
+// never see a partial update.
+var masterCfg atomic.Value
+
+// Compiled default until pulled from cfg server.
+func getMasterCfg() *workgroup.MasterCfg {
+	if mc, ok := masterCfg.Load().(*workgroup.MasterCfg); ok {
+		return mc
+	}
+	return workgroup.MCfgDef
+}
+
+func initMasterCfg(cfgserver string) error {
+	if err := cfgmgr.RegisterLayeredCfg(workgroup.MCfg, workgroup.MCfgDef); err != nil {
+		return err
+	}
+	if err := cfgmgr.PullCfg(cfgserver, workgroup.MCfg); err != nil {
+		return err
+	}
+	mc := *workgroup.MCfg
+	masterCfg.Store(&mc)
+	log.Info("Master cfg %+v", mc)
+	cfgmgr.Subscribe(workgroup.MCfg, func(cOld, cNew interface{}) {
+		masterCfg.Store(cNew.(*workgroup.MasterCfg))
+	})
+	return nil
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"pegasus/log"
 	"pegasus/server"
 	"pegasus/task"
+	"pegasus/taskreg"
 	"pegasus/util"
 	"sync"
 	"time"
@@ -15,7 +15,6 @@ import (
 var jobctx = new(JobCtx)
 
 const (
-	BUF_TASK_CNT = 10
 	TASK_MAX_ERR = 0 // do not allow retry
 )
 
@@ -28,6 +27,7 @@ type TaskMeta struct {
 	WorkerLabel string
 	ErrCnt      int
 	ErrMsg      string
+	Attempt     int
 	Total       int
 	Done        int
 	Dispatched  bool
@@ -35,6 +35,28 @@ type TaskMeta struct {
 	Finished    bool
 	tspec       *task.TaskSpec
 	report      *task.TaskReport
+	ckptKey     string
+}
+
+// Keep the progress of a failed attempt in tspec, so that the task is
+// re-dispatched with only the remaining tasklets. Return false if the
+// attempt made no progress at all.
+func (tmeta *TaskMeta) updateResume(report *task.TaskReport) bool {
+	prev := tmeta.tspec.Resume
+	if prev != nil && len(report.Done) <= len(prev.Done) {
+		return false
+	} else if prev == nil && len(report.Done) == 0 {
+		return false
+	}
+	tmeta.Attempt++
+	tmeta.tspec.Resume = &task.TaskResume{
+		Attempt: tmeta.Attempt,
+		Done:    report.Done,
+		Output:  report.Output,
+	}
+	log.Info("Task %q attempt %d, %d tasklets done, %d remaining", tmeta.Tid,
+		tmeta.Attempt, len(report.Done), len(report.Remaining))
+	return true
 }
 
 func (tmeta *TaskMeta) snapshot() *TaskMeta {
@@ -47,6 +69,7 @@ func (tmeta *TaskMeta) snapshot() *TaskMeta {
 		WorkerLabel: tmeta.WorkerLabel,
 		ErrCnt:      tmeta.ErrCnt,
 		ErrMsg:      tmeta.ErrMsg,
+		Attempt:     tmeta.Attempt,
 		Total:       tmeta.Total,
 		Done:        tmeta.Done,
 		Dispatched:  tmeta.Dispatched,
@@ -104,11 +127,12 @@ func (m *JobMeta) allDone() bool {
 	return m.Total == m.Done
 }
 
-func (m *JobMeta) addTaskMeta(tspec *task.TaskSpec) {
+func (m *JobMeta) addTaskMeta(tspec *task.TaskSpec, ckptKey string) {
 	tmeta := &TaskMeta{
-		Tid:   tspec.Tid,
-		Kind:  tspec.Kind,
-		tspec: tspec,
+		Tid:     tspec.Tid,
+		Kind:    tspec.Kind,
+		tspec:   tspec,
+		ckptKey: ckptKey,
 	}
 	if _, ok := m.taskMetas[tspec.Tid]; ok {
 		log.Error("Task %q meta already set", tspec.Tid)
@@ -135,11 +159,17 @@ func (m *JobMeta) addTaskReport(report *task.TaskReport) {
 	}
 	tmeta.StartTs = report.StartTs
 	tmeta.EndTs = report.EndTs
-	if report.Err == "" {
+	if report.Aborted {
+		// Task aborted on purpose, it's given up, so leave the resume info
+		// alone. Late ones of attempts reassigned are dropped by wmgr.
+		tmeta.ErrMsg = report.Err
+	} else if report.Err == "" {
 		tmeta.report = report
 	} else {
-		tmeta.ErrCnt++
 		tmeta.ErrMsg = report.Err
+		if !tmeta.updateResume(report) {
+			tmeta.ErrCnt++
+		}
 	}
 }
 
@@ -164,6 +194,13 @@ func (m *JobMeta) snapshot() *JobMeta {
 			tmetas = append(tmetas, tmeta.snapshot())
 		}
 	}
+	jmeta := m.brief()
+	jmeta.TaskMetas = tmetas
+	return jmeta
+}
+
+// Snapshot without task metas.
+func (m *JobMeta) brief() *JobMeta {
 	return &JobMeta{
 		JobId:      m.JobId,
 		Kind:       m.Kind,
@@ -174,7 +211,6 @@ func (m *JobMeta) snapshot() *JobMeta {
 		Total:      m.Total,
 		Dispatched: m.Dispatched,
 		Done:       m.Done,
-		TaskMetas:  tmetas,
 		Report:     m.Report,
 	}
 }
@@ -195,8 +231,9 @@ func (ctx *JobCtx) start() {
 	defer ctx.mutex.Unlock()
 	log.Info("Reset job ctx")
 	ctx.shouldFinish = make(chan struct{})
-	ctx.todoTasks = make(chan *task.TaskSpec, BUF_TASK_CNT)
-	ctx.reassignedTasks = make(chan *task.TaskSpec, BUF_TASK_CNT)
+	bufCnt := getMasterCfg().BufTaskCnt
+	ctx.todoTasks = make(chan *task.TaskSpec, bufCnt)
+	ctx.reassignedTasks = make(chan *task.TaskSpec, bufCnt)
 	ctx.jobMeta = new(JobMeta).Init()
 	ctx.jobMeta.StartTs = time.Now()
 	ctx.jobMeta.JobId = fmt.Sprintf("job-%d-%d", time.Now().Unix(), jobctx.jobIdx)
@@ -215,7 +252,7 @@ func (ctx *JobCtx) assignJob(job task.Job, env interface{}) error {
 	log.Info("Assign and init job %q", job.GetKind())
 	if err := job.Init(env); err != nil {
 		err = fmt.Errorf("Fail to init job %q, %v", job.GetKind(), err)
-		log.Error(err.Error())
+		log.Error("%v", err)
 		return err
 	}
 	ctx.mutex.Lock()
@@ -245,10 +282,10 @@ func (ctx *JobCtx) aborted() bool {
 	}
 }
 
-func (ctx *JobCtx) addTaskMeta(tspec *task.TaskSpec) {
+func (ctx *JobCtx) addTaskMeta(tspec *task.TaskSpec, ckptKey string) {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	ctx.jobMeta.addTaskMeta(tspec)
+	ctx.jobMeta.addTaskMeta(tspec, ckptKey)
 }
 
 func (ctx *JobCtx) getTaskMeta(tid string) *TaskMeta {
@@ -317,6 +354,19 @@ func (ctx *JobCtx) incDone() {
 	}
 }
 
+func (ctx *JobCtx) snapshotTaskMeta(tid string) (*JobMeta, *TaskMeta) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.jobMeta == nil {
+		return nil, nil
+	}
+	tmeta, ok := ctx.jobMeta.taskMetas[tid]
+	if !ok {
+		return nil, nil
+	}
+	return ctx.jobMeta.brief(), tmeta.snapshot()
+}
+
 func (ctx *JobCtx) snapshotJobMeta() *JobMeta {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
@@ -345,6 +395,8 @@ func taskStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	jobctx.updateTaskStatus(status)
+	publishTaskEvent(EVENT_TASK_STATUS, status.Tid, "", "")
+	server.FmtResp(w, nil, nil)
 }
 
 func taskReportHandler(w http.ResponseWriter, r *http.Request) {
@@ -359,19 +411,11 @@ func taskReportHandler(w http.ResponseWriter, r *http.Request) {
 		server.FmtResp(w, err, nil)
 		return
 	}
-	body, err := util.HttpReadRequestJsonBody(r)
-	if err != nil {
-		log.Error("Fail to read request, %v", err)
-		server.FmtResp(w, err, nil)
-		return
-	}
 	log.Info("Get task report from %q", key)
-	//log.Debug("Task report from %q:\n%s", key, body)
 	report := new(task.TaskReport)
-	if err = json.Unmarshal(body, report); err != nil {
-		err = fmt.Errorf("Fail to unmarshal body for task report, %v, body:\n%s",
-			err, string(body))
-		log.Error(err.Error())
+	if err := util.HttpFitRequestInto(r, report); err != nil {
+		err = fmt.Errorf("Fail to read task report, %w", err)
+		log.Error("%v", err)
 		server.FmtResp(w, err, nil)
 		return
 	}
@@ -381,16 +425,29 @@ func taskReportHandler(w http.ResponseWriter, r *http.Request) {
 
 func handleTaskReport(key string, report *task.TaskReport) error {
 	log.Info("Handle task report from %q, task %q", key, report.Tid)
+	if err := taskreg.DecodeTaskReport(report); err != nil {
+		log.Error("Fail to decode task report, drop output, %v", err)
+		report.Output, report.Done = nil, nil
+		if report.Err == "" {
+			report.Err = err.Error()
+		}
+	}
 	if err := wmgr.handleTaskReport(jobctx, key, report); err != nil {
 		log.Error("Fail handle task report, %v", err)
 		return err
 	}
 	jobctx.addTaskReport(report)
-	if report.Err != "" {
+	publishTaskEvent(EVENT_TASK_REPORTED, report.Tid, key, report.Err)
+	if report.Aborted {
+		log.Info("Task %q was aborted, no reassign", report.Tid)
+	} else if report.Err != "" {
 		if m := jobctx.getTaskMeta(report.Tid); m != nil {
 			reassignTask(m.tspec)
 		}
 	} else {
+		if m := jobctx.getTaskMeta(report.Tid); m != nil {
+			checkpointTaskReport(m.ckptKey, report)
+		}
 		jobctx.incDone()
 	}
 	return nil
@@ -421,6 +478,12 @@ func taskDispatcher(ctx *JobCtx) {
 			log.Info("Job ctx was set aborted, exit dispatcher!")
 			break
 		}
+		// Fail early on bad spec rather than let workers reject it
+		if err := taskreg.DecodeTaskSpec(t); err != nil {
+			jobctx.setErr(err)
+			log.Error("Fail to decode task %q, exit dispatcher, %v", t.Tid, err)
+			break
+		}
 		workerName, err := wmgr.dispatchTask(t)
 		if err != nil {
 			jobctx.setErr(err)
@@ -429,6 +492,7 @@ func taskDispatcher(ctx *JobCtx) {
 		}
 		ctx.incDispatched()
 		ctx.updateTaskMetaForWorker(t.Tid, workerName)
+		publishTaskEvent(EVENT_TASK_DISPATCHED, t.Tid, workerName, "")
 	}
 	log.Info("Exit dispatcher")
 }
@@ -442,7 +506,14 @@ func assignTasks(ctx *JobCtx, job task.Job) error {
 			break
 		}
 		log.Info("Assign task %q", tspec.Tid)
-		jobctx.addTaskMeta(tspec)
+		key := checkpointKey(tspec)
+		jobctx.addTaskMeta(tspec, key)
+		if report := projctx.getResumedReport(key); report != nil {
+			// Not in the same routine, as the last one done finishes the job
+			go reuseTaskReport(tspec, report)
+			idx++
+			continue
+		}
 		select {
 		case jobctx.todoTasks <- tspec:
 			// do nothing
@@ -460,10 +531,12 @@ func reassignTask(tspec *task.TaskSpec) {
 	if errCnt > TASK_MAX_ERR {
 		err := fmt.Errorf("Task %q failed %d times, last error: %s",
 			tspec.Tid, errCnt, errMsg)
+		publishTaskEvent(EVENT_TASK_FAILED, tspec.Tid, "", err.Error())
 		jobctx.setErr(err)
 	} else {
 		jobctx.reassignedTasks <- tspec
 		jobctx.updateTaskMetaForWorker(tspec.Tid, "")
+		publishTaskEvent(EVENT_TASK_REASSIGNED, tspec.Tid, "", errMsg)
 	}
 }
 
@@ -476,6 +549,9 @@ func waitForJobDone(ctx *JobCtx) error {
 	close(ctx.todoTasks)
 	close(ctx.reassignedTasks)
 	err := ctx.jobMeta.getErr()
+	if err != nil {
+		wmgr.abortBusyTasks()
+	}
 	log.Info("Job %q done, err %v", ctx.curJob.GetKind(), err)
 	return err
 }
@@ -525,6 +601,7 @@ func jobRunner(job task.Job, env interface{}) error {
 	if err := jobctx.assignJob(job, env); err != nil {
 		return err
 	}
+	publishJobEvent(EVENT_JOB_STARTED, jobctx.snapshotJobMeta())
 	if jobctx.jobMeta.Total > 0 {
 		if err := splitJobAndRun(job); err != nil {
 			return err
@@ -541,5 +618,7 @@ func runJob(job task.Job, env interface{}) (*JobMeta, error) {
 	if err != nil {
 		jobctx.jobMeta.setErr(err)
 	}
-	return jobctx.snapshotJobMeta(), err
+	jmeta := jobctx.snapshotJobMeta()
+	publishJobEvent(EVENT_JOB_FINISHED, jmeta)
+	return jmeta, err
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"pegasus/task"
+)
+
+func TestUpdateResume(t *testing.T) {
+	cases := []struct {
+		prev    *task.TaskResume
+		done    []string
+		updated bool
+		attempt int
+	}{
+		{nil, []string{}, false, 0},
+		{nil, []string{"t-0"}, true, 1},
+		{&task.TaskResume{Attempt: 1, Done: []string{"t-0"}}, []string{"t-0"}, false, 1},
+		{&task.TaskResume{Attempt: 1, Done: []string{"t-0"}}, []string{"t-0", "t-1"}, true, 2},
+	}
+	for _, c := range cases {
+		tmeta := &TaskMeta{Tid: "t", tspec: &task.TaskSpec{Tid: "t", Resume: c.prev}}
+		if c.prev != nil {
+			tmeta.Attempt = c.prev.Attempt
+		}
+		report := &task.TaskReport{Err: "fail", Tid: "t", Done: c.done, Output: len(c.done)}
+		if updated := tmeta.updateResume(report); updated != c.updated {
+			t.Fatalf("Update resume from %+v with done %v, get %v, expect %v",
+				c.prev, c.done, updated, c.updated)
+		}
+		resume := tmeta.tspec.Resume
+		if !c.updated {
+			if resume != c.prev || tmeta.Attempt != c.attempt {
+				t.Fatalf("Get resume %+v without progress, expect %+v kept", resume, c.prev)
+			}
+			continue
+		}
+		expect := &task.TaskResume{Attempt: c.attempt, Done: c.done, Output: len(c.done)}
+		if tmeta.Attempt != c.attempt || !reflect.DeepEqual(resume, expect) {
+			t.Fatalf("Get attempt %d resume %+v, expect %+v", tmeta.Attempt, resume, expect)
+		}
+	}
+}
+
+// A failed attempt keeps the progress made for resume without counting
+// as an error, while one with no progress counts.
+func TestAddTaskReportResume(t *testing.T) {
+	m := new(JobMeta).Init()
+	tspec := &task.TaskSpec{Tid: "t", Kind: "test"}
+	m.addTaskMeta(tspec, "")
+	tmeta := m.getTaskMeta("t")
+	status := &task.TaskStatus{Tid: "t", Total: 4}
+	reports := []struct {
+		done   []string
+		errCnt int
+	}{
+		{[]string{"t-0", "t-1"}, 0},
+		{[]string{"t-0", "t-1"}, 1},
+		{[]string{"t-0", "t-1", "t-3"}, 1},
+	}
+	for _, r := range reports {
+		m.addTaskReport(&task.TaskReport{
+			Err:       "tasklet fails",
+			Tid:       "t",
+			Status:    status,
+			Output:    len(r.done),
+			Done:      r.done,
+			Remaining: []string{"t-2"},
+		})
+		if tmeta.ErrCnt != r.errCnt || tmeta.ErrMsg != "tasklet fails" {
+			t.Fatalf("Report done %v, get err cnt %d %q, expect %d", r.done, tmeta.ErrCnt,
+				tmeta.ErrMsg, r.errCnt)
+		}
+		if !reflect.DeepEqual(tspec.Resume.Done, r.done) || tspec.Resume.Output != len(r.done) {
+			t.Fatalf("Report done %v, get resume %+v", r.done, tspec.Resume)
+		}
+	}
+	if tmeta.report != nil || tmeta.Attempt != 2 {
+		t.Fatalf("Get report %+v attempt %d after failed ones, expect none and 2",
+			tmeta.report, tmeta.Attempt)
+	}
+
+	// Aborted one leaves the resume info alone
+	m.addTaskReport(&task.TaskReport{Err: "aborted", Tid: "t", Status: status, Aborted: true})
+	if tmeta.ErrCnt != 1 || len(tspec.Resume.Done) != 3 {
+		t.Fatalf("Get err cnt %d resume %+v after aborted, expect unchanged", tmeta.ErrCnt, tspec.Resume)
+	}
+}
@@ -4,18 +4,27 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"pegasus/cfgmgr"
+	"pegasus/db"
 	"pegasus/log"
+	"pegasus/pki"
 	"pegasus/rate"
 	"pegasus/route"
 	"pegasus/server"
 	"pegasus/uri"
 	"pegasus/util"
 	"pegasus/workgroup"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-var cfgServerIP = "127.0.0.1"
+// From bootstrap cfg
+var cfgServerIP string
+
+// Registration on cfg server, closed on shutdown
+var serviceLease *cfgmgr.ServiceLease
 
 type Master struct {
 	Name         string
@@ -29,7 +38,7 @@ var masterSelf = new(Master)
 
 func discoverIp() error {
 	log.Info("Discover self ip address")
-	ip, err := cfgmgr.DiscoverIpFromCfg(cfgServerIP)
+	ip, err := cfgmgr.GetAdvertiseIP(cfgServerIP, &cfgmgr.Bootstrap.Master)
 	if err != nil {
 		return err
 	}
@@ -44,17 +53,14 @@ func prepareNetwork() error {
 	if err := discoverIp(); err != nil {
 		return err
 	}
-	if err := s.Listen(masterSelf.IP); err != nil {
+	nc := &cfgmgr.Bootstrap.Master
+	if err := s.Listen(nc.BindIP, nc.Port); err != nil {
 		return fmt.Errorf("Fail to listen, %v", err)
 	}
 	masterSelf.masterServer = s
-	masterSelf.masterAddr = s.GetListenAddr()
-	_, port, err := util.SplitAddr(masterSelf.masterAddr)
-	if err != nil {
-		return err
-	}
-	masterSelf.ListenPort = port
-	log.Info("Listen on %s:%d", masterSelf.IP, masterSelf.ListenPort)
+	masterSelf.ListenPort = s.GetListenPort()
+	masterSelf.masterAddr = util.JoinAddr(masterSelf.IP, masterSelf.ListenPort)
+	log.Info("Listen on %s, advertise as %s", s.GetListenAddr(), masterSelf.masterAddr)
 	hostname, err := os.Hostname()
 	if err != nil {
 		return err
@@ -63,19 +69,43 @@ func prepareNetwork() error {
 	return nil
 }
 
-func registerOnCfgServer() (err error) {
+// Deregister from cfg server on SIGINT or SIGTERM, rather than being
+// listed until the lease expires.
+func stopOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	log.Info("Stop on %v", sig)
+	if err := serviceLease.Close(); err != nil {
+		log.Error("Fail to deregister from cfg server, %v", err)
+	}
+	os.Exit(0)
+}
+
+func registerOnCfgServer() error {
 	log.Info("Register on cfg server")
-	u := &util.HttpUrl{
-		IP:   cfgServerIP,
-		Port: cfgmgr.CfgServerPort,
-		Uri:  uri.CfgMasterUri,
+	inst := &cfgmgr.ServiceInstance{
+		Role:    cfgmgr.SERVICE_ROLE_MASTER,
+		Addr:    masterSelf.masterAddr,
+		Version: strconv.Itoa(workgroup.PROTO_VERSION),
+		Meta:    map[string]string{"name": masterSelf.Name},
 	}
-	_, err = util.HttpPostStr(u, masterSelf.masterAddr)
+	inst.Meta[cfgmgr.SERVICE_META_TOKEN] = strconv.FormatUint(leaderLease.Token(), 10)
+	lease, err := cfgmgr.RegisterService(cfgServerIP, inst)
 	if err != nil {
 		return fmt.Errorf("Fail to register, %v", err)
 	}
+	serviceLease = lease
 	log.Info("Register on cfg server done")
-	return
+	return nil
+}
+
+func cfgEffectiveHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, cfgmgr.GetCfgOrigins())
+}
+
+func cfgRevHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, cfgmgr.GetAppliedRevision())
 }
 
 func testHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +113,7 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 	s, err := util.HttpReadRequestTextBody(r)
 	if err != nil {
 		err = fmt.Errorf("Fail to read request test body, %v", err)
-		log.Error(err.Error())
+		log.Error("%v", err)
 		server.FmtResp(w, err, "")
 		return
 	}
@@ -97,7 +127,7 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 			Uri:  uri.WorkerTestUri,
 		}
 		if resp, err := util.HttpPostStr(u, s); err != nil {
-			log.Error(err.Error())
+			log.Error("%v", err)
 			server.FmtResp(w, err, s)
 			return
 		} else {
@@ -111,6 +141,18 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func registerRoutes() {
+	route.RegisterRoute(&route.Route{
+		Name:    "cfgEffectiveHandler",
+		Method:  http.MethodGet,
+		Path:    uri.MasterCfgEffectiveUri,
+		Handler: cfgEffectiveHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "cfgRevHandler",
+		Method:  http.MethodGet,
+		Path:    uri.MasterCfgRevUri,
+		Handler: cfgRevHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "registerWorkerHandler",
 		Method:  http.MethodGet,
@@ -141,6 +183,12 @@ func registerRoutes() {
 		Path:    uri.MasterWorkerHbIntervalUri,
 		Handler: workerHbIntervalHandler,
 	})
+	route.RegisterRoute(&route.Route{
+		Name:    "workerInventoryHandler",
+		Method:  http.MethodGet,
+		Path:    uri.MasterWorkerInventoryUri,
+		Handler: workerInventoryHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "taskReportHandler",
 		Method:  http.MethodPost,
@@ -165,6 +213,12 @@ func registerRoutes() {
 		Path:    uri.MasterProjectStatusUri,
 		Handler: queryProjStatusHandler,
 	})
+	route.RegisterRoute(&route.Route{
+		Name:    "projEventsHandler",
+		Method:  http.MethodGet,
+		Path:    uri.MasterProjectEventsUri,
+		Handler: projEventsHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "testHandler",
 		Method:  http.MethodPost,
@@ -174,8 +228,12 @@ func registerRoutes() {
 }
 
 func initLogger() error {
+	level, err := log.GetLogLevel(cfgmgr.Bootstrap.LogLevel)
+	if err != nil {
+		return err
+	}
 	consoleLogger := &log.ConsoleLogger{
-		Level: log.LevelInfo,
+		Level: level,
 	}
 	if err := log.RegisterLogger(consoleLogger); err != nil {
 		return err
@@ -185,20 +243,41 @@ func initLogger() error {
 }
 
 func main() {
+	if err := cfgmgr.InitLayers(); err != nil {
+		panic(err)
+	}
+	cfgServerIP = cfgmgr.Bootstrap.CfgServerIP
 	if err := initLogger(); err != nil {
 		panic(fmt.Errorf("Fail to init logger, %v", err))
 	}
+	if err := pki.InitFromLocalCfg(); err != nil {
+		panic(err)
+	}
 	registerRoutes()
 	cfgmgr.WaitForCfgServerUp(cfgServerIP)
 	if err := prepareNetwork(); err != nil {
 		panic(err)
 	}
+	becomeLeader()
 	if err := registerOnCfgServer(); err != nil {
 		panic(err)
 	}
+	go stopOnSignal()
 	if err := workgroup.InitWorkgroup(cfgServerIP); err != nil {
 		panic(err)
 	}
+	if err := initMasterCfg(cfgServerIP); err != nil {
+		panic(err)
+	}
+	// Projects write their results on finish
+	if err := db.InitDb(cfgServerIP); err != nil {
+		panic(err)
+	}
+	cfgmgr.WatchCfg(cfgServerIP)
+	cfgmgr.LogCfgOrigins()
 	rate.InitAsMaster()
+	if err := resumeFromCheckpoint(); err != nil {
+		panic(err)
+	}
 	panic(masterSelf.masterServer.Serve())
 }
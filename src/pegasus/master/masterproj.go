@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"pegasus/cfgmgr"
 	"pegasus/log"
 	"pegasus/server"
 	"pegasus/task"
@@ -35,6 +36,16 @@ func (pmeta *ProjMeta) insertJobMeta(jmeta *JobMeta) {
 	pmeta.JobMetas = append(pmeta.JobMetas, jmeta)
 }
 
+func (pmeta *ProjMeta) brief() *ProjMeta {
+	return &ProjMeta{
+		Name:     pmeta.Name,
+		StartTs:  pmeta.StartTs,
+		EndTs:    pmeta.EndTs,
+		ErrMsg:   pmeta.ErrMsg,
+		Finished: pmeta.Finished,
+	}
+}
+
 func (pmeta *ProjMeta) snapshot() *ProjMeta {
 	metas := make([]*JobMeta, len(pmeta.JobMetas))
 	for i, jmeta := range pmeta.JobMetas {
@@ -59,6 +70,8 @@ type ProjectCtx struct {
 	config   string
 	proj     task.Project
 	projMeta *ProjMeta
+	// Reports of tasks done before takeover, by checkpoint key
+	resumed map[string]*task.TaskReport
 }
 
 func (ctx *ProjectCtx) init() {
@@ -82,14 +95,43 @@ func (ctx *ProjectCtx) checkAndUnsetFree(proj task.Project, config string) (stri
 	ctx.proj = proj
 	ctx.config = config
 	ctx.projId = ctx.makeProjId()
+	ctx.resumed = nil
 	return ctx.projId, nil
 }
 
+func (ctx *ProjectCtx) checkAndResume(proj task.Project, ckpt *cfgmgr.ProjCheckpoint,
+	reports map[string]*task.TaskReport) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if !ctx.free {
+		return fmt.Errorf("Project %q in running", ctx.projId)
+	}
+	ctx.free = false
+	ctx.proj = proj
+	ctx.config = ckpt.Config
+	ctx.projId = ckpt.ProjId
+	ctx.resumed = reports
+	return nil
+}
+
+func (ctx *ProjectCtx) isResumed() bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.resumed != nil
+}
+
+func (ctx *ProjectCtx) getResumedReport(key string) *task.TaskReport {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.resumed[key]
+}
+
 func (ctx *ProjectCtx) finishProj(err error) {
 	stats := ctx.formatProjStats(err)
 	if err := ctx.proj.Finish(stats); err != nil {
 		log.Error("Fail on project %q finish, %v", projctx.projId, err)
 	}
+	clearCheckpoint()
 	projctx.finish(err)
 }
 
@@ -131,6 +173,11 @@ func (ctx *ProjectCtx) finish(err error) {
 	ctx.projMeta.Finished = true
 	ctx.projMeta.EndTs = time.Now()
 	ctx.free = true
+	events.publish(&Event{
+		Type:   EVENT_PROJ_FINISHED,
+		ErrMsg: ctx.projMeta.ErrMsg,
+		Proj:   ctx.projMeta.brief(),
+	})
 }
 
 func (ctx *ProjectCtx) makeProjId() string {
@@ -158,8 +205,18 @@ func (ctx *ProjectCtx) snapshotProjMeta() *ProjMeta {
 func projRunner() {
 	log.Info("Run project %q", projctx.projId)
 	projctx.start()
+	events.setProj(projctx.projId)
+	events.publish(&Event{
+		Type: EVENT_PROJ_STARTED,
+		Proj: projctx.snapshotProjMeta(),
+	})
 	proj := projctx.proj
+	if !projctx.isResumed() {
+		startCheckpoint(projctx.projId, proj.GetName(), projctx.config,
+			projctx.snapshotProjMeta().StartTs)
+	}
 	if err := proj.Init(projctx.config); err != nil {
+		clearCheckpoint()
 		projctx.finish(err)
 		log.Error("Fail on project %q init, %v", projctx.projId, err)
 		return
@@ -169,7 +226,7 @@ func projRunner() {
 		projctx.insertJobMeta(jmeta)
 		if err != nil {
 			err = fmt.Errorf("Fail on job %q, %v", job.GetKind(), err)
-			log.Error(err.Error())
+			log.Error("%v", err)
 			projctx.finishProj(err)
 			log.Info("Run project %q finished with err %v", projctx.projId, err)
 			return
@@ -196,6 +253,15 @@ func runProj(proj task.Project, config string) *RunProjReceipt {
 	return &RunProjReceipt{ProjId: projId}
 }
 
+func resumeProj(proj task.Project, ckpt *cfgmgr.ProjCheckpoint,
+	reports map[string]*task.TaskReport) error {
+	if err := projctx.checkAndResume(proj, ckpt, reports); err != nil {
+		return err
+	}
+	go projRunner()
+	return nil
+}
+
 func runProjHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		err = fmt.Errorf("Fail to parse form, err %v", err)
@@ -212,7 +278,7 @@ func runProjHandler(w http.ResponseWriter, r *http.Request) {
 	config := string(body)
 	proj := taskreg.GetProj(projName)
 	if proj == nil {
-		err = fmt.Errorf("Proj %q not supported", projName)
+		err = fmt.Errorf("%w, proj %q not supported", util.ErrNotFound, projName)
 		server.FmtResp(w, err, nil)
 		return
 	}
@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/url"
+	"pegasus/auth"
 	"pegasus/log"
 	"pegasus/server"
 	"pegasus/task"
+	"pegasus/taskreg"
 	"pegasus/uri"
 	"pegasus/util"
 	"pegasus/workgroup"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -23,32 +28,31 @@ const (
 	WORKER_STATUS_REMOVED  = "Removed"
 )
 
-const (
-	WORKER_HB_INTERVAL      = time.Duration(5 * time.Second)
-	WORKER_MONITOR_INTERVAL = time.Duration(30 * time.Second)
-	WORKER_HB_CNT_GOOD      = 5
-	WORKER_HB_CNT_NORM      = 3
-	WORKER_MAX_FAULT        = 2
-)
-
 var wmgr = new(workerMgr)
 
 type Worker struct {
-	Label       string
-	Name        string
-	ip          string
-	port        int
-	Key         string
-	Status      string
-	StatusStart time.Time
-	LastHb      time.Time
-	HbWinCnt    int
-	FaultCnt    int
-	tspec       *task.TaskSpec
-	doneTasks   int
-	prev        *Worker
-	next        *Worker
-	listHead    **Worker
+	Label        string
+	Name         string
+	ip           string
+	port         int
+	Key          string
+	Status       string
+	StatusStart  time.Time
+	LastHb       time.Time
+	HbWinCnt     int
+	FaultCnt     int
+	CrashCnt     int
+	DoneTasks    int
+	Tid          string
+	ProtoVersion int
+	TaskKinds    map[string]int
+	Unsupported  []string
+	CfgRevision  uint64
+	kinds        map[string]bool
+	tspec        *task.TaskSpec
+	prev         *Worker
+	next         *Worker
+	listHead     **Worker
 }
 
 type workerMgr struct {
@@ -82,6 +86,51 @@ func (mgr *workerMgr) getAllWorkerAddr() (ips []string, ports []int) {
 	return
 }
 
+func (w *Worker) snapshot() *Worker {
+	tid := ""
+	if w.tspec != nil {
+		tid = w.tspec.Tid
+	}
+	return &Worker{
+		Label:        w.Label,
+		Name:         w.Name,
+		Key:          w.Key,
+		Status:       w.Status,
+		StatusStart:  w.StatusStart,
+		LastHb:       w.LastHb,
+		HbWinCnt:     w.HbWinCnt,
+		FaultCnt:     w.FaultCnt,
+		CrashCnt:     w.CrashCnt,
+		DoneTasks:    w.DoneTasks,
+		Tid:          tid,
+		ProtoVersion: w.ProtoVersion,
+		TaskKinds:    w.TaskKinds,
+		Unsupported:  w.Unsupported,
+		CfgRevision:  w.CfgRevision,
+	}
+}
+
+func (mgr *workerMgr) getInventory() []*Worker {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	workers := make([]*Worker, 0, len(mgr.workers))
+	for _, w := range mgr.workers {
+		workers = append(workers, w.snapshot())
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Label < workers[j].Label
+	})
+	return workers
+}
+
+func (w *Worker) setStatus(status string) {
+	if w.Status == status {
+		return
+	}
+	publishWorkerEvent(w, w.Status, status)
+	w.Status = status
+}
+
 func (mgr *workerMgr) removeWorker(worker *Worker) {
 	if _, ok := mgr.workers[worker.Key]; ok {
 		delete(mgr.workers, worker.Key)
@@ -118,17 +167,56 @@ func (mgr *workerMgr) verifyWorker(form *workgroup.WorkerRegForm, key string) (e
 	}()
 	worker, ok := mgr.workers[key]
 	if !ok {
-		err := fmt.Errorf("Worker key %s not registered", key)
+		err := fmt.Errorf("%w, worker key %s not registered", util.ErrNotFound, key)
+		return err
+	}
+	ip, err := util.ParseHost(form.IP)
+	if err == nil && (form.Port <= 0 || form.Port > 65535) {
+		err = fmt.Errorf("Invalid port %d", form.Port)
+	}
+	if err != nil {
+		mgr.removeWorker(worker)
+		return fmt.Errorf("%w, worker addr, %v", util.ErrInvalidSpec, err)
+	}
+	if err = checkWorkerCompat(worker, form); err != nil {
+		mgr.removeWorker(worker)
 		return err
 	}
 	worker.Name = form.Name
-	worker.ip, worker.port = form.IP, form.Port
+	worker.ip, worker.port = ip, form.Port
 	worker.StatusStart = time.Now()
 	// TODO for test purpose
 	//mgr.insertWorker(worker, &mgr.unstableWorkers)
 	//worker.Status = WORKER_STATUS_UNSTABLE
 	mgr.insertWorker(worker, &mgr.freeWorkers)
-	worker.Status = WORKER_STATUS_ACTIVE
+	worker.setStatus(WORKER_STATUS_ACTIVE)
+	return nil
+}
+
+// Only kinds with the same version on both sides are dispatched to worker.
+func checkWorkerCompat(worker *Worker, form *workgroup.WorkerRegForm) error {
+	if err := workgroup.CheckProtoVersion(form.ProtoVersion); err != nil {
+		return err
+	}
+	worker.ProtoVersion = form.ProtoVersion
+	worker.TaskKinds = form.TaskKinds
+	worker.kinds = make(map[string]bool)
+	worker.Unsupported = make([]string, 0)
+	for kind, version := range taskreg.GetTaskKinds() {
+		if v, ok := form.TaskKinds[kind]; ok && v == version {
+			worker.kinds[kind] = true
+		} else {
+			worker.Unsupported = append(worker.Unsupported, kind)
+		}
+	}
+	sort.Strings(worker.Unsupported)
+	if len(worker.kinds) == 0 {
+		return fmt.Errorf("Worker %q supports none of the task kinds, unsupported %v",
+			form.Name, worker.Unsupported)
+	}
+	if len(worker.Unsupported) > 0 {
+		log.Info("Worker %q doesn't support task kinds %v", form.Name, worker.Unsupported)
+	}
 	return nil
 }
 
@@ -136,7 +224,7 @@ func (mgr *workerMgr) verifyWorkerKey(key string) error {
 	mgr.mutex.Lock()
 	mgr.mutex.Unlock()
 	if _, ok := mgr.workers[key]; !ok {
-		return fmt.Errorf("Worker key %s not registered", key)
+		return fmt.Errorf("%w, worker key %s not registered", util.ErrNotFound, key)
 	}
 	return nil
 }
@@ -207,43 +295,98 @@ func (mgr *workerMgr) removeFirstOneFrom(head **Worker) *Worker {
 	return worker
 }
 
-func (mgr *workerMgr) waitForFreeWorker() error {
-	for mgr.freeWorkers == nil {
+func (mgr *workerMgr) supportedByAny(kind string) bool {
+	for _, w := range mgr.workers {
+		switch w.Status {
+		case WORKER_STATUS_ACTIVE, WORKER_STATUS_UNSTABLE:
+			if w.kinds[kind] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (mgr *workerMgr) findFreeWorker(kind string) *Worker {
+	w := mgr.freeWorkers
+	for w != nil {
+		if w.kinds[kind] {
+			return w
+		}
+		w = w.next
+		if w == mgr.freeWorkers {
+			break
+		}
+	}
+	return nil
+}
+
+func (mgr *workerMgr) waitForFreeWorker(kind string) (*Worker, error) {
+	for {
 		// TODO should we keep track of avail workers count???
 		if len(mgr.workers) == 0 {
-			return fmt.Errorf("No workers registered or all workers dead")
+			return nil, fmt.Errorf("No workers registered or all workers dead")
+		}
+		if !mgr.supportedByAny(kind) {
+			return nil, fmt.Errorf("No worker supports task kind %q", kind)
+		}
+		if w := mgr.findFreeWorker(kind); w != nil {
+			return w, nil
 		}
 		mgr.cond.Wait()
 	}
-	return nil
+}
+
+// Until any worker registers and a heartbeat interval more for the rest,
+// or timeout.
+func (mgr *workerMgr) waitForWorkers(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mgr.mutex.Lock()
+		cnt := len(mgr.workers)
+		mgr.mutex.Unlock()
+		if cnt > 0 {
+			time.Sleep(getMasterCfg().WorkerHbInterval)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	log.Error("No worker registered in %v", timeout)
 }
 
 func (mgr *workerMgr) notifyFreeWorker() {
 	mgr.cond.Broadcast()
 }
 
-func (mgr *workerMgr) getFreeWorker() (*Worker, error) {
-	log.Info("Get free worker...")
+func (mgr *workerMgr) getFreeWorker(kind string) (*Worker, error) {
+	log.Info("Get free worker for %q...", kind)
 	mgr.mutex.Lock()
 	defer mgr.mutex.Unlock()
-	if len(mgr.workers) == 0 {
-		return nil, fmt.Errorf("No workers registered or all workers dead")
-	}
-	if err := mgr.waitForFreeWorker(); err != nil {
+	worker, err := mgr.waitForFreeWorker(kind)
+	if err != nil {
 		return nil, err
 	}
-	worker := mgr.removeFirstOneFrom(&mgr.freeWorkers)
+	mgr.removeFrom(worker, &mgr.freeWorkers)
+	worker.next, worker.prev = nil, nil
 	return worker, nil
 }
 
+// With the leader token, workers refuse tasks of a former master.
+func makeWorkerTaskUrl(ip string, port int, u string) *util.HttpUrl {
+	q := make(url.Values)
+	q.Set(uri.LeaderTokenKey, strconv.FormatUint(leaderLease.Token(), 10))
+	return &util.HttpUrl{
+		IP:    ip,
+		Port:  port,
+		Uri:   u,
+		Query: q,
+	}
+}
+
 func (mgr *workerMgr) dispatchTaskTo(t *task.TaskSpec, w *Worker) error {
 	log.Info("Post task %q to worker %v", t.Tid, w.Key)
-	url := &util.HttpUrl{
-		IP:   w.ip,
-		Port: w.port,
-		Uri:  uri.WorkerTaskUri,
-	}
-	if _, err := util.HttpPostData(url, t); err != nil {
+	u := makeWorkerTaskUrl(w.ip, w.port, uri.WorkerTaskUri)
+	if _, err := util.HttpPostPayload(u, t); err != nil {
 		return fmt.Errorf("Fail to post task spec to %q, %v", w.Name, err)
 	}
 	w.tspec = t
@@ -256,7 +399,7 @@ func (mgr *workerMgr) dispatchTask(t *task.TaskSpec) (string, error) {
 	var w *Worker
 	log.Info("Dispatch task %q", t.Tid)
 	for {
-		w, err = mgr.getFreeWorker()
+		w, err = mgr.getFreeWorker(t.Kind)
 		if err != nil {
 			return "", fmt.Errorf("Fail to get free worker, %v", err)
 		}
@@ -266,7 +409,7 @@ func (mgr *workerMgr) dispatchTask(t *task.TaskSpec) (string, error) {
 		} else {
 			log.Error("Fail to dispatch task to %q, %v", w.Key, err)
 		}
-		w.Status = WORKER_STATUS_UNSTABLE
+		w.setStatus(WORKER_STATUS_UNSTABLE)
 		mgr.insertWorkerInlock(w, &mgr.unstableWorkers)
 	}
 	log.Info("Dispatch task %q successfully to %s", t.Tid, w.Name)
@@ -275,17 +418,20 @@ func (mgr *workerMgr) dispatchTask(t *task.TaskSpec) (string, error) {
 
 func (mgr *workerMgr) releaseWorker(w *Worker) (logMsg string) {
 	w.tspec = nil
-	if w.FaultCnt >= WORKER_MAX_FAULT {
-		w.Status = WORKER_STATUS_FAULT
+	if w.Status == WORKER_STATUS_DEAD {
+		// Its task given up already, the worker is removed in time
+		return fmt.Sprintf("Worker %q dead, kept in dead queue", w.Key)
+	}
+	if w.FaultCnt >= getMasterCfg().WorkerMaxFault {
+		w.setStatus(WORKER_STATUS_FAULT)
 		// TODO should we remove it???
 		mgr.reinsertWorker(w, &mgr.faultWorkers)
 		logMsg = fmt.Sprintf("Woker %q fault %d, move to fault queue", w.Key, w.FaultCnt)
 	} else if w.Status == WORKER_STATUS_UNSTABLE {
-		w.Status = WORKER_STATUS_UNSTABLE
 		mgr.reinsertWorker(w, &mgr.unstableWorkers)
 		logMsg = fmt.Sprintf("Worker %q released to unstable queue", w.Key)
 	} else {
-		w.Status = WORKER_STATUS_ACTIVE
+		w.setStatus(WORKER_STATUS_ACTIVE)
 		mgr.reinsertWorker(w, &mgr.freeWorkers)
 		logMsg = fmt.Sprintf("Worker %q released to free queue", w.Key)
 	}
@@ -303,18 +449,54 @@ func (mgr *workerMgr) handleTaskReport(ctx *JobCtx, key string, report *task.Tas
 	}()
 	w, ok := mgr.workers[key]
 	if !ok {
-		return fmt.Errorf("Worker with key %q not found", key)
+		return fmt.Errorf("%w, worker with key %q", util.ErrNotFound, key)
+	}
+	if report.Aborted && (w.tspec == nil || w.tspec.Tid != report.Tid) {
+		// Aborted as the worker turned dead and the task was reassigned,
+		// the report comes late and is not of the attempt in running.
+		logMsg = "ignored, task no longer on the worker"
+		return fmt.Errorf("%w, task %q no longer on worker %q", util.ErrConflict, report.Tid, key)
 	}
-	if report.Err != "" {
+	if report.Aborted {
+		log.Info("Task %q aborted on worker %q", report.Tid, key)
+	} else if report.Err != "" {
 		w.FaultCnt++
 	} else {
-		w.doneTasks++
+		w.DoneTasks++
+	}
+	if report.Stack != "" {
+		w.CrashCnt++
+		log.Error("Task %q crashed on worker %q, crash count %d, stack:\n%s",
+			report.Tid, key, w.CrashCnt, report.Stack)
 	}
 	logMsg = mgr.releaseWorker(w)
 	return nil
 }
 
-func (mgr *workerMgr) updateWorkerHb(key string, ts time.Time) (err error) {
+func abortTaskOn(ip string, port int, tid string) {
+	log.Info("Abort task %q on %s", tid, util.JoinAddr(ip, port))
+	u := makeWorkerTaskUrl(ip, port, uri.WorkerTaskUri+"/"+tid)
+	if _, err := util.HttpDelete(u); err != nil {
+		log.Error("Fail to abort task %q on %s, %v", tid, util.JoinAddr(ip, port), err)
+	}
+}
+
+func (mgr *workerMgr) abortBusyTasks() {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	w := mgr.busyWorkers
+	for w != nil {
+		if w.tspec != nil {
+			go abortTaskOn(w.ip, w.port, w.tspec.Tid)
+		}
+		w = w.next
+		if w == mgr.busyWorkers {
+			break
+		}
+	}
+}
+
+func (mgr *workerMgr) updateWorkerHb(key string, ts time.Time, cfgRev uint64) (err error) {
 	log.Debug("Update HB for worker %q", key)
 	mgr.mutex.Lock()
 	defer func() {
@@ -322,11 +504,12 @@ func (mgr *workerMgr) updateWorkerHb(key string, ts time.Time) (err error) {
 	}()
 	w, ok := mgr.workers[key]
 	if !ok {
-		err = fmt.Errorf("Worker with key %q not found", key)
+		err = fmt.Errorf("%w, worker with key %q", util.ErrNotFound, key)
 		return
 	}
 	w.HbWinCnt++
 	w.LastHb = ts
+	w.CfgRevision = cfgRev
 	return
 }
 
@@ -335,11 +518,14 @@ func registerWorkerHandler(w http.ResponseWriter, r *http.Request) {
 	server.FmtResp(w, err, key)
 }
 
+// Key in the header signed along with the request, so that it can't be
+// swapped on the way.
 func getWorkerKeyFromReq(r *http.Request) (string, error) {
-	if err := r.ParseForm(); err != nil {
-		return "", fmt.Errorf("Fail to parse form, %v", err)
+	key := r.Header.Get(auth.HEADER_WORKER_KEY)
+	if key == "" {
+		return "", fmt.Errorf("%w, worker key missing", util.ErrUnauthorized)
 	}
-	return r.Form.Get(uri.MasterWorkerQueryKey), nil
+	return key, nil
 }
 
 func verifyWorkerHandler(w http.ResponseWriter, r *http.Request) {
@@ -366,12 +552,23 @@ func workerHbHandler(w http.ResponseWriter, r *http.Request) {
 		server.FmtResp(w, err, "")
 		return
 	}
-	err = wmgr.updateWorkerHb(key, time.Now())
-	server.FmtResp(w, err, "")
+	// Missing from workers of older version
+	cfgRev, _ := strconv.ParseUint(r.URL.Query().Get(uri.MasterCfgRevKey), 10, 64)
+	if err := wmgr.updateWorkerHb(key, time.Now(), cfgRev); err != nil {
+		server.FmtResp(w, err, "")
+		return
+	}
+	// So that workers follow changes of the interval
+	interval := getMasterCfg().WorkerHbInterval
+	server.FmtResp(w, nil, &interval)
+}
+
+func workerInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, wmgr.getInventory())
 }
 
 func workerHbIntervalHandler(w http.ResponseWriter, r *http.Request) {
-	interval := WORKER_HB_INTERVAL
+	interval := getMasterCfg().WorkerHbInterval
 	server.FmtResp(w, nil, &interval)
 }
 
@@ -395,7 +592,7 @@ func monitorGoodWorker(w *Worker) *monitorRec {
 		oldStatus:  w.Status,
 		newStatus:  WORKER_STATUS_ACTIVE,
 	}
-	w.Status = WORKER_STATUS_ACTIVE
+	w.setStatus(WORKER_STATUS_ACTIVE)
 	if w.tspec == nil {
 		wmgr.reinsertWorker(w, &wmgr.freeWorkers)
 		wmgr.notifyFreeWorker()
@@ -406,15 +603,19 @@ func monitorGoodWorker(w *Worker) *monitorRec {
 func monitorBadWorker(w *Worker) *monitorRec {
 	oldStatus := w.Status
 	if w.Status == WORKER_STATUS_ACTIVE {
-		w.Status = WORKER_STATUS_UNSTABLE
+		w.setStatus(WORKER_STATUS_UNSTABLE)
 		if w.tspec == nil {
 			wmgr.reinsertWorker(w, &wmgr.unstableWorkers)
 		}
 	} else if w.Status == WORKER_STATUS_UNSTABLE {
 		if w.tspec != nil {
+			// In case the worker is still alive, stop it from working on
+			// the task which is about to run somewhere else.
+			go abortTaskOn(w.ip, w.port, w.tspec.Tid)
 			go reassignTask(w.tspec)
 		}
-		w.Status, w.tspec = WORKER_STATUS_DEAD, nil
+		w.setStatus(WORKER_STATUS_DEAD)
+		w.tspec = nil
 		wmgr.reinsertWorker(w, &wmgr.deadWorkers)
 		wmgr.notifyFreeWorker()
 	} else {
@@ -431,8 +632,9 @@ func monitorBadWorker(w *Worker) *monitorRec {
 
 func monitorOneWorker(w *Worker) *monitorRec {
 	var rec *monitorRec
+	mc := getMasterCfg()
 	d := time.Now().Sub(w.StatusStart)
-	if d < WORKER_MONITOR_INTERVAL {
+	if d < mc.WorkerMonitorInterval {
 		return nil
 	}
 	if w.Status == WORKER_STATUS_FAULT {
@@ -440,6 +642,7 @@ func monitorOneWorker(w *Worker) *monitorRec {
 	}
 	if w.Status == WORKER_STATUS_PENDING || w.Status == WORKER_STATUS_DEAD {
 		wmgr.removeWorker(w)
+		publishWorkerEvent(w, w.Status, WORKER_STATUS_REMOVED)
 		return &monitorRec{
 			workerKey:  w.Key,
 			workerName: w.Name,
@@ -447,9 +650,9 @@ func monitorOneWorker(w *Worker) *monitorRec {
 			newStatus:  WORKER_STATUS_REMOVED,
 		}
 	}
-	if w.HbWinCnt >= WORKER_HB_CNT_GOOD {
+	if w.HbWinCnt >= mc.WorkerHbCntGood {
 		rec = monitorGoodWorker(w)
-	} else if w.HbWinCnt < WORKER_HB_CNT_NORM {
+	} else if w.HbWinCnt < mc.WorkerHbCntNorm {
 		rec = monitorBadWorker(w)
 	}
 	w.HbWinCnt = 0
@@ -474,6 +677,10 @@ func monitorWorkers() []*monitorRec {
 	return recs
 }
 
+func getWorkerMonitorInterval() time.Duration {
+	return getMasterCfg().WorkerMonitorInterval
+}
+
 func wmgrMonitorMain(args interface{}) {
 	log.Debug("Start WMGR monitor")
 	t1 := time.Now()
@@ -491,5 +698,5 @@ func wmgrMonitorMain(args interface{}) {
 
 func init() {
 	wmgr.init()
-	go util.PeriodicalRoutine(true, WORKER_MONITOR_INTERVAL, wmgrMonitorMain, nil)
+	go util.PeriodicalRoutineFunc(true, getWorkerMonitorInterval, wmgrMonitorMain, nil)
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"pegasus/auth"
+	"pegasus/server"
+	"pegasus/task"
+	"pegasus/taskreg"
+	"pegasus/uri"
+	"pegasus/util"
+	"pegasus/workgroup"
+)
+
+func registerWorkerAt(ip string, port int, form *workgroup.WorkerRegForm) (string, error) {
+	u := &util.HttpUrl{
+		IP:   ip,
+		Port: port,
+		Uri:  uri.MasterRegisterWokerUri,
+	}
+	key, err := util.HttpGet(u)
+	if err != nil {
+		return "", err
+	}
+	u.Header = http.Header{auth.HEADER_WORKER_KEY: {key}}
+	_, err = util.HttpPostData(u, form)
+	return key, err
+}
+
+// Workers reach the master listening on all interfaces by either IPv4 or
+// IPv6, and are reached back at the addr they register with.
+func TestDualStackRegistration(t *testing.T) {
+	os.Setenv(auth.SECRET_ENV, "wmgr-test")
+	defer os.Unsetenv(auth.SECRET_ENV)
+	registerRoutes()
+	s := new(server.Server)
+	if err := s.Listen("", 0); err != nil {
+		t.Fatalf("Fail to listen, %v", err)
+	}
+	go s.Serve()
+	port := s.GetListenPort()
+	if conn, err := net.Dial("tcp", util.JoinAddr("::1", port)); err != nil {
+		t.Skipf("IPv6 loopback not available, %v", err)
+	} else {
+		conn.Close()
+	}
+	cases := []struct {
+		masterIP string
+		workerIP string
+		ip       string
+		url      string
+	}{
+		{"127.0.0.1", "10.0.0.1", "10.0.0.1", "http://10.0.0.1:9000/test"},
+		{"::1", "fd00::1", "fd00::1", "http://[fd00::1]:9000/test"},
+		{"::1", "[fd00::2]", "fd00::2", "http://[fd00::2]:9000/test"},
+		{"127.0.0.1", "worker-0.pegasus", "worker-0.pegasus",
+			"http://worker-0.pegasus:9000/test"},
+	}
+	for _, c := range cases {
+		form := &workgroup.WorkerRegForm{
+			Name:         c.workerIP,
+			IP:           c.workerIP,
+			Port:         9000,
+			ProtoVersion: workgroup.PROTO_VERSION,
+			TaskKinds:    taskreg.GetTaskKinds(),
+		}
+		key, err := registerWorkerAt(c.masterIP, port, form)
+		if err != nil {
+			t.Fatalf("Fail to register %s on master at %s, %v", c.workerIP, c.masterIP, err)
+		}
+		wmgr.mutex.Lock()
+		w := wmgr.workers[key]
+		wmgr.mutex.Unlock()
+		if w == nil || w.ip != c.ip || w.port != 9000 {
+			t.Fatalf("Worker %s registered as %+v, expect %s", c.workerIP, w, c.ip)
+		}
+		u := &util.HttpUrl{IP: w.ip, Port: w.port, Uri: uri.WorkerTestUri}
+		if u.String() != c.url {
+			t.Fatalf("Reach worker %s at %s, expect %s", c.workerIP, u.String(), c.url)
+		}
+	}
+	for _, ip := range []string{"", "10.0.0.1:9000", "[fd00::1]:9000"} {
+		form := &workgroup.WorkerRegForm{
+			IP:           ip,
+			Port:         9000,
+			ProtoVersion: workgroup.PROTO_VERSION,
+			TaskKinds:    taskreg.GetTaskKinds(),
+		}
+		if _, err := registerWorkerAt("::1", port, form); !errors.Is(err, util.ErrInvalidSpec) {
+			t.Fatalf("Register worker at %q, get %v, expect invalid", ip, err)
+		}
+	}
+}
+
+func addTestWorker(t *testing.T, name string) *Worker {
+	key, err := wmgr.registerWorker()
+	if err != nil {
+		t.Fatalf("Fail to register worker, %v", err)
+	}
+	form := &workgroup.WorkerRegForm{
+		Name:         name,
+		IP:           "10.0.0.1",
+		Port:         9000,
+		ProtoVersion: workgroup.PROTO_VERSION,
+		TaskKinds:    taskreg.GetTaskKinds(),
+	}
+	if err := wmgr.verifyWorker(form, key); err != nil {
+		t.Fatalf("Fail to verify worker %s, %v", name, err)
+	}
+	return wmgr.workers[key]
+}
+
+// Put tspec on w, as dispatched.
+func setTestWorkerTask(w *Worker, tspec *task.TaskSpec) {
+	wmgr.mutex.Lock()
+	defer wmgr.mutex.Unlock()
+	w.tspec = tspec
+	wmgr.reinsertWorker(w, &wmgr.busyWorkers)
+}
+
+// Worker turned dead with its task reassigned reports the task aborted
+// late, which is dropped rather than taken as the report of the attempt
+// in running, and the worker stays dead.
+func TestLateAbortedReport(t *testing.T) {
+	var kind string
+	for kind = range taskreg.GetTaskKinds() {
+		break
+	}
+	jobctx.start()
+	tspec := &task.TaskSpec{Tid: "tsk-late", Kind: kind}
+	jobctx.addTaskMeta(tspec, "")
+	dead, cur := addTestWorker(t, "dead"), addTestWorker(t, "cur")
+	setTestWorkerTask(dead, tspec)
+	// As monitorBadWorker gives it up
+	wmgr.mutex.Lock()
+	dead.setStatus(WORKER_STATUS_DEAD)
+	dead.tspec = nil
+	wmgr.reinsertWorker(dead, &wmgr.deadWorkers)
+	wmgr.mutex.Unlock()
+	setTestWorkerTask(cur, tspec)
+	startTs := time.Now()
+	jobctx.updateTaskStatus(&task.TaskStatus{Tid: tspec.Tid, StartTs: startTs, Total: 4})
+
+	late := &task.TaskReport{
+		Tid:     tspec.Tid,
+		Kind:    kind,
+		Err:     "Task aborted",
+		StartTs: startTs.Add(-time.Minute),
+		EndTs:   startTs,
+		Status:  &task.TaskStatus{Tid: tspec.Tid, StartTs: startTs.Add(-time.Minute)},
+		Aborted: true,
+	}
+	if err := handleTaskReport(dead.Key, late); !errors.Is(err, util.ErrConflict) {
+		t.Fatalf("Handle late aborted report, get %v, expect conflict", err)
+	}
+	_, tmeta := jobctx.snapshotTaskMeta(tspec.Tid)
+	if !tmeta.StartTs.Equal(startTs) || tmeta.ErrMsg != "" || !tmeta.EndTs.IsZero() {
+		t.Fatalf("Task meta %+v changed by late aborted report", tmeta)
+	}
+	wmgr.mutex.Lock()
+	status, head := dead.Status, dead.listHead
+	wmgr.releaseWorker(dead)
+	head2 := dead.listHead
+	wmgr.mutex.Unlock()
+	if status != WORKER_STATUS_DEAD || head != &wmgr.deadWorkers || head2 != &wmgr.deadWorkers {
+		t.Fatalf("Dead worker in %s, expect kept in dead queue", status)
+	}
+
+	// Aborted on the worker in running, the report is taken
+	report := *late
+	report.Status = &task.TaskStatus{Tid: tspec.Tid, StartTs: startTs}
+	report.StartTs = startTs
+	if err := handleTaskReport(cur.Key, &report); err != nil {
+		t.Fatalf("Fail to handle aborted report, %v", err)
+	}
+	if _, tmeta := jobctx.snapshotTaskMeta(tspec.Tid); tmeta.ErrMsg != report.Err {
+		t.Fatalf("Task meta %+v, expect error of aborted report", tmeta)
+	}
+	wmgr.mutex.Lock()
+	defer wmgr.mutex.Unlock()
+	if cur.listHead != &wmgr.freeWorkers || cur.tspec != nil {
+		t.Fatalf("Worker %s not released to free queue", cur.Status)
+	}
+}
+
+// Report with a panic stack counts as a crash of the worker besides the
+// fault, and the worker is released for the next task.
+func TestCrashReport(t *testing.T) {
+	tspec := &task.TaskSpec{Tid: "tsk-crash"}
+	w := addTestWorker(t, "crash")
+	setTestWorkerTask(w, tspec)
+
+	report := &task.TaskReport{
+		Tid:    tspec.Tid,
+		Err:    "Panic, boom",
+		Status: &task.TaskStatus{Tid: tspec.Tid, Total: 4},
+		Stack:  "goroutine 1 [running]:",
+	}
+	if err := wmgr.handleTaskReport(jobctx, w.Key, report); err != nil {
+		t.Fatalf("Fail to handle crash report, %v", err)
+	}
+	wmgr.mutex.Lock()
+	defer wmgr.mutex.Unlock()
+	if w.CrashCnt != 1 || w.FaultCnt != 1 || w.DoneTasks != 0 {
+		t.Fatalf("Get crash %d fault %d done %d, expect 1 1 0", w.CrashCnt, w.FaultCnt, w.DoneTasks)
+	}
+	if w.tspec != nil || w.listHead == &wmgr.busyWorkers {
+		t.Fatalf("Worker %s with task %+v, expect released", w.Status, w.tspec)
+	}
+}
+
+func TestCheckWorkerCompat(t *testing.T) {
+	kinds := taskreg.GetTaskKinds()
+	if len(kinds) < 2 {
+		t.Fatalf("Get task kinds %v, expect at least 2 registered", kinds)
+	}
+	var older string
+	olderKinds := make(map[string]int)
+	for kind, version := range kinds {
+		olderKinds[kind] = version
+		older = kind
+	}
+	olderKinds[older]--
+	cases := []struct {
+		name        string
+		version     int
+		kinds       map[string]int
+		ok          bool
+		unsupported []string
+	}{
+		{"same version", workgroup.PROTO_VERSION, kinds, true, []string{}},
+		{"older compatible", workgroup.PROTO_MIN_VERSION, olderKinds, true, []string{older}},
+		{"newer", workgroup.PROTO_VERSION + 1, kinds, false, nil},
+		{"too old", workgroup.PROTO_MIN_VERSION - 1, kinds, false, nil},
+		{"missing version", 0, kinds, false, nil},
+		{"no kinds", workgroup.PROTO_VERSION, map[string]int{}, false, nil},
+	}
+	for _, c := range cases {
+		w := new(Worker)
+		form := &workgroup.WorkerRegForm{Name: c.name, ProtoVersion: c.version, TaskKinds: c.kinds}
+		err := checkWorkerCompat(w, form)
+		if (err == nil) != c.ok {
+			t.Fatalf("Check %s worker, get %v, expect ok %v", c.name, err, c.ok)
+		}
+		if !c.ok {
+			continue
+		}
+		if w.ProtoVersion != c.version || !reflect.DeepEqual(w.Unsupported, c.unsupported) {
+			t.Fatalf("Check %s worker, get version %d unsupported %v, expect %d %v",
+				c.name, w.ProtoVersion, w.Unsupported, c.version, c.unsupported)
+		}
+		if len(w.kinds) != len(kinds)-len(c.unsupported) || w.kinds[older] == (len(c.unsupported) > 0) {
+			t.Fatalf("Check %s worker, get kinds %v", c.name, w.kinds)
+		}
+	}
+}
+
+func TestGetWorkerKeyFromReq(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodPost, "/worker/hb?key=k0", nil)
+	if _, err := getWorkerKeyFromReq(r); !errors.Is(err, util.ErrUnauthorized) {
+		t.Fatalf("Get worker key from query only, get %v, expect unauthorized", err)
+	}
+	r.Header.Set(auth.HEADER_WORKER_KEY, "k1")
+	if key, err := getWorkerKeyFromReq(r); err != nil || key != "k1" {
+		t.Fatalf("Get worker key %q %v, expect k1 from header", key, err)
+	}
+}
@@ -69,6 +69,10 @@ func (job *JobDumpres) GetTaskGen() task.TaskGenerator {
 	return nil
 }
 
+func (job *JobDumpres) GetTaskTypes() *task.TaskTypes {
+	return nil
+}
+
 func (job *JobDumpres) GetReport() string {
 	return ""
 }
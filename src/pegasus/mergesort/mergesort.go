@@ -1,9 +1,10 @@
 package mergesort
 
 import (
+	"context"
+	"fmt"
 	"pegasus/log"
 	"pegasus/task"
-	"pegasus/util"
 	"sort"
 	"time"
 )
@@ -12,6 +13,8 @@ const (
 	SPLIT_SEGMENTS      = 8
 	JOB_KIND_MERGESORT  = "Mergesort:mergesort"
 	TASK_KIND_MERGESORT = JOB_KIND_MERGESORT
+
+	TASKLET_TIMEOUT_MERGESORT = 10 * time.Second
 )
 
 type JobMergesort struct {
@@ -71,9 +74,9 @@ func (job *JobMergesort) GetNextTask(tid string) *task.TaskSpec {
 func (job *JobMergesort) ReduceTasks(reports []*task.TaskReport) error {
 	all := make([]int, 0)
 	for _, report := range reports {
-		a := make([]int, 0)
-		if err := util.FitDataInto(report.Output, &a); err != nil {
-			return err
+		a, ok := report.Output.([]int)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		all = append(all, a...)
 	}
@@ -98,6 +101,14 @@ func (job *JobMergesort) GetTaskGen() task.TaskGenerator {
 	return TaskGenMergesort
 }
 
+func (job *JobMergesort) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &taskSpecMergesort{},
+		Output:  []int{},
+		Version: 1,
+	}
+}
+
 func (job *JobMergesort) GetReport() string {
 	return ""
 }
@@ -110,8 +121,11 @@ func TaskGenMergesort(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskMergesort)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(taskSpecMergesort)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*taskSpecMergesort)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.seq = spec.Seq
 	return tsk, nil
 }
@@ -159,6 +173,10 @@ func (tsk *taskMergesort) GetTaskletCnt() int {
 	return tsk.taskletCnt
 }
 
+func (tsk *taskMergesort) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_MERGESORT
+}
+
 func (tsk *taskMergesort) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.left == 0 {
 		return nil
@@ -170,11 +188,19 @@ func (tsk *taskMergesort) GetNextTasklet(taskletid string) task.Tasklet {
 	}
 }
 
-func (tsk *taskMergesort) ReduceTasklets(tasklets []task.Tasklet) {
+func (tsk *taskMergesort) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
+	if prev != nil {
+		output, ok := prev.([]int)
+		if !ok {
+			return fmt.Errorf("Unexpected previous output %T", prev)
+		}
+		tsk.output = output
+	}
 	for _, t := range tasklets {
 		tasklet := t.(*taskletMergesort)
 		tsk.output = tasklet.seq
 	}
+	return nil
 }
 
 func (tsk *taskMergesort) SetError(err error) {
@@ -198,8 +224,12 @@ func (t *taskletMergesort) GetTaskletId() string {
 	return t.tid
 }
 
-func (t *taskletMergesort) Execute(ctx task.TaskletCtx) error {
+func (t *taskletMergesort) Execute(ctx context.Context, c task.TaskletCtx) error {
 	sort.Ints(t.seq)
-	time.Sleep(2 * time.Second)
-	return nil
+	select {
+	case <-time.After(2 * time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -1,11 +1,11 @@
 package mergesort
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"pegasus/log"
 	"pegasus/task"
-	"pegasus/util"
 	"time"
 )
 
@@ -15,6 +15,8 @@ const (
 	TASK_KIND_RANDINTS = JOB_KIND_RANDINTS
 	MIN_INT            = 1
 	MAX_INT            = 100
+
+	TASKLET_TIMEOUT_RANDINTS = 10 * time.Second
 )
 
 type JobRandInts struct {
@@ -61,9 +63,9 @@ func (job *JobRandInts) GetNextTask(tid string) *task.TaskSpec {
 
 func (job *JobRandInts) ReduceTasks(reports []*task.TaskReport) error {
 	for _, report := range reports {
-		a := make([]int, 0)
-		if err := util.FitDataInto(report.Output, &a); err != nil {
-			return err
+		a, ok := report.Output.([]int)
+		if !ok {
+			return fmt.Errorf("Unexpected output %T from task %q", report.Output, report.Tid)
 		}
 		job.output = append(job.output, a...)
 	}
@@ -86,6 +88,14 @@ func (job *JobRandInts) GetTaskGen() task.TaskGenerator {
 	return TaskGenRandInts
 }
 
+func (job *JobRandInts) GetTaskTypes() *task.TaskTypes {
+	return &task.TaskTypes{
+		Spec:    &taskSpecRandInts{},
+		Output:  []int{},
+		Version: 1,
+	}
+}
+
 func (job *JobRandInts) GetReport() string {
 	return ""
 }
@@ -95,12 +105,22 @@ type taskSpecRandInts struct {
 	Size int
 }
 
+func (spec *taskSpecRandInts) Validate() error {
+	if spec.Size <= 0 {
+		return fmt.Errorf("Size %d invalid", spec.Size)
+	}
+	return nil
+}
+
 func TaskGenRandInts(tspec *task.TaskSpec) (task.Task, error) {
 	tsk := new(taskRandInts)
 	tsk.tid = tspec.Tid
 	tsk.kind = tspec.Kind
-	spec := new(taskSpecRandInts)
-	task.DecodeSpec(tspec, spec)
+	// Decoded into the registered type by taskreg
+	spec, ok := tspec.Spec.(*taskSpecRandInts)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected spec %T", tspec.Spec)
+	}
 	tsk.seed = spec.Seed
 	tsk.total = spec.Size
 	tsk.left = spec.Size
@@ -157,6 +177,10 @@ func (tsk *taskRandInts) GetTaskletCnt() int {
 	return tsk.taskletCnt
 }
 
+func (tsk *taskRandInts) GetTaskletTimeout() time.Duration {
+	return TASKLET_TIMEOUT_RANDINTS
+}
+
 func (tsk *taskRandInts) GetNextTasklet(taskletid string) task.Tasklet {
 	if tsk.left == 0 {
 		return nil
@@ -172,12 +196,20 @@ func (tsk *taskRandInts) GetNextTasklet(taskletid string) task.Tasklet {
 	}
 }
 
-func (tsk *taskRandInts) ReduceTasklets(tasklets []task.Tasklet) {
+func (tsk *taskRandInts) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
+	if prev != nil {
+		ints, ok := prev.([]int)
+		if !ok {
+			return fmt.Errorf("Unexpected previous output %T", prev)
+		}
+		tsk.ints = append(tsk.ints, ints...)
+	}
 	for _, t := range tasklets {
 		tasklet := t.(*taskletRandInts)
 		log.Info("From %q, ints %v", tasklet.tid, tasklet.ints)
 		tsk.ints = append(tsk.ints, tasklet.ints...)
 	}
+	return nil
 }
 
 func (tsk *taskRandInts) SetError(err error) {
@@ -207,12 +239,16 @@ func (t *taskletRandInts) randInt(rand *rand.Rand) int {
 	return rand.Int()%d + MIN_INT
 }
 
-func (t *taskletRandInts) Execute(ctx task.TaskletCtx) error {
-	tctx := ctx.(*taskletRandIntsCtx)
+func (t *taskletRandInts) Execute(ctx context.Context, c task.TaskletCtx) error {
+	tctx := c.(*taskletRandIntsCtx)
 	t.ints = make([]int, 0)
 	for i := 0; i < t.size; i++ {
 		t.ints = append(t.ints, t.randInt(tctx.rand))
 	}
-	time.Sleep(2 * time.Second)
-	return nil
+	select {
+	case <-time.After(2 * time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
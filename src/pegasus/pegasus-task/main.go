@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"pegasus/log"
+	"pegasus/task"
+	"pegasus/taskreg"
+	"pegasus/util"
+	"pegasus/workgroup"
+)
+
+const TASKLET_MAX_ATTEMPTS = 3
+
+var (
+	specFile    = flag.String("spec", "", "task spec json file, read from stdin if empty")
+	executorCnt = flag.Int("executors", workgroup.WgCfgDef.WorkerExecutorCnt, "number of tasklet executors")
+	maxAttempts = flag.Int("attempts", TASKLET_MAX_ATTEMPTS, "max attempts for each tasklet")
+	showOutput  = flag.Bool("output", true, "include task output in the report")
+	debug       = flag.Bool("debug", false, "enable debug log")
+)
+
+func formatTimings(recs []*task.TaskletRec) string {
+	tbl := new(util.PrettyTable)
+	tbl.Init([]string{"Tasklet", "Executor", "Attempts", "Start", "Duration", "Error"})
+	for _, rec := range recs {
+		errMsg := ""
+		if rec.Err != nil {
+			errMsg = fmt.Sprintf("%s: %v",
+				task.GetErrClassStr(task.GetErrClass(rec.Err)), rec.Err)
+		}
+		tbl.AppendLine([]string{
+			rec.Id,
+			fmt.Sprintf("#%d", rec.Executor),
+			fmt.Sprintf("%d", rec.Attempts),
+			rec.StartTs.Format("15:04:05.000"),
+			rec.EndTs.Sub(rec.StartTs).String(),
+			errMsg,
+		})
+	}
+	return tbl.Format()
+}
+
+func readTaskSpec() (*task.TaskSpec, error) {
+	var buf []byte
+	var err error
+	if *specFile == "" {
+		buf, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		buf, err = ioutil.ReadFile(*specFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read task spec, %v", err)
+	}
+	tspec := new(task.TaskSpec)
+	if err := json.Unmarshal(buf, tspec); err != nil {
+		return nil, fmt.Errorf("Fail to unmarshal task spec, %v", err)
+	}
+	return tspec, nil
+}
+
+func spawnTask(tspec *task.TaskSpec) (task.Task, error) {
+	gen := taskreg.GetTaskGenerator(tspec.Kind)
+	if gen == nil {
+		return nil, fmt.Errorf("Task %q not supported", tspec.Kind)
+	}
+	if err := taskreg.DecodeTaskSpec(tspec); err != nil {
+		return nil, err
+	}
+	return gen(tspec)
+}
+
+func initLogger() error {
+	level := log.LevelInfo
+	if *debug {
+		level = log.LevelDebug
+	}
+	return log.RegisterLogger(&log.ConsoleLogger{Level: level})
+}
+
+func main() {
+	flag.Parse()
+	if err := initLogger(); err != nil {
+		panic(fmt.Errorf("Fail to init logger, %v", err))
+	}
+	if *executorCnt <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid executor count %d\n", *executorCnt)
+		os.Exit(2)
+	}
+	tspec, err := readTaskSpec()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tsk, err := spawnTask(tspec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to spawn task %q, %v\n", tspec.Tid, err)
+		os.Exit(1)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	policy := &task.RetryPolicy{
+		MaxAttempts: *maxAttempts,
+		Backoff:     task.TASKLET_RETRY_BACKOFF,
+		MaxBackoff:  task.TASKLET_RETRY_MAX_BACKOFF,
+	}
+	r := task.NewRunner(ctx, tsk, tspec.Resume, policy)
+	r.Run(*executorCnt)
+	report := r.GenerateReport()
+	if !*showOutput {
+		report.Output = nil
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Fail to marshal task report, %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Task report:\n%s\n\n", string(buf))
+	fmt.Printf("Tasklets:\n%s", formatTimings(r.GetTaskletRecs()))
+	if r.GetErr() != nil {
+		os.Exit(1)
+	}
+}
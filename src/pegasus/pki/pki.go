@@ -0,0 +1,106 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/server"
+	"pegasus/util"
+)
+
+// TLS and HTTP client are set up before anything is pulled from cfg
+// server, so their cfg is resolved from the layers below it, see
+// cfgmgr.InitLayers.
+type TlsCfg struct {
+	Enabled  bool
+	CaFile   string
+	CertFile string
+	KeyFile  string
+}
+
+var Cfg = new(TlsCfg)
+var CfgDef = &TlsCfg{
+	Enabled:  false,
+	CaFile:   "./certs/ca.pem",
+	CertFile: "./certs/node.pem",
+	KeyFile:  "./certs/node-key.pem",
+}
+
+var HttpCfg = new(util.HttpCfg)
+
+func RegisterCfg() {
+	cfgmgr.RegisterCfgEntry(Cfg, CfgDef)
+	cfgmgr.RegisterCfgEntry(HttpCfg, util.HttpCfgDef)
+	cfgmgr.RegisterCfgValidator(HttpCfg, cfgmgr.IntRange("MaxRetries", 0, 10))
+	cfgmgr.RegisterCfgValidator(HttpCfg, cfgmgr.IntRange("BreakerThreshold", 1, 1000))
+}
+
+// For components other than cfg server, which loads all the cfg entries
+// from its cfg file by itself.
+func InitFromLocalCfg() error {
+	RegisterCfg()
+	if err := cfgmgr.RegisterLayeredCfg(Cfg, CfgDef); err != nil {
+		return err
+	}
+	if err := cfgmgr.RegisterLayeredCfg(HttpCfg, util.HttpCfgDef); err != nil {
+		return err
+	}
+	return setup()
+}
+
+func Init() error {
+	if err := cfgmgr.GetCfgEntry(HttpCfg); err != nil {
+		return err
+	}
+	if err := cfgmgr.GetCfgEntry(Cfg); err != nil {
+		return err
+	}
+	return setup()
+}
+
+func setup() error {
+	util.ConfigHttpClient(HttpCfg)
+	log.Info("HTTP client cfg %+v", *HttpCfg)
+	if !Cfg.Enabled {
+		log.Info("TLS disabled")
+		return nil
+	}
+	pool, err := loadCaPool(Cfg.CaFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(Cfg.CertFile, Cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Fail to load cert %s, key %s, %v",
+			Cfg.CertFile, Cfg.KeyFile, err)
+	}
+	// Mutual TLS, both sides present node cert signed by cluster CA
+	server.EnableTls(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	util.EnableTls(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	log.Info("TLS enabled, CA %s, cert %s", Cfg.CaFile, Cfg.CertFile)
+	return nil
+}
+
+func loadCaPool(fpath string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read CA %s, %v", fpath, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("No valid cert found in CA %s", fpath)
+	}
+	return pool, nil
+}
@@ -1,12 +1,16 @@
 package rate
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"pegasus/log"
 	"pegasus/route"
 	"pegasus/server"
+	"pegasus/task"
 	"pegasus/util"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,8 +20,9 @@ import (
 var masterinfo = new(masterInfo)
 
 type masterInfo struct {
-	ip   string
-	port int
+	mutex sync.Mutex
+	ip    string
+	port  int
 }
 
 const (
@@ -116,9 +121,75 @@ func (stats *RateStats) summary() string {
 	return s
 }
 
-func GetHtml(link string) (string, error) {
+var htmlClient = new(http.Client)
+
+func getHtml(ctx context.Context, link string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		err = fmt.Errorf("Fail to make GET request to %s, %v", link, err)
+		return "", task.NewPermanentErr(err)
+	}
+	req = req.WithContext(ctx)
+	for name, value := range soup.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := htmlClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("Fail to GET %s, %w", link, err)
+		if ctx.Err() == context.Canceled {
+			return "", task.NewPermanentErr(err)
+		}
+		return "", task.NewRetryableErr(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("Fail to read body from %s, %v", link, err)
+		return "", task.NewRetryableErr(err)
+	}
+	if err := classifyStatus(resp); err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func classifyStatus(resp *http.Response) error {
+	code := resp.StatusCode
+	if code < http.StatusBadRequest {
+		return nil
+	}
+	err := fmt.Errorf("GET %s, %s", resp.Request.URL, resp.Status)
+	switch {
+	case code == http.StatusTooManyRequests:
+		return task.NewRateLimitedErr(err, parseRetryAfter(resp))
+	case code == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+		return task.NewRateLimitedErr(err, parseRetryAfter(resp))
+	case code == http.StatusForbidden:
+		return task.NewBannedErr(err)
+	case code >= http.StatusInternalServerError:
+		return task.NewRetryableErr(err)
+	default:
+		return task.NewPermanentErr(err)
+	}
+}
+
+func parseRetryAfter(resp *http.Response) time.Duration {
+	s := resp.Header.Get("Retry-After")
+	if s == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if ts, err := http.ParseTime(s); err == nil {
+		return time.Until(ts)
+	}
+	return 0
+}
+
+func GetHtml(ctx context.Context, link string) (string, error) {
 	t1 := time.Now()
-	resp, err := soup.Get(link)
+	resp, err := getHtml(ctx, link)
 	t2 := time.Now()
 	if err == nil {
 		rateStats.update(len(resp), t2.Sub(t1))
@@ -137,11 +208,13 @@ func reportRate(args interface{}) {
 	if stats.SuccessCnt+stats.FailureCnt == 0 {
 		return
 	}
+	masterinfo.mutex.Lock()
 	u := &util.HttpUrl{
 		IP:   masterinfo.ip,
 		Port: masterinfo.port,
 		Uri:  masterWorkerRateUri,
 	}
+	masterinfo.mutex.Unlock()
 	if _, err := util.HttpPostData(u, stats); err != nil {
 		log.Error("Fail to post rate data, %v", err)
 		rateStats.combine(stats)
@@ -183,7 +256,14 @@ func InitAsMaster() {
 	registerRoutes()
 }
 
-func InitAsWorker(masterIp string, masterPort int) {
+// Report to the master at the addr from now on.
+func SetMaster(masterIp string, masterPort int) {
+	masterinfo.mutex.Lock()
+	defer masterinfo.mutex.Unlock()
 	masterinfo.ip, masterinfo.port = masterIp, masterPort
+}
+
+func InitAsWorker(masterIp string, masterPort int) {
+	SetMaster(masterIp, masterPort)
 	go util.PeriodicalRoutine(true, workerReportInterval, reportRate, nil)
 }
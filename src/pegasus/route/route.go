@@ -1,8 +1,11 @@
 package route
 
 import (
+	"fmt"
 	"net/http"
+	"pegasus/auth"
 	"pegasus/log"
+	"pegasus/util"
 
 	"github.com/gorilla/mux"
 )
@@ -14,6 +17,8 @@ type Route struct {
 	Method  string
 	Path    string
 	Handler RouteHandler
+	// Public routes are served without verifying the request signature
+	Public bool
 }
 
 var routes = []*Route{}
@@ -26,7 +31,23 @@ func BuildRouter() *mux.Router {
 	r := mux.NewRouter()
 	for _, route := range routes {
 		log.Info("Add route %q", route.Name)
-		r.HandleFunc(route.Path, route.Handler).Methods(route.Method)
+		handler := route.Handler
+		if !route.Public {
+			handler = authHandler(route)
+		}
+		r.HandleFunc(route.Path, handler).Methods(route.Method)
 	}
 	return r
 }
+
+func authHandler(route *Route) RouteHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := auth.VerifyRequest(r); err != nil {
+			log.Error("Reject request %s %s from %s for %q, %v", r.Method,
+				r.RequestURI, r.RemoteAddr, route.Name, err)
+			util.WriteResp(w, fmt.Errorf("%w, %v", util.ErrUnauthorized, err), nil)
+			return
+		}
+		route.Handler(w, r)
+	}
+}
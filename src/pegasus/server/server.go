@@ -1,88 +1,105 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"pegasus/log"
 	"pegasus/route"
+	"pegasus/util"
 )
 
-func marshalData(data interface{}) ([]byte, error) {
-	s, ok := data.(string)
-	if ok {
-		return []byte(s), nil
-	}
-	buf := bytes.NewBuffer(nil)
-	enc := json.NewEncoder(buf)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(data); err != nil {
-		log.Error("Fail on json marshal, %v", err)
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
+// Respond with RespEnvelope, the status code follows the error, see
+// util.GetErrCode.
 func FmtResp(w http.ResponseWriter, err error, data interface{}) {
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		io.WriteString(w, err.Error())
-	} else {
-		w.Header().Set("Content-Type", "text/json; charset=utf-8")
-		buf, err := marshalData(data)
-		if err != nil {
-			FmtResp(w, err, nil)
-		}
-		_, err = w.Write(buf)
-		if err != nil {
-			log.Error("Fail to write resp data, %v", err)
-		}
-	}
+	util.WriteResp(w, err, data)
 }
 
 type serverHandler struct {
 	handler http.Handler
 }
 
+// Take request id from the caller if there is one, so the same request
+// could be traced across components.
 func (h *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Remote %s, method %s, access %s", r.RemoteAddr, r.Method, r.RequestURI)
+	rid := r.Header.Get(util.REQUEST_ID_HEADER)
+	if rid == "" {
+		rid = util.NewRequestId()
+	}
+	w.Header().Set(util.REQUEST_ID_HEADER, rid)
+	log.Debug("Remote %s, method %s, access %s, request %s", r.RemoteAddr,
+		r.Method, r.RequestURI, rid)
 	h.handler.ServeHTTP(w, r)
 }
 
+var tlsConfig *tls.Config
+
+// Serve https with the given config for all servers started afterwards.
+func EnableTls(c *tls.Config) {
+	tlsConfig = c
+}
+
 type Server struct {
 	listener net.Listener
 }
 
-func (s *Server) Listen(ip string) (err error) {
-	addr := fmt.Sprintf("%s:", ip)
+func listenAddr(ip string, port int) (string, error) {
+	if ip == "" {
+		return util.JoinAddr("", port), nil
+	}
+	ip, err := util.ParseHost(ip)
+	if err != nil {
+		return "", err
+	}
+	return util.JoinAddr(ip, port), nil
+}
+
+// Listen on all interfaces if ip is empty, on a random port if port is 0.
+func (s *Server) Listen(ip string, port int) error {
+	addr, err := listenAddr(ip, port)
+	if err != nil {
+		return err
+	}
 	s.listener, err = net.Listen("tcp", addr)
-	return
+	return err
 }
 
 func (s *Server) GetListenAddr() string {
 	return s.listener.Addr().String()
 }
 
+func (s *Server) GetListenPort() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
 func (s *Server) Serve() error {
 	r := route.BuildRouter()
 	handler := &serverHandler{
 		handler: r,
 	}
-	return http.Serve(s.listener, handler)
+	listener := s.listener
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return http.Serve(listener, handler)
 }
 
-func (s *Server) ListenAndServe(listenPort int) error {
+func (s *Server) ListenAndServe(ip string, listenPort int) error {
 	r := route.BuildRouter()
 	handler := &serverHandler{
 		handler: r,
 	}
+	addr, err := listenAddr(ip, listenPort)
+	if err != nil {
+		return err
+	}
 	httpServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", listenPort),
-		Handler: handler,
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		return httpServer.ListenAndServeTLS("", "")
 	}
 	return httpServer.ListenAndServe()
 }
@@ -0,0 +1,121 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	ErrClassRetryable = iota
+	ErrClassPermanent
+	ErrClassRateLimited
+	ErrClassBanned
+)
+
+func GetErrClassStr(class int) string {
+	switch class {
+	case ErrClassRetryable:
+		return "Retryable"
+	case ErrClassPermanent:
+		return "Permanent"
+	case ErrClassRateLimited:
+		return "RateLimited"
+	case ErrClassBanned:
+		return "Banned"
+	default:
+		return "Unknown"
+	}
+}
+
+type TaskletError struct {
+	Class      int
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *TaskletError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskletError) Unwrap() error {
+	return e.Err
+}
+
+func NewRetryableErr(err error) error {
+	return &TaskletError{Class: ErrClassRetryable, Err: err}
+}
+
+func NewPermanentErr(err error) error {
+	return &TaskletError{Class: ErrClassPermanent, Err: err}
+}
+
+func NewRateLimitedErr(err error, retryAfter time.Duration) error {
+	return &TaskletError{
+		Class:      ErrClassRateLimited,
+		RetryAfter: retryAfter,
+		Err:        err,
+	}
+}
+
+func NewBannedErr(err error) error {
+	return &TaskletError{Class: ErrClassBanned, Err: err}
+}
+
+// Errors without explicit class are treated as retryable, except
+// cancellation which only happens when the task is aborted.
+func GetErrClass(err error) int {
+	var terr *TaskletError
+	if errors.As(err, &terr) {
+		return terr.Class
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrClassPermanent
+	}
+	return ErrClassRetryable
+}
+
+func GetRetryAfter(err error) time.Duration {
+	var terr *TaskletError
+	if errors.As(err, &terr) {
+		return terr.RetryAfter
+	}
+	return 0
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (p *RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	if attempt+1 >= p.MaxAttempts {
+		return false
+	}
+	switch GetErrClass(err) {
+	case ErrClassRetryable, ErrClassRateLimited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Retry-After of the server is taken over the backoff, but capped by
+// MaxBackoff as well, so that a bogus one couldn't park the executor.
+func (p *RetryPolicy) Delay(err error, attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 0; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if retryAfter := GetRetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+		if delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+	return delay
+}
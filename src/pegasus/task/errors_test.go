@@ -0,0 +1,77 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGetErrClass(t *testing.T) {
+	base := errors.New("boom")
+	cases := []struct {
+		err   error
+		class int
+	}{
+		{base, ErrClassRetryable},
+		{NewRetryableErr(base), ErrClassRetryable},
+		{NewPermanentErr(base), ErrClassPermanent},
+		{NewRateLimitedErr(base, time.Second), ErrClassRateLimited},
+		{NewBannedErr(base), ErrClassBanned},
+		{fmt.Errorf("wrapped, %w", NewBannedErr(base)), ErrClassBanned},
+		{context.Canceled, ErrClassPermanent},
+		{fmt.Errorf("wrapped, %w", context.Canceled), ErrClassPermanent},
+	}
+	for i, c := range cases {
+		if class := GetErrClass(c.err); class != c.class {
+			t.Fatalf("Case %d, get class %s, expect %s", i,
+				GetErrClassStr(class), GetErrClassStr(c.class))
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := &RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+	}
+	base := errors.New("boom")
+	retries := []struct {
+		err     error
+		attempt int
+		retry   bool
+	}{
+		{NewRetryableErr(base), 0, true},
+		{NewRetryableErr(base), 1, true},
+		{NewRetryableErr(base), 2, false},
+		{NewRateLimitedErr(base, 0), 0, true},
+		{NewPermanentErr(base), 0, false},
+		{NewBannedErr(base), 0, false},
+	}
+	for i, c := range retries {
+		if retry := p.ShouldRetry(c.err, c.attempt); retry != c.retry {
+			t.Fatalf("Case %d, retry %v, expect %v", i, retry, c.retry)
+		}
+	}
+	delays := []struct {
+		err     error
+		attempt int
+		delay   time.Duration
+	}{
+		{base, 0, time.Second},
+		{base, 1, 2 * time.Second},
+		{base, 3, 8 * time.Second},
+		{base, 10, 30 * time.Second},
+		{NewRateLimitedErr(base, 5*time.Second), 0, 5 * time.Second},
+		// Backoff longer than Retry-After
+		{NewRateLimitedErr(base, 5*time.Second), 4, 16 * time.Second},
+		{NewRateLimitedErr(base, 24*time.Hour), 0, 30 * time.Second},
+	}
+	for i, c := range delays {
+		if delay := p.Delay(c.err, c.attempt); delay != c.delay {
+			t.Fatalf("Case %d, delay %v, expect %v", i, delay, c.delay)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Run f and turn a panic inside into a permanent error carrying the stack,
+// it makes no sense to retry on code bug.
+func Protect(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewPermanentErr(&PanicError{
+				Value: r,
+				Stack: string(debug.Stack()),
+			})
+		}
+	}()
+	return f()
+}
+
+func GetPanicStack(err error) string {
+	var perr *PanicError
+	if errors.As(err, &perr) {
+		return perr.Stack
+	}
+	return ""
+}
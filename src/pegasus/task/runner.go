@@ -0,0 +1,397 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"pegasus/log"
+	"pegasus/util"
+	"sync"
+	"time"
+)
+
+const (
+	BUF_TASKLET_CNT = 8
+
+	TASKLET_RETRY_BACKOFF     = 1 * time.Second
+	TASKLET_RETRY_MAX_BACKOFF = 30 * time.Second
+)
+
+// Execution of a tasklet, with all its attempts.
+type TaskletRec struct {
+	Id       string
+	Executor int
+	Attempts int
+	StartTs  time.Time
+	EndTs    time.Time
+	Err      error
+}
+
+// Runner runs a task through with its tasklets spread over executors, as
+// worker does and pegasus-task replays. Tasklets done in the attempt
+// resumed from are skipped, the first error aborts the rest.
+type Runner struct {
+	tsk     Task
+	resume  *TaskResume
+	policy  *RetryPolicy
+	skip    map[string]bool
+	ids     []string
+	reduced bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	todo    chan Tasklet
+	ctxList []TaskletCtx
+	// Following fields under mutex protection
+	mutex    sync.Mutex
+	err      error
+	done     []Tasklet
+	recs     []*TaskletRec
+	total    int
+	doneCnt  int
+	finished bool
+	startTs  time.Time
+	endTs    time.Time
+}
+
+// The runner is aborted once ctx is done.
+func NewRunner(ctx context.Context, tsk Task, resume *TaskResume, policy *RetryPolicy) *Runner {
+	r := &Runner{
+		tsk:     tsk,
+		resume:  resume,
+		policy:  policy,
+		skip:    make(map[string]bool),
+		todo:    make(chan Tasklet, BUF_TASKLET_CNT),
+		startTs: time.Now(),
+	}
+	if resume != nil {
+		for _, taskletid := range resume.Done {
+			r.skip[taskletid] = true
+		}
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	return r
+}
+
+func (r *Runner) setErr(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.cancel()
+}
+
+func (r *Runner) GetErr() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Runner) aborted() bool {
+	return r.GetErr() != nil
+}
+
+// Abort the task with err, unless it's finished already.
+func (r *Runner) Abort(err error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.finished {
+		return fmt.Errorf("Task %q already finished", r.tsk.GetTaskId())
+	}
+	if r.err == nil {
+		r.err = err
+	}
+	r.cancel()
+	return nil
+}
+
+func (r *Runner) GetStatus() *TaskStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &TaskStatus{
+		Tid:      r.tsk.GetTaskId(),
+		Desc:     r.tsk.GetDesc(),
+		StartTs:  r.startTs,
+		Finished: r.finished,
+		Total:    r.total,
+		Done:     r.doneCnt,
+	}
+}
+
+func (r *Runner) GetTaskletRecs() []*TaskletRec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*TaskletRec(nil), r.recs...)
+}
+
+// Run one step of the task lifecycle, a panic in task code is converted
+// into task error instead of crashing the caller.
+func (r *Runner) step(name string, f func() error) bool {
+	err := Protect(f)
+	if err == nil {
+		return true
+	}
+	if stack := GetPanicStack(err); stack != "" {
+		log.Error("Panic on %s for task %q, %v\n%s", name, r.tsk.GetTaskId(), err, stack)
+	} else {
+		log.Error("Fail to %s for task %q, %v", name, r.tsk.GetTaskId(), err)
+	}
+	r.setErr(err)
+	return false
+}
+
+// Run the task with cnt executors till all tasklets are done or the task
+// is aborted, the error of the task is set by then.
+func (r *Runner) Run(cnt int) {
+	tsk := r.tsk
+	if r.step("init", func() error { return tsk.Init(cnt) }) {
+		r.init()
+		r.step("prepare executors", func() error {
+			r.prepareExecutors(cnt)
+			return nil
+		})
+		r.step("assign tasklets", func() error {
+			r.assignTasklets()
+			return nil
+		})
+		log.Info("Wait for task %q done", tsk.GetTaskId())
+		r.wg.Wait()
+		if err := r.ctx.Err(); err != nil {
+			// Cancelled by the ctx given rather than aborted
+			r.setErr(fmt.Errorf("Task %q aborted, %w", tsk.GetTaskId(), err))
+		}
+		r.step("release executors", func() error {
+			r.releaseExecutors()
+			return nil
+		})
+		r.step("reduce tasklets", r.reduceTasklets)
+	}
+	r.mutex.Lock()
+	r.finished = true
+	r.endTs = time.Now()
+	err := r.err
+	r.mutex.Unlock()
+	r.cancel()
+	if err != nil {
+		tsk.SetError(err)
+	}
+}
+
+func (r *Runner) init() {
+	taskletCnt := r.tsk.GetTaskletCnt()
+	log.Info("Task %q tasklet count %d", r.tsk.GetTaskId(), taskletCnt)
+	if r.resume != nil {
+		log.Info("Resume task %q, attempt %d, %d tasklets done", r.tsk.GetTaskId(),
+			r.resume.Attempt, len(r.resume.Done))
+	}
+	r.ids = make([]string, 0, taskletCnt)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.total = taskletCnt
+	r.doneCnt = len(r.skip)
+}
+
+func (r *Runner) prepareExecutors(cnt int) {
+	for i := 0; i < cnt; i++ {
+		c := r.tsk.NewTaskletCtx()
+		r.wg.Add(1)
+		go r.executor(i, c)
+		if c != nil {
+			r.ctxList = append(r.ctxList, c)
+		}
+	}
+}
+
+func (r *Runner) releaseExecutors() {
+	log.Info("Release all executors' ctx")
+	for _, c := range r.ctxList {
+		c.Close()
+	}
+}
+
+// Tasklets are still enumerated after abort, so that the ids of the
+// remaining ones could be reported back for resume.
+func (r *Runner) assignTasklets() {
+	log.Info("Assign tasklets")
+	defer close(r.todo)
+	abortLogged := false
+	for i := 0; ; i++ {
+		taskletid := fmt.Sprintf("%s-%d", r.tsk.GetTaskId(), i)
+		tasklet := r.tsk.GetNextTasklet(taskletid)
+		if tasklet == nil {
+			break
+		}
+		r.ids = append(r.ids, tasklet.GetTaskletId())
+		if r.skip[tasklet.GetTaskletId()] {
+			log.Info("Skip tasklet %q done in previous attempt", tasklet.GetTaskletId())
+			continue
+		}
+		if r.aborted() {
+			if !abortLogged {
+				log.Info("Abort assign tasklets")
+				abortLogged = true
+			}
+			continue
+		}
+		log.Info("Put tasklet %q to todo list", tasklet.GetTaskletId())
+		select {
+		case r.todo <- tasklet:
+		case <-r.ctx.Done():
+			log.Info("Abort assign tasklets, %v", r.ctx.Err())
+			abortLogged = true
+		}
+	}
+	log.Info("Assign tasklets finished")
+}
+
+func (r *Runner) executor(eid int, c TaskletCtx) {
+	defer r.wg.Done()
+	for {
+		if r.aborted() {
+			log.Info("Error set in task, abort executor #%d", eid)
+			break
+		}
+		log.Info("Executor #%d, retrieve todo tasklet...", eid)
+		var tasklet Tasklet
+		var ok bool
+		select {
+		case tasklet, ok = <-r.todo:
+		case <-r.ctx.Done():
+			log.Info("Task ctx cancelled, abort executor #%d", eid)
+			return
+		}
+		if !ok {
+			log.Info("Todo tasklets drained, exit executor #%d", eid)
+			break
+		}
+		log.Info("Executor #%d execute tasklet %q", eid, tasklet.GetTaskletId())
+		rec := &TaskletRec{
+			Id:       tasklet.GetTaskletId(),
+			Executor: eid,
+			StartTs:  time.Now(),
+		}
+		for i := 0; ; i++ {
+			rec.Attempts++
+			if rec.Err = r.executeTasklet(tasklet, c); rec.Err == nil {
+				break
+			}
+			if r.aborted() || !r.policy.ShouldRetry(rec.Err, i) {
+				break
+			}
+			delay := r.policy.Delay(rec.Err, i)
+			log.Info("Retry execute tasklet %q after %v, %s error, %v",
+				rec.Id, delay, GetErrClassStr(GetErrClass(rec.Err)), rec.Err)
+			if util.SleepContext(r.ctx, delay) != nil {
+				break
+			}
+		}
+		rec.EndTs = time.Now()
+		log.Info("Executor #%d execute tasklet %q done", eid, rec.Id)
+		r.addRec(rec, tasklet)
+		if rec.Err != nil {
+			log.Info("Fail on tasklet %q, %s error, %v", rec.Id,
+				GetErrClassStr(GetErrClass(rec.Err)), rec.Err)
+			r.setErr(rec.Err)
+			break
+		}
+	}
+	log.Info("Executor #%d, exit", eid)
+}
+
+func (r *Runner) executeTasklet(tasklet Tasklet, c TaskletCtx) error {
+	tctx := r.ctx
+	if timeout := r.tsk.GetTaskletTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		tctx, cancel = context.WithTimeout(r.ctx, timeout)
+		defer cancel()
+	}
+	err := Protect(func() error { return tasklet.Execute(tctx, c) })
+	if stack := GetPanicStack(err); stack != "" {
+		log.Error("Panic on tasklet %q, %v\n%s", tasklet.GetTaskletId(), err, stack)
+	}
+	return err
+}
+
+func (r *Runner) addRec(rec *TaskletRec, tasklet Tasklet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.recs = append(r.recs, rec)
+	if rec.Err == nil {
+		r.done = append(r.done, tasklet)
+		r.doneCnt++
+	}
+}
+
+// Tasklets done are reduced even if the task failed, so that their output
+// is kept for resume.
+func (r *Runner) reduceTasklets() error {
+	log.Info("Reduce tasklets for task %q", r.tsk.GetTaskId())
+	r.mutex.Lock()
+	done := r.done
+	r.mutex.Unlock()
+	var prev interface{}
+	if r.resume != nil {
+		prev = r.resume.Output
+	}
+	if err := r.tsk.ReduceTasklets(prev, done); err != nil {
+		return fmt.Errorf("Fail to reduce tasklets, %w", err)
+	}
+	r.reduced = true
+	return nil
+}
+
+func (r *Runner) collectProgress() (done, remaining []string) {
+	done = make([]string, 0)
+	if r.resume != nil {
+		done = append(done, r.resume.Done...)
+	}
+	if r.reduced {
+		for _, tasklet := range r.done {
+			done = append(done, tasklet.GetTaskletId())
+		}
+	}
+	set := make(map[string]bool, len(done))
+	for _, taskletid := range done {
+		set[taskletid] = true
+	}
+	remaining = make([]string, 0)
+	for _, taskletid := range r.ids {
+		if !set[taskletid] {
+			remaining = append(remaining, taskletid)
+		}
+	}
+	return done, remaining
+}
+
+// Report of the task once Run returns, output of the attempt resumed from
+// is carried on if the tasklets done are not reduced.
+func (r *Runner) GenerateReport() *TaskReport {
+	tsk := r.tsk
+	status := r.GetStatus()
+	errMsg := ""
+	if err := tsk.GetError(); err != nil {
+		errMsg = err.Error()
+	}
+	done, remaining := r.collectProgress()
+	r.mutex.Lock()
+	endTs := r.endTs
+	r.mutex.Unlock()
+	var output interface{}
+	if r.reduced {
+		output = tsk.GetOutput()
+	} else if r.resume != nil {
+		output = r.resume.Output
+	}
+	return &TaskReport{
+		Err:       errMsg,
+		Tid:       tsk.GetTaskId(),
+		Kind:      tsk.GetKind(),
+		StartTs:   status.StartTs,
+		EndTs:     endTs,
+		Status:    status,
+		Output:    output,
+		Done:      done,
+		Remaining: remaining,
+		Stack:     GetPanicStack(r.GetErr()),
+	}
+}
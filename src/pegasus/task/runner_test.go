@@ -0,0 +1,50 @@
+package task
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type testTasklet struct {
+	id string
+}
+
+func (t *testTasklet) GetTaskletId() string {
+	return t.id
+}
+
+func (t *testTasklet) Execute(ctx context.Context, c TaskletCtx) error {
+	return nil
+}
+
+func TestCollectProgress(t *testing.T) {
+	ids := []string{"t-0", "t-1", "t-2", "t-3"}
+	cases := []struct {
+		resume    []string
+		done      []string
+		reduced   bool
+		expect    []string
+		remaining []string
+	}{
+		{nil, nil, false, []string{}, ids},
+		{nil, []string{"t-1", "t-0"}, true, []string{"t-1", "t-0"}, []string{"t-2", "t-3"}},
+		{nil, []string{"t-1", "t-0"}, false, []string{}, ids},
+		{[]string{"t-0"}, []string{"t-2"}, true, []string{"t-0", "t-2"}, []string{"t-1", "t-3"}},
+		{[]string{"t-0"}, []string{"t-2"}, false, []string{"t-0"}, []string{"t-1", "t-2", "t-3"}},
+	}
+	for _, c := range cases {
+		r := &Runner{ids: ids, reduced: c.reduced}
+		for _, id := range c.done {
+			r.done = append(r.done, &testTasklet{id: id})
+		}
+		if c.resume != nil {
+			r.resume = &TaskResume{Done: c.resume}
+		}
+		done, remaining := r.collectProgress()
+		if !reflect.DeepEqual(done, c.expect) || !reflect.DeepEqual(remaining, c.remaining) {
+			t.Fatalf("Collect progress of %+v, get %v %v, expect %v %v",
+				c, done, remaining, c.expect, c.remaining)
+		}
+	}
+}
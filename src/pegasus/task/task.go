@@ -1,8 +1,7 @@
 package task
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"time"
 )
 
@@ -38,9 +37,24 @@ type Job interface {
 	GetOutput() interface{}
 	GetNextJobs() []Job
 	GetTaskGen() TaskGenerator
+	GetTaskTypes() *TaskTypes
 	GetReport() string
 }
 
+// Concrete types of TaskSpec.Spec and TaskReport.Output for a task kind,
+// given as zero values such as &TspecFoo{}. Version should be bumped when
+// either of them changes, so that master and worker could tell.
+type TaskTypes struct {
+	Spec    interface{}
+	Output  interface{}
+	Version int
+}
+
+// Specs implementing Validator are checked before dispatch.
+type Validator interface {
+	Validate() error
+}
+
 type JobStatus struct {
 	Kind       string
 	Total      int
@@ -55,20 +69,18 @@ const (
 )
 
 type TaskSpec struct {
-	Tid  string
-	Kind string
-	Spec interface{}
+	Tid    string
+	Kind   string
+	Spec   interface{}
+	Resume *TaskResume
 }
 
-func DecodeSpec(tspec *TaskSpec, subspec interface{}) error {
-	buf, err := json.Marshal(tspec.Spec)
-	if err != nil {
-		return fmt.Errorf("Fail to marshal tspec, %v", err)
-	}
-	if err = json.Unmarshal(buf, subspec); err != nil {
-		return fmt.Errorf("Fail to unmarshal spec, %v", err)
-	}
-	return nil
+// TaskResume carries the progress of previous failed attempts, tasklets
+// listed in Done are skipped and Output is merged on ReduceTasklets.
+type TaskResume struct {
+	Attempt int
+	Done    []string
+	Output  interface{}
 }
 
 type TaskGenerator func(tspec *TaskSpec) (Task, error)
@@ -80,8 +92,9 @@ type Task interface {
 	GetKind() string
 	GetDesc() string
 	GetTaskletCnt() int
+	GetTaskletTimeout() time.Duration
 	GetNextTasklet(string) Tasklet
-	ReduceTasklets([]Tasklet)
+	ReduceTasklets(interface{}, []Tasklet) error
 	SetError(error)
 	GetError() error
 	GetOutput() interface{}
@@ -89,7 +102,7 @@ type Task interface {
 
 type Tasklet interface {
 	GetTaskletId() string
-	Execute(TaskletCtx) error
+	Execute(context.Context, TaskletCtx) error
 }
 
 type TaskletCtx interface {
@@ -97,13 +110,17 @@ type TaskletCtx interface {
 }
 
 type TaskReport struct {
-	Err     string
-	Tid     string
-	Kind    string
-	StartTs time.Time
-	EndTs   time.Time
-	Status  *TaskStatus
-	Output  interface{}
+	Err       string
+	Tid       string
+	Kind      string
+	StartTs   time.Time
+	EndTs     time.Time
+	Status    *TaskStatus
+	Output    interface{}
+	Done      []string
+	Remaining []string
+	Aborted   bool
+	Stack     string
 }
 
 type TaskStatus struct {
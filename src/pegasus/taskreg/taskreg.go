@@ -6,6 +6,7 @@ import (
 	"pegasus/log"
 	"pegasus/mergesort"
 	"pegasus/task"
+	"pegasus/util"
 	"reflect"
 )
 
@@ -13,6 +14,8 @@ var projs = make(map[string]reflect.Type)
 
 var taskGens = make(map[string]task.TaskGenerator)
 
+var taskTypes = make(map[string]*task.TaskTypes)
+
 func register(proj task.Project) {
 	name := proj.GetName()
 	log.Info("Register proj %q", name)
@@ -34,6 +37,10 @@ func registerTasks(proj task.Project) error {
 		}
 		log.Info("Register task %q", kind)
 		taskGens[kind] = job.GetTaskGen()
+		if types := job.GetTaskTypes(); types != nil {
+			taskTypes[kind] = types
+			util.RegisterPayloadTypes(types.Spec, types.Output)
+		}
 	}
 	return nil
 }
@@ -54,6 +61,68 @@ func GetTaskGenerator(kind string) task.TaskGenerator {
 	return gen
 }
 
+// Task kinds with typed specs, mapped to their versions.
+func GetTaskKinds() map[string]int {
+	kinds := make(map[string]int, len(taskTypes))
+	for kind, types := range taskTypes {
+		kinds[kind] = types.Version
+	}
+	return kinds
+}
+
+func decodeInto(data interface{}, sample interface{}) (interface{}, error) {
+	v := reflect.New(reflect.TypeOf(sample))
+	if err := util.FitDataIntoStrict(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+// Decode spec and resume output of tspec into the registered types of its
+// kind, so that they are used as is afterwards. The spec is validated if
+// it implements task.Validator.
+func DecodeTaskSpec(tspec *task.TaskSpec) error {
+	types, ok := taskTypes[tspec.Kind]
+	if !ok {
+		return fmt.Errorf("Task %q kind %q not registered", tspec.Tid, tspec.Kind)
+	}
+	spec, err := decodeInto(tspec.Spec, types.Spec)
+	if err != nil {
+		return fmt.Errorf("Task %q spec doesn't match %T, %v", tspec.Tid, types.Spec, err)
+	}
+	if v, ok := spec.(task.Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("Task %q invalid spec, %v", tspec.Tid, err)
+		}
+	}
+	tspec.Spec = spec
+	if tspec.Resume != nil && tspec.Resume.Output != nil {
+		output, err := decodeInto(tspec.Resume.Output, types.Output)
+		if err != nil {
+			return fmt.Errorf("Task %q resume output doesn't match %T, %v",
+				tspec.Tid, types.Output, err)
+		}
+		tspec.Resume.Output = output
+	}
+	return nil
+}
+
+func DecodeTaskReport(report *task.TaskReport) error {
+	types, ok := taskTypes[report.Kind]
+	if !ok {
+		return fmt.Errorf("Task %q kind %q not registered", report.Tid, report.Kind)
+	}
+	if report.Output == nil {
+		return nil
+	}
+	output, err := decodeInto(report.Output, types.Output)
+	if err != nil {
+		return fmt.Errorf("Task %q output doesn't match %T, %v", report.Tid, types.Output, err)
+	}
+	report.Output = output
+	return nil
+}
+
 func init() {
 	register(&mergesort.ProjMergesort{})
 	register(&lianjia.ProjLianjia{})
@@ -1,10 +1,39 @@
 #!/bin/bash
+# Start a Lianjia project and stream its progress. Requests are signed with
+# $PEGASUS_CLUSTER_SECRET as auth.SignRequest does, set SCHEME=https to go
+# through TLS with the node cert in ./certs.
 
-master=$(curl -s -X GET http://127.0.0.1:10086/master)
-curl -s -X POST http://${master}/project?proj=Lianjia-Crawler
-for i in $(seq 600); do
-    echo "======================================="
-    curl -s -X GET http://${master}/project/status
-    #curl -s -X GET http://${master}/rate
-    sleep 1
-done
+CFG_SERVER=${CFG_SERVER:-127.0.0.1:10086}
+SCHEME=${SCHEME:-http}
+CURL_OPTS=(-s)
+if [ "$SCHEME" = "https" ]; then
+    CURL_OPTS+=(--cacert certs/ca.pem --cert certs/node.pem --key certs/node-key.pem)
+fi
+
+# signed_curl METHOD ADDR URI [BODY] [CURL_ARGS...]
+signed_curl() {
+    local method=$1 addr=$2 uri=$3 body=$4
+    shift 4
+    local headers=()
+    if [ -n "$PEGASUS_CLUSTER_SECRET" ]; then
+        local ts nonce hash sig
+        ts=$(date +%s)
+        nonce=$(openssl rand -hex 16)
+        hash=$(printf '%s' "$body" | openssl dgst -sha256 -r | cut -d' ' -f1)
+        sig=$(printf '%s\n%s\n%s\n%s\n%s' "$method" "$uri" "$ts" "$nonce" "$hash" |
+            openssl dgst -sha256 -hmac "$PEGASUS_CLUSTER_SECRET" -r | cut -d' ' -f1)
+        headers=(-H "X-Pegasus-Timestamp: $ts" -H "X-Pegasus-Nonce: $nonce"
+            -H "X-Pegasus-Signature: $sig")
+    fi
+    if [ -n "$body" ]; then
+        headers+=(-H "Content-Type: application/json" --data-binary "$body")
+    fi
+    curl "${CURL_OPTS[@]}" -X "$method" "${headers[@]}" "$@" "${SCHEME}://${addr}${uri}"
+}
+
+master=$(signed_curl GET "$CFG_SERVER" "/registry?role=master" "" |
+    python3 -c 'import json,sys; print(json.load(sys.stdin)["content"]["Instances"][0]["Addr"])')
+signed_curl POST "$master" "/project?proj=Lianjia-Crawler" "{}"
+echo
+# Stream progress events, resume with "-H 'Last-Event-ID: <id>'" after reconnect
+signed_curl GET "$master" "/project/events?since=0" "" -N
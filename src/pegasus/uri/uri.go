@@ -2,26 +2,57 @@ package uri
 
 // URIs for CFG server
 const (
-	CfgUriRoot   = "/cfg"
-	CfgPingUri   = "/ping"
-	CfgMasterUri = "/master"
-	CfgEchoIpUri = "/echoip"
-	CfgTestUri   = "/test"
+	CfgUriRoot          = "/cfg"
+	CfgPingUri          = "/ping"
+	CfgMasterUri        = "/master"
+	CfgEchoIpUri        = "/echoip"
+	CfgTestUri          = "/test"
+	CfgWatchUri         = "/cfg/watch"
+	CfgAuditUri         = "/cfg/audit"
+	CfgRevsUri          = "/cfg/revisions"
+	CfgDiffUri          = "/cfg/diff"
+	CfgRollbackUri      = "/cfg/rollback"
+	CfgEffectiveUri     = "/cfg/effective"
+	RegistryUri         = "/registry"
+	RegistryLeaseUri    = "/registry/lease"
+	RegistryWatchUri    = "/registry/watch"
+	LeaderUri           = "/leader"
+	LeaderCampaignUri   = "/leader/campaign"
+	CheckpointUri       = "/leader/checkpoint"
+	CheckpointReportUri = "/leader/checkpoint/report"
 
 	MasterRegisterWokerUri    = "/worker"
 	MasterWorkerHbUri         = "/worker/heartbeat"
 	MasterWorkerHbIntervalUri = "/worker/heartbeat/interval"
 	MasterWorkerTaskStatusUri = "/worker/task/status"
 	MasterWorkerTaskReportUri = "/worker/task/report"
+	MasterWorkerInventoryUri  = "/worker/inventory"
 	MasterProjectUri          = "/project"
 	MasterProjectStatusUri    = "/project/status"
+	MasterProjectEventsUri    = "/project/events"
 	MasterTestUri             = "/test"
+	MasterCfgRevUri           = "/cfg/revision"
+	MasterCfgEffectiveUri     = "/cfg/effective"
 
-	WorkerTaskUri = "/task"
-	WorkerTestUri = "/test"
+	WorkerTaskUri         = "/task"
+	WorkerTestUri         = "/test"
+	WorkerCfgRevUri       = "/cfg/revision"
+	WorkerCfgEffectiveUri = "/cfg/effective"
 )
 
 const (
-	MasterWorkerQueryKey = "key"
 	MasterProjNameKey    = "proj"
+	WorkerTaskIdKey      = "tid"
+	MasterEventsSinceKey = "since"
+	CfgRevKey            = "rev"
+	CfgTimeoutKey        = "timeout"
+	CfgPathKey           = "path"
+	CfgLimitKey          = "limit"
+	CfgFromKey           = "from"
+	CfgToKey             = "to"
+	MasterCfgRevKey      = "cfgrev"
+	RegistryRoleKey      = "role"
+	RegistryIdKey        = "id"
+	LeaderTokenKey       = "token"
+	CheckpointKeyKey     = "key"
 )
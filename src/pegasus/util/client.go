@@ -0,0 +1,232 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type HttpCfg struct {
+	ConnectTimeoutMs    int
+	RequestTimeoutMs    int
+	MaxIdleConnsPerHost int
+	IdleConnTimeoutMs   int
+	// Retries apply to idempotent requests only, such as GET and DELETE,
+	// and PUT failing to connect
+	MaxRetries     int
+	RetryBackoffMs int
+	// Peer is cut off for cooldown after this many consecutive failures
+	BreakerThreshold  int
+	BreakerCooldownMs int
+}
+
+var HttpCfgDef = &HttpCfg{
+	ConnectTimeoutMs:    3000,
+	RequestTimeoutMs:    30000,
+	MaxIdleConnsPerHost: 8,
+	IdleConnTimeoutMs:   90000,
+	MaxRetries:          2,
+	RetryBackoffMs:      200,
+	BreakerThreshold:    5,
+	BreakerCooldownMs:   10000,
+}
+
+var ErrCircuitOpen = errors.New("Circuit open")
+
+var (
+	httpScheme = "http"
+	httpTls    *tls.Config
+	httpCfg    = HttpCfgDef
+	httpClient = newHttpClient()
+	breakers   = &breakerSet{peers: make(map[string]*breaker)}
+)
+
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// Shared by all requests, so connections to the same peer are reused.
+// Overall timeout is applied per request through context, callers that
+// need longer, such as long polling, pass their own deadline.
+func newHttpClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   ms(httpCfg.ConnectTimeoutMs),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     httpTls,
+			TLSHandshakeTimeout: ms(httpCfg.ConnectTimeoutMs),
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: httpCfg.MaxIdleConnsPerHost,
+			IdleConnTimeout:     ms(httpCfg.IdleConnTimeoutMs),
+		},
+	}
+}
+
+// Switch all requests to https with the given client config.
+func EnableTls(c *tls.Config) {
+	httpScheme = "https"
+	httpTls = c
+	httpClient = newHttpClient()
+}
+
+// Should be called before any request is sent.
+func ConfigHttpClient(c *HttpCfg) {
+	httpCfg = c
+	httpClient = newHttpClient()
+	breakers = &breakerSet{peers: make(map[string]*breaker)}
+}
+
+const (
+	BREAKER_CLOSED = iota
+	BREAKER_OPEN
+	BREAKER_HALF_OPEN
+)
+
+type breaker struct {
+	state    int
+	failures int
+	openTs   time.Time
+}
+
+type breakerSet struct {
+	mutex sync.Mutex
+	peers map[string]*breaker
+}
+
+func (bs *breakerSet) get(peer string) *breaker {
+	b, ok := bs.peers[peer]
+	if !ok {
+		b = new(breaker)
+		bs.peers[peer] = b
+	}
+	return b
+}
+
+// Once cooldown passes, a single trial request is let through, the
+// circuit closes if it succeeds and opens again otherwise.
+func (bs *breakerSet) allow(peer string) error {
+	if httpCfg.BreakerThreshold <= 0 {
+		return nil
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	b := bs.get(peer)
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openTs) < ms(httpCfg.BreakerCooldownMs) {
+			return fmt.Errorf("%w to %s after %d failures", ErrCircuitOpen,
+				peer, b.failures)
+		}
+		b.state = BREAKER_HALF_OPEN
+	case BREAKER_HALF_OPEN:
+		return fmt.Errorf("%w to %s, trial in progress", ErrCircuitOpen, peer)
+	}
+	return nil
+}
+
+func (bs *breakerSet) report(peer string, ok bool) {
+	if httpCfg.BreakerThreshold <= 0 {
+		return
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	b := bs.get(peer)
+	if ok {
+		b.state, b.failures = BREAKER_CLOSED, 0
+		return
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || b.failures >= httpCfg.BreakerThreshold {
+		b.state, b.openTs = BREAKER_OPEN, time.Now()
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Failed to connect, so the peer never got the request.
+func isNotSent(err error) bool {
+	var oerr *net.OpError
+	return errors.As(err, &oerr) && oerr.Op == "dial"
+}
+
+// PUT is idempotent by spec, but handlers such as /cfg keep history of
+// each update, so it's retried only if never sent.
+func canRetry(method string, err error) bool {
+	return isIdempotent(method) || (method == http.MethodPut && isNotSent(err))
+}
+
+// Only failures of the peer itself count, not rejected requests.
+func isPeerFailure(err error) bool {
+	var serr *HttpStatusErr
+	if errors.As(err, &serr) {
+		switch serr.Code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+func sendRequest(ctx context.Context, method string, url *HttpUrl,
+	mime, encoding, rid string, body []byte) (string, error) {
+	if _, ok := ctx.Deadline(); !ok && httpCfg.RequestTimeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ms(httpCfg.RequestTimeoutMs))
+		defer cancel()
+	}
+	req, err := newRequest(ctx, method, url, mime, encoding, rid, body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	return readResp(resp)
+}
+
+func doRequestContext(ctx context.Context, method string, url *HttpUrl,
+	mime, encoding string, body []byte) (string, error) {
+	peer := JoinAddr(url.IP, url.Port)
+	backoff := ms(httpCfg.RetryBackoffMs)
+	// Retries share the request id
+	rid := NewRequestId()
+	var s string
+	var err error
+	for i := 0; ; i++ {
+		if berr := breakers.allow(peer); berr != nil {
+			if i > 0 {
+				// Circuit opened by previous attempts, report their error
+				return s, err
+			}
+			return "", berr
+		}
+		s, err = sendRequest(ctx, method, url, mime, encoding, rid, body)
+		failed := err != nil && isPeerFailure(err)
+		breakers.report(peer, !failed)
+		if !failed || i >= httpCfg.MaxRetries || !canRetry(method, err) || ctx.Err() != nil {
+			return s, err
+		}
+		if err := SleepContext(ctx, backoff); err != nil {
+			return "", err
+		}
+		backoff *= 2
+	}
+}
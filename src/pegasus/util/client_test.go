@@ -0,0 +1,140 @@
+package util
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serve with status, counting requests.
+func startStatusServer(t *testing.T, status *int32, cnt *int32) (*httptest.Server, *HttpUrl) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(cnt, 1)
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+	return s, makeTestUrl(t, s, "/test")
+}
+
+func TestRequestRetry(t *testing.T) {
+	cases := []struct {
+		method     string
+		maxRetries int
+		refused    bool
+		attempts   int
+	}{
+		{http.MethodGet, 0, false, 1},
+		{http.MethodGet, 1, false, 2},
+		{http.MethodGet, 3, false, 4},
+		{http.MethodDelete, 2, false, 3},
+		{http.MethodPost, 2, false, 1},
+		{http.MethodPut, 2, false, 1},
+		// Never sent
+		{http.MethodPut, 2, true, 3},
+		{http.MethodPost, 2, true, 1},
+	}
+	defer ConfigHttpClient(HttpCfgDef)
+	for _, tc := range cases {
+		ConfigHttpClient(&HttpCfg{
+			RequestTimeoutMs: 3000,
+			MaxRetries:       tc.maxRetries,
+			RetryBackoffMs:   10,
+			BreakerThreshold: 100,
+		})
+		status, cnt := int32(http.StatusServiceUnavailable), int32(0)
+		s, u := startStatusServer(t, &status, &cnt)
+		if tc.refused {
+			s.Close()
+		}
+		start := time.Now()
+		_, err := doRequest(tc.method, u, "", "", nil)
+		s.Close()
+		if err == nil {
+			t.Fatalf("%s with %d retries, expect error", tc.method, tc.maxRetries)
+		}
+		attempts := int(cnt)
+		if tc.refused {
+			if !isNotSent(err) {
+				t.Fatalf("%s to closed server, get %v, expect dial error", tc.method, err)
+			}
+			attempts = breakers.peers[JoinAddr(u.IP, u.Port)].failures
+		}
+		if attempts != tc.attempts {
+			t.Fatalf("%s with %d retries, refused %v, sent %d times, expect %d",
+				tc.method, tc.maxRetries, tc.refused, attempts, tc.attempts)
+		}
+		// Backoff doubles from 10ms
+		backoff := time.Duration((1<<uint(tc.attempts-1))-1) * 10 * time.Millisecond
+		if d := time.Since(start); d < backoff {
+			t.Fatalf("%s retried %d times within %v, expect backoff %v",
+				tc.method, tc.attempts-1, d, backoff)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	ConfigHttpClient(&HttpCfg{
+		RequestTimeoutMs:  3000,
+		BreakerThreshold:  3,
+		BreakerCooldownMs: 50,
+	})
+	defer ConfigHttpClient(HttpCfgDef)
+	status, cnt := int32(http.StatusServiceUnavailable), int32(0)
+	s, u := startStatusServer(t, &status, &cnt)
+	defer s.Close()
+	get := func() error {
+		_, err := HttpGet(u)
+		return err
+	}
+	cases := []struct {
+		name   string
+		status int32
+		sleep  time.Duration
+		open   bool
+		sent   int32
+	}{
+		{"failure 1", http.StatusServiceUnavailable, 0, false, 1},
+		{"failure 2", http.StatusServiceUnavailable, 0, false, 2},
+		{"failure 3 opens", http.StatusServiceUnavailable, 0, false, 3},
+		{"open", http.StatusOK, 0, true, 3},
+		{"trial fails", http.StatusServiceUnavailable, 60 * time.Millisecond, false, 4},
+		{"open again", http.StatusOK, 0, true, 4},
+		{"trial recovers", http.StatusOK, 60 * time.Millisecond, false, 5},
+		{"closed", http.StatusOK, 0, false, 6},
+		// Rejected requests are not failures of the peer
+		{"not found", http.StatusNotFound, 0, false, 7},
+		{"not found again", http.StatusNotFound, 0, false, 8},
+		{"not found once more", http.StatusNotFound, 0, false, 9},
+		{"still closed", http.StatusOK, 0, false, 10},
+	}
+	for _, tc := range cases {
+		time.Sleep(tc.sleep)
+		atomic.StoreInt32(&status, tc.status)
+		err := get()
+		if open := errors.Is(err, ErrCircuitOpen); open != tc.open {
+			t.Fatalf("Get on %s, get %v, expect circuit open %v", tc.name, err, tc.open)
+		}
+		if tc.status == http.StatusOK && !tc.open && err != nil {
+			t.Fatalf("Fail to get on %s, %v", tc.name, err)
+		}
+		if n := atomic.LoadInt32(&cnt); n != tc.sent {
+			t.Fatalf("Get on %s, sent %d in all, expect %d", tc.name, n, tc.sent)
+		}
+	}
+
+	// Only a single trial once cooldown passes
+	for i := 0; i < 3; i++ {
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		get()
+	}
+	time.Sleep(60 * time.Millisecond)
+	peer := JoinAddr(u.IP, u.Port)
+	if err := breakers.allow(peer); err != nil {
+		t.Fatalf("Trial not allowed after cooldown, %v", err)
+	}
+	if err := breakers.allow(peer); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Second trial, get %v, expect circuit open", err)
+	}
+}
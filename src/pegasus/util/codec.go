@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+)
+
+const (
+	MIME_GOB      = "application/x-gob"
+	ENCODING_GZIP = "gzip"
+
+	// Payloads smaller than this are not worth compressing
+	GZIP_MIN_SIZE = 1024
+)
+
+var ErrUnsupportedMedia = errors.New("Unsupported media type")
+
+// Concrete types carried in interface{} fields, such as task spec and
+// output, must be registered before they could be sent as gob. Payloads
+// with unregistered types fall back to JSON.
+func RegisterPayloadTypes(values ...interface{}) {
+	for _, v := range values {
+		gob.Register(v)
+	}
+}
+
+func EncodePayload(data interface{}, mime string, compress bool) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var err error
+	switch mime {
+	case MIME_JSON:
+		err = json.NewEncoder(buf).Encode(data)
+	case MIME_GOB:
+		err = gob.NewEncoder(buf).Encode(data)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedMedia, mime)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return buf.Bytes(), nil
+	}
+	return gzipBytes(buf.Bytes())
+}
+
+func DecodePayload(buf []byte, mime string, compressed bool, v interface{}) error {
+	if compressed {
+		var err error
+		if buf, err = gunzip(buf); err != nil {
+			return err
+		}
+	}
+	switch mime {
+	case MIME_JSON:
+		return json.Unmarshal(buf, v)
+	case MIME_GOB:
+		return gob.NewDecoder(bytes.NewReader(buf)).Decode(v)
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedMedia, mime)
+	}
+}
+
+func gzipBytes(buf []byte) ([]byte, error) {
+	zbuf := bytes.NewBuffer(nil)
+	zw := gzip.NewWriter(zbuf)
+	if _, err := zw.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zbuf.Bytes(), nil
+}
+
+func gunzip(buf []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read gzip payload, %v", err)
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// Set data into v directly if it is already of v's type, as is the case
+// for payloads decoded from gob.
+func fitDirect(data interface{}, v interface{}) bool {
+	dv, pv := reflect.ValueOf(data), reflect.ValueOf(v)
+	if !dv.IsValid() || pv.Kind() != reflect.Ptr || pv.IsNil() {
+		return false
+	}
+	target := pv.Elem()
+	if dv.Type().AssignableTo(target.Type()) {
+		target.Set(dv)
+		return true
+	}
+	if dv.Kind() == reflect.Ptr && !dv.IsNil() &&
+		dv.Elem().Type().AssignableTo(target.Type()) {
+		target.Set(dv.Elem())
+		return true
+	}
+	return false
+}
@@ -2,17 +2,23 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"pegasus/auth"
 	"pegasus/log"
+	"strings"
 )
 
 const (
 	MIME_TEXT = "application/text"
 	MIME_JSON = "application/json"
+
+	MIME_EVENT_STREAM = "text/event-stream"
 )
 
 type HttpUrl struct {
@@ -20,53 +26,103 @@ type HttpUrl struct {
 	Port  int
 	Uri   string
 	Query url.Values
+	// Sent along and signed if it's one of auth's signed headers
+	Header http.Header
+}
+
+// Host of IPv6 in brackets, with the zone escaped.
+func (url *HttpUrl) Host() string {
+	return strings.Replace(JoinAddr(url.IP, url.Port), "%", "%25", 1)
 }
 
 func (url *HttpUrl) String() string {
 	if len(url.Query) > 0 {
 		query := url.Query.Encode()
-		return fmt.Sprintf("http://%s:%d%s?%s",
-			url.IP, url.Port, url.Uri, query)
+		return fmt.Sprintf("%s://%s%s?%s",
+			httpScheme, url.Host(), url.Uri, query)
 	} else {
-		return fmt.Sprintf("http://%s:%d%s",
-			url.IP, url.Port, url.Uri)
+		return fmt.Sprintf("%s://%s%s",
+			httpScheme, url.Host(), url.Uri)
 	}
 }
 
+type HttpStatusErr struct {
+	Code      int
+	Status    string
+	Body      string
+	ErrCode   string
+	RequestId string
+}
+
+func (e *HttpStatusErr) Error() string {
+	if e.RequestId != "" {
+		return fmt.Sprintf("Request %s failed, %s, %v", e.RequestId, e.Status, e.Body)
+	}
+	return fmt.Sprintf("Request failed, %s, %v", e.Status, e.Body)
+}
+
+// So that errors.Is(err, ErrNotFound) and alike work on the client side.
+func (e *HttpStatusErr) Unwrap() error {
+	return getCodeErr(e.ErrCode)
+}
+
+func IsHttpStatus(err error, code int) bool {
+	var serr *HttpStatusErr
+	return errors.As(err, &serr) && serr.Code == code
+}
+
 func readResp(resp *http.Response) (string, error) {
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
-	s := string(body)
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Request failed, %s, %v", resp.Status, s)
-	} else {
-		return s, nil
-	}
+	return parseResp(resp, body)
 }
 
-func HttpGet(url *HttpUrl) (string, error) {
-	c := new(http.Client)
-	resp, err := c.Get(url.String())
+func newRequest(ctx context.Context, method string, url *HttpUrl,
+	mime, encoding, rid string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return readResp(resp)
+	for name, values := range url.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set(REQUEST_ID_HEADER, rid)
+	if mime != "" {
+		req.Header.Set("Content-Type", mime)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if err := auth.SignRequest(req, body); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func doRequest(method string, url *HttpUrl, mime, encoding string, body []byte) (string, error) {
+	return doRequestContext(context.Background(), method, url, mime, encoding, body)
+}
+
+func HttpGet(url *HttpUrl) (string, error) {
+	return HttpGetContext(context.Background(), url)
+}
+
+func HttpGetContext(ctx context.Context, url *HttpUrl) (string, error) {
+	return doRequestContext(ctx, http.MethodGet, url, "", "", nil)
 }
 
 func HttpPostStr(url *HttpUrl, s string) (string, error) {
-	buf := bytes.NewBuffer([]byte(s))
-	c := new(http.Client)
-	resp, err := c.Post(url.String(), MIME_TEXT, buf)
-	if err != nil {
-		return "", err
-	}
-	return readResp(resp)
+	return doRequest(http.MethodPost, url, MIME_TEXT, "", []byte(s))
 }
 
 func HttpPostData(url *HttpUrl, data interface{}) (string, error) {
+	return HttpPostDataContext(context.Background(), url, data)
+}
+
+func HttpPostDataContext(ctx context.Context, url *HttpUrl, data interface{}) (string, error) {
 	buf := bytes.NewBuffer(nil)
 	enc := json.NewEncoder(buf)
 	enc.SetIndent("", "  ")
@@ -74,26 +130,106 @@ func HttpPostData(url *HttpUrl, data interface{}) (string, error) {
 		log.Error("Fail to post data during marshal, %v", err)
 		return "", err
 	}
-	c := new(http.Client)
-	resp, err := c.Post(url.String(), MIME_JSON, buf)
+	return doRequestContext(ctx, http.MethodPost, url, MIME_JSON, "", buf.Bytes())
+}
+
+func HttpDelete(url *HttpUrl) (string, error) {
+	return HttpDeleteContext(context.Background(), url)
+}
+
+func HttpDeleteContext(ctx context.Context, url *HttpUrl) (string, error) {
+	return doRequestContext(ctx, http.MethodDelete, url, "", "", nil)
+}
+
+// Post data as gob if possible, compressed when large. Fall back to JSON
+// if data has types not registered for gob, or the peer refuses the body
+// with 415, sent plain as the peer may take no gzip either. Only 415 is
+// taken as refused, as it comes before the body is handled, other errors
+// may come after side effects that must not run twice.
+func HttpPostPayload(url *HttpUrl, data interface{}) (string, error) {
+	buf, err := EncodePayload(data, MIME_GOB, false)
 	if err != nil {
+		log.Debug("Fail to encode payload as gob, use JSON instead, %v", err)
+		return httpPostPayloadAs(url, data, MIME_JSON)
+	}
+	s, err := httpPostEncoded(url, MIME_GOB, buf)
+	if IsHttpStatus(err, http.StatusUnsupportedMediaType) {
+		log.Info("Gob not accepted by %s, retry with plain JSON, %v", url.String(), err)
+		buf, err := EncodePayload(data, MIME_JSON, false)
+		if err != nil {
+			log.Error("Fail to encode payload as JSON, %v", err)
+			return "", err
+		}
+		return doRequest(http.MethodPost, url, MIME_JSON, "", buf)
+	}
+	return s, err
+}
+
+func httpPostPayloadAs(url *HttpUrl, data interface{}, mime string) (string, error) {
+	buf, err := EncodePayload(data, mime, false)
+	if err != nil {
+		log.Error("Fail to encode payload as %s, %v", mime, err)
 		return "", err
 	}
-	return readResp(resp)
+	return httpPostEncoded(url, mime, buf)
 }
 
-func HttpReadRequestJsonBody(r *http.Request) ([]byte, error) {
-	contentType := r.Header.Get("Content-Type")
-	if contentType != MIME_JSON {
-		err := fmt.Errorf("Expect MIME JSON, get %v", contentType)
-		return nil, err
+func httpPostEncoded(url *HttpUrl, mime string, buf []byte) (string, error) {
+	if len(buf) < GZIP_MIN_SIZE {
+		return doRequest(http.MethodPost, url, mime, "", buf)
+	}
+	zbuf, err := gzipBytes(buf)
+	if err != nil {
+		return "", err
+	}
+	return doRequest(http.MethodPost, url, mime, ENCODING_GZIP, zbuf)
+}
+
+// Read request body in any supported format, decompressed if needed.
+// The decompressed body is put back for later reads.
+func HttpReadRequestBody(r *http.Request) ([]byte, string, error) {
+	mime := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	switch mime {
+	case MIME_JSON, MIME_GOB:
+	default:
+		return nil, "", fmt.Errorf("%w %q", ErrUnsupportedMedia, mime)
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "":
+	case ENCODING_GZIP:
+		if body, err = gunzip(body); err != nil {
+			return nil, "", err
+		}
+		r.Header.Del("Content-Encoding")
+	default:
+		return nil, "", fmt.Errorf("%w, encoding %q", ErrUnsupportedMedia, encoding)
 	}
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	return body, nil
+	return body, mime, nil
+}
+
+// Read request body as raw JSON, which could be posted as gob of the
+// JSON bytes as well, such as json.RawMessage by HttpPostPayload.
+func HttpReadRequestJsonBody(r *http.Request) ([]byte, error) {
+	body, mime, err := HttpReadRequestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if mime == MIME_JSON {
+		return body, nil
+	}
+	var raw json.RawMessage
+	if err := DecodePayload(body, mime, false, &raw); err != nil {
+		return nil, fmt.Errorf("%w, expect JSON in gob, %v", ErrUnsupportedMedia, err)
+	}
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("%w, invalid JSON in gob", ErrInvalidSpec)
+	}
+	return raw, nil
 }
 
 func HttpReadRequestTextBody(r *http.Request) (string, error) {
@@ -111,14 +247,11 @@ func HttpReadRequestTextBody(r *http.Request) (string, error) {
 }
 
 func HttpFitRequestInto(r *http.Request, v interface{}) error {
-	buf, err := HttpReadRequestJsonBody(r)
+	buf, mime, err := HttpReadRequestBody(r)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(buf, v); err != nil {
-		return err
-	}
-	return nil
+	return DecodePayload(buf, mime, false, v)
 }
 
 func GetRequestAddr(r *http.Request) string {
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type payloadTest struct {
+	Name string
+	Cnt  int
+}
+
+func makeTestUrl(t *testing.T, s *httptest.Server, uri string) *HttpUrl {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("Fail to parse %s, %v", s.URL, err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return &HttpUrl{IP: u.Hostname(), Port: port, Uri: uri}
+}
+
+// Gob refused with 415 is posted again as plain JSON, with other errors
+// the body could have been handled already and is posted once only.
+func TestHttpPostPayloadFallback(t *testing.T) {
+	cases := []struct {
+		status int
+		mimes  []string
+		ok     bool
+	}{
+		{http.StatusUnsupportedMediaType, []string{MIME_GOB, MIME_JSON}, true},
+		{http.StatusBadRequest, []string{MIME_GOB}, false},
+		{http.StatusInternalServerError, []string{MIME_GOB}, false},
+	}
+	for _, tc := range cases {
+		var mimes []string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mime := r.Header.Get("Content-Type")
+			mimes = append(mimes, mime)
+			body, _ := ioutil.ReadAll(r.Body)
+			p := new(payloadTest)
+			if mime != MIME_JSON || r.Header.Get("Content-Encoding") != "" ||
+				json.Unmarshal(body, p) != nil {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, "Expect MIME JSON, get "+mime)
+				return
+			}
+			io.WriteString(w, p.Name)
+		}))
+		resp, err := HttpPostPayload(makeTestUrl(t, s, "/report"), &payloadTest{"tsk-0", 3})
+		s.Close()
+		if tc.ok && (err != nil || resp != "tsk-0") {
+			t.Fatalf("Post payload refused with %d, get %q %v, expect %q", tc.status, resp, err, "tsk-0")
+		}
+		if !tc.ok && !IsHttpStatus(err, tc.status) {
+			t.Fatalf("Post payload refused with %d, get %v, expect the status", tc.status, err)
+		}
+		if !reflect.DeepEqual(mimes, tc.mimes) {
+			t.Fatalf("Post payload refused with %d as %v, expect %v", tc.status, mimes, tc.mimes)
+		}
+	}
+}
+
+func TestHttpReadRequestJsonBody(t *testing.T) {
+	raw := json.RawMessage(`{"Name": "tsk-0", "Cnt": 3}`)
+	gobRaw, _ := EncodePayload(raw, MIME_GOB, false)
+	gobStr, _ := EncodePayload(string(raw), MIME_GOB, false)
+	gobBad, _ := EncodePayload(json.RawMessage(`{"Name"`), MIME_GOB, false)
+	zRaw, _ := gzipBytes(gobRaw)
+	cases := []struct {
+		name     string
+		mime     string
+		encoding string
+		body     []byte
+		err      error
+	}{
+		{"json", MIME_JSON, "", raw, nil},
+		{"gob", MIME_GOB, "", gobRaw, nil},
+		{"gzip gob", MIME_GOB, ENCODING_GZIP, zRaw, nil},
+		{"gob of string", MIME_GOB, "", gobStr, ErrUnsupportedMedia},
+		{"gob of bad json", MIME_GOB, "", gobBad, ErrInvalidSpec},
+		{"text", MIME_TEXT, "", raw, ErrUnsupportedMedia},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.body))
+		r.Header.Set("Content-Type", tc.mime)
+		if tc.encoding != "" {
+			r.Header.Set("Content-Encoding", tc.encoding)
+		}
+		body, err := HttpReadRequestJsonBody(r)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Read %s body, get %v, expect %v", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || string(body) != string(raw) {
+			t.Fatalf("Read %s body, get %s %v, expect %s", tc.name, body, err, raw)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"pegasus/log"
+	"strings"
+)
+
+// Bump on incompatible changes to RespEnvelope.
+const RESP_VERSION = 1
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+const (
+	ERR_CODE_BAD_REQUEST       = "bad_request"
+	ERR_CODE_NOT_FOUND         = "not_found"
+	ERR_CODE_BUSY              = "busy"
+	ERR_CODE_CONFLICT          = "conflict"
+	ERR_CODE_UNAUTHORIZED      = "unauthorized"
+	ERR_CODE_INVALID_SPEC      = "invalid_spec"
+	ERR_CODE_UNSUPPORTED_MEDIA = "unsupported_media"
+	ERR_CODE_INTERNAL          = "internal"
+)
+
+// Wrap these with %w in handler errors to pick the error code and status,
+// errors wrapping none of them are taken as bad request.
+var (
+	ErrNotFound     = errors.New("Not found")
+	ErrBusy         = errors.New("Busy")
+	ErrConflict     = errors.New("Conflict")
+	ErrUnauthorized = errors.New("Unauthorized")
+	ErrInvalidSpec  = errors.New("Invalid spec")
+	ErrInternal     = errors.New("Internal error")
+)
+
+type errCode struct {
+	err    error
+	code   string
+	status int
+}
+
+var errCodes = []errCode{
+	{ErrNotFound, ERR_CODE_NOT_FOUND, http.StatusNotFound},
+	{ErrBusy, ERR_CODE_BUSY, http.StatusTooManyRequests},
+	{ErrConflict, ERR_CODE_CONFLICT, http.StatusConflict},
+	{ErrUnauthorized, ERR_CODE_UNAUTHORIZED, http.StatusUnauthorized},
+	{ErrInvalidSpec, ERR_CODE_INVALID_SPEC, http.StatusUnprocessableEntity},
+	{ErrUnsupportedMedia, ERR_CODE_UNSUPPORTED_MEDIA, http.StatusUnsupportedMediaType},
+	{ErrInternal, ERR_CODE_INTERNAL, http.StatusInternalServerError},
+}
+
+type RespError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type RespEnvelope struct {
+	V         int             `json:"v"`
+	Rc        bool            `json:"rc"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	Error     *RespError      `json:"error,omitempty"`
+	RequestId string          `json:"request_id,omitempty"`
+}
+
+func NewRequestId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		log.Error("Fail to generate request id, %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func GetErrCode(err error) (code string, status int) {
+	for _, c := range errCodes {
+		if errors.Is(err, c.err) {
+			return c.code, c.status
+		}
+	}
+	return ERR_CODE_BAD_REQUEST, http.StatusBadRequest
+}
+
+func getCodeErr(code string) error {
+	for _, c := range errCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+func marshalContent(data interface{}) (json.RawMessage, error) {
+	if data == nil {
+		return nil, nil
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(buf), nil
+}
+
+// Request id is set on the response header by the server beforehand.
+func WriteResp(w http.ResponseWriter, err error, data interface{}) {
+	env := &RespEnvelope{
+		V:         RESP_VERSION,
+		RequestId: w.Header().Get(REQUEST_ID_HEADER),
+	}
+	status := http.StatusOK
+	if err == nil {
+		content, merr := marshalContent(data)
+		if merr != nil {
+			log.Error("Fail on json marshal, %v", merr)
+			err = fmt.Errorf("%w, fail to marshal resp, %v", ErrInternal, merr)
+		} else {
+			env.Rc = true
+			env.Content = content
+		}
+	}
+	if err != nil {
+		var code string
+		code, status = GetErrCode(err)
+		env.Error = &RespError{Code: code, Message: err.Error()}
+	}
+	buf, merr := json.MarshalIndent(env, "", "  ")
+	if merr != nil {
+		log.Error("Fail to marshal resp envelope, %v", merr)
+		http.Error(w, merr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", MIME_JSON+"; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf); err != nil {
+		log.Error("Fail to write resp data, %v", err)
+	}
+}
+
+// Content of string is returned as is, other content as JSON.
+func parseResp(resp *http.Response, body []byte) (string, error) {
+	ctype := resp.Header.Get("Content-Type")
+	env := new(RespEnvelope)
+	if !strings.HasPrefix(ctype, MIME_JSON) || json.Unmarshal(body, env) != nil ||
+		env.V == 0 {
+		// Not from a pegasus server, or a plain error from net/http
+		if resp.StatusCode != http.StatusOK {
+			return "", &HttpStatusErr{
+				Code:   resp.StatusCode,
+				Status: resp.Status,
+				Body:   string(body),
+			}
+		}
+		return string(body), nil
+	}
+	if env.V > RESP_VERSION {
+		log.Debug("Resp version %d newer than %d", env.V, RESP_VERSION)
+	}
+	if !env.Rc || resp.StatusCode != http.StatusOK {
+		serr := &HttpStatusErr{
+			Code:      resp.StatusCode,
+			Status:    resp.Status,
+			RequestId: env.RequestId,
+		}
+		if env.Error != nil {
+			serr.ErrCode = env.Error.Code
+			serr.Body = env.Error.Message
+		}
+		return "", serr
+	}
+	if len(env.Content) == 0 {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(env.Content, &s); err == nil {
+		return s, nil
+	}
+	return string(env.Content), nil
+}
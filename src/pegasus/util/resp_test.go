@@ -0,0 +1,134 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Write resp as a pegasus server does and parse it back as the client.
+func roundTripResp(t *testing.T, err error, data interface{}) (*http.Response, string, error) {
+	w := httptest.NewRecorder()
+	w.Header().Set(REQUEST_ID_HEADER, "req-1")
+	WriteResp(w, err, data)
+	resp := w.Result()
+	body, rerr := ioutil.ReadAll(resp.Body)
+	if rerr != nil {
+		t.Fatalf("Fail to read resp body, %v", rerr)
+	}
+	content, perr := parseResp(resp, body)
+	return resp, content, perr
+}
+
+func TestRespSuccess(t *testing.T) {
+	cases := []struct {
+		data    interface{}
+		content string
+	}{
+		{nil, ""},
+		{"plain", "plain"},
+		{&payloadTest{Name: "a", Cnt: 1}, `{"Name":"a","Cnt":1}`},
+		{[]int{1, 2}, "[1,2]"},
+	}
+	for _, c := range cases {
+		resp, content, err := roundTripResp(t, nil, c.data)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Round trip %v, get status %d %v", c.data, resp.StatusCode, err)
+		}
+		// Content is indented along with the envelope
+		buf := new(bytes.Buffer)
+		if json.Compact(buf, []byte(content)) == nil {
+			content = buf.String()
+		}
+		if content != c.content {
+			t.Fatalf("Round trip %v, get content %q, expect %q", c.data, content, c.content)
+		}
+	}
+}
+
+func TestRespError(t *testing.T) {
+	cases := []struct {
+		err    error
+		code   string
+		status int
+	}{
+		{ErrNotFound, ERR_CODE_NOT_FOUND, http.StatusNotFound},
+		{ErrBusy, ERR_CODE_BUSY, http.StatusTooManyRequests},
+		{ErrConflict, ERR_CODE_CONFLICT, http.StatusConflict},
+		{ErrUnauthorized, ERR_CODE_UNAUTHORIZED, http.StatusUnauthorized},
+		{ErrInvalidSpec, ERR_CODE_INVALID_SPEC, http.StatusUnprocessableEntity},
+		{ErrUnsupportedMedia, ERR_CODE_UNSUPPORTED_MEDIA, http.StatusUnsupportedMediaType},
+		{ErrInternal, ERR_CODE_INTERNAL, http.StatusInternalServerError},
+		{nil, ERR_CODE_BAD_REQUEST, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		err := fmt.Errorf("%w, task %q", c.err, "t-0")
+		if c.err == nil {
+			err = errors.New("Something wrong")
+		}
+		resp, content, perr := roundTripResp(t, err, "ignored")
+		if resp.StatusCode != c.status || content != "" {
+			t.Fatalf("Round trip %v, get status %d content %q, expect %d", err, resp.StatusCode,
+				content, c.status)
+		}
+		var serr *HttpStatusErr
+		if !errors.As(perr, &serr) {
+			t.Fatalf("Round trip %v, get %v, expect status error", err, perr)
+		}
+		if serr.Code != c.status || serr.ErrCode != c.code || serr.Body != err.Error() ||
+			serr.RequestId != "req-1" {
+			t.Fatalf("Round trip %v, get %+v, expect code %s", err, serr, c.code)
+		}
+		if c.err != nil && !errors.Is(perr, c.err) {
+			t.Fatalf("Round trip %v, get %v, expect to be %v", err, perr, c.err)
+		}
+		if c.err == nil && errors.Unwrap(perr) != nil {
+			t.Fatalf("Round trip %v, get %v wrapping %v, expect none", err, perr, errors.Unwrap(perr))
+		}
+	}
+
+	// Content failing to marshal turns into internal error
+	_, _, err := roundTripResp(t, nil, make(chan int))
+	if !errors.Is(err, ErrInternal) {
+		t.Fatalf("Round trip content failing to marshal, get %v, expect internal", err)
+	}
+}
+
+// Resp not in the envelope, as from net/http or other servers.
+func TestParseRespPlain(t *testing.T) {
+	cases := []struct {
+		ctype  string
+		status int
+		body   string
+		ok     bool
+	}{
+		{"text/plain; charset=utf-8", http.StatusOK, "pong", true},
+		{"text/plain; charset=utf-8", http.StatusNotFound, "404 page not found\n", false},
+		{MIME_JSON, http.StatusOK, `{"Name":"a"}`, true},
+		{MIME_JSON, http.StatusBadGateway, `{"v":0}`, false},
+	}
+	for _, c := range cases {
+		resp := &http.Response{
+			StatusCode: c.status,
+			Status:     fmt.Sprintf("%d %s", c.status, http.StatusText(c.status)),
+			Header:     http.Header{"Content-Type": {c.ctype}},
+		}
+		content, err := parseResp(resp, []byte(c.body))
+		if c.ok {
+			if err != nil || content != c.body {
+				t.Fatalf("Parse %d %q, get %q %v, expect body as is", c.status, c.body, content, err)
+			}
+			continue
+		}
+		var serr *HttpStatusErr
+		if !errors.As(err, &serr) || serr.Code != c.status || serr.Body != c.body ||
+			serr.ErrCode != "" || errors.Unwrap(err) != nil {
+			t.Fatalf("Parse %d %q, get %v, expect plain status error", c.status, c.body, err)
+		}
+	}
+}
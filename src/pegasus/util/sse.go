@@ -0,0 +1,90 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Lines carrying job snapshots could be long
+const SSE_MAX_LINE = 16 * 1024 * 1024
+
+type SseEvent struct {
+	Id   string
+	Type string
+	Data string
+}
+
+// Read server-sent events from url and pass them to handle, until ctx is
+// done, the stream breaks or handle returns an error. Events after lastId
+// are replayed if the server still has them.
+func HttpGetEvents(ctx context.Context, url *HttpUrl, lastId string,
+	handle func(*SseEvent) error) error {
+	peer := JoinAddr(url.IP, url.Port)
+	if err := breakers.allow(peer); err != nil {
+		return err
+	}
+	req, err := newRequest(ctx, http.MethodGet, url, "", "", NewRequestId(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", MIME_EVENT_STREAM)
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	resp, err := httpClient.Do(req)
+	breakers.report(peer, err == nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, err := readResp(resp)
+		return err
+	}
+	defer resp.Body.Close()
+	if err := readEvents(resp.Body, handle); err != nil {
+		return err
+	}
+	return fmt.Errorf("Event stream from %s closed", peer)
+}
+
+// Pass events in r to handle until EOF. Data of multiple lines are joined
+// by "\n", comment lines are skipped.
+func readEvents(r io.Reader, handle func(*SseEvent) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), SSE_MAX_LINE)
+	evt := new(SseEvent)
+	data := make([]string, 0)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 || evt.Type != "" {
+				evt.Data = strings.Join(data, "\n")
+				if err := handle(evt); err != nil {
+					return err
+				}
+			}
+			evt, data = new(SseEvent), data[:0]
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			evt.Id = value
+		case "event":
+			evt.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
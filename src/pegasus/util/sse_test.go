@@ -0,0 +1,61 @@
+package util
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": ping",
+		"",
+		"id: 1",
+		"event: proj_started",
+		`data: {"Seq":1}`,
+		"",
+		"id: 2",
+		"event: task_failed",
+		"data: line one",
+		"data:line two",
+		"data: ",
+		"",
+		": ping",
+		"",
+		"id: 3",
+		"event: reset",
+		"",
+		"id: 4",
+		"data: no trailing blank line",
+	}, "\n")
+	expect := []*SseEvent{
+		{"1", "proj_started", `{"Seq":1}`},
+		{"2", "task_failed", "line one\nline two\n"},
+		{"3", "reset", ""},
+	}
+	got := make([]*SseEvent, 0)
+	err := readEvents(strings.NewReader(stream), func(evt *SseEvent) error {
+		got = append(got, evt)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Fail to read events, %v", err)
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("Get %d events, expect %d", len(got), len(expect))
+	}
+	for i := range expect {
+		if *got[i] != *expect[i] {
+			t.Fatalf("Event %d, get %+v, expect %+v", i, *got[i], *expect[i])
+		}
+	}
+	stop := errors.New("stop")
+	cnt := 0
+	err = readEvents(strings.NewReader(stream), func(evt *SseEvent) error {
+		cnt++
+		return stop
+	})
+	if err != stop || cnt != 1 {
+		t.Fatalf("Stop by handle, get %v after %d events", err, cnt)
+	}
+}
@@ -2,8 +2,10 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -25,14 +27,15 @@ func Min(a, b int) int {
 	}
 }
 
+// Split host and port of addr, IPv6 hosts are given in brackets, such as
+// [::1]:80, and returned without.
 func SplitAddr(addr string) (ip string, port int, err error) {
-	toks := strings.Split(addr, ":")
-	if len(toks) != 2 {
-		err = fmt.Errorf("Fail to split %q, get %v", addr, toks)
+	ip, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		err = fmt.Errorf("Fail to split %q, %v", addr, err)
 		return
 	}
-	ip = toks[0]
-	port64, err := strconv.ParseInt(toks[1], 10, 32)
+	port64, err := strconv.ParseUint(sport, 10, 16)
 	if err != nil {
 		err = fmt.Errorf("Fail to parse port from %q, %v", addr, err)
 		return
@@ -41,13 +44,49 @@ func SplitAddr(addr string) (ip string, port int, err error) {
 	return
 }
 
+// Join host and port as addr, IPv6 hosts in brackets.
+func JoinAddr(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// Host given by IP, IPv6 in brackets or not, or DNS name, returned without
+// brackets.
+func ParseHost(host string) (string, error) {
+	h := host
+	if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		h = h[1 : len(h)-1]
+	}
+	if h == "" {
+		return "", fmt.Errorf("Empty host")
+	}
+	if strings.Contains(h, ":") {
+		ip := h
+		if i := strings.LastIndex(ip, "%"); i >= 0 {
+			ip = ip[:i]
+		}
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("Invalid host %q", host)
+		}
+	} else if h != host || strings.ContainsAny(h, "/[]% ") {
+		return "", fmt.Errorf("Invalid host %q", host)
+	}
+	return h, nil
+}
+
 func PeriodicalRoutine(skipFirst bool,
 	interval time.Duration, routine func(interface{}), args interface{}) {
+	PeriodicalRoutineFunc(skipFirst, func() time.Duration { return interval },
+		routine, args)
+}
+
+// Interval is taken before each run, so that it could change on the fly.
+func PeriodicalRoutineFunc(skipFirst bool,
+	interval func() time.Duration, routine func(interface{}), args interface{}) {
 	if skipFirst {
-		time.Sleep(interval)
+		time.Sleep(interval())
 	}
 	for {
-		t1 := time.Now().Add(interval)
+		t1 := time.Now().Add(interval())
 		routine(args)
 		t2 := time.Now()
 		if t2.Before(t1) {
@@ -56,6 +95,17 @@ func PeriodicalRoutine(skipFirst bool,
 	}
 }
 
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type PrettyTable struct {
 	header      []string
 	lines       [][]string
@@ -118,7 +168,24 @@ func (t *PrettyTable) formatLine(buf *bytes.Buffer, line []string) {
 	buf.WriteByte('\n')
 }
 
+// Like FitDataInto, but fail on fields not found in v.
+func FitDataIntoStrict(data interface{}, v interface{}) error {
+	if fitDirect(data, v) {
+		return nil
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
 func FitDataInto(data interface{}, v interface{}) error {
+	if fitDirect(data, v) {
+		return nil
+	}
 	buf, err := json.Marshal(data)
 	if err != nil {
 		return err
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestSplitAddr(t *testing.T) {
+	cases := []struct {
+		addr string
+		ip   string
+		port int
+	}{
+		{"127.0.0.1:8080", "127.0.0.1", 8080},
+		{"[::1]:8080", "::1", 8080},
+		{"[fe80::1%eth0]:8080", "fe80::1%eth0", 8080},
+		{"master.pegasus.svc:10086", "master.pegasus.svc", 10086},
+		{":8080", "", 8080},
+	}
+	for _, c := range cases {
+		ip, port, err := SplitAddr(c.addr)
+		if err != nil {
+			t.Fatalf("Fail to split %q, %v", c.addr, err)
+		}
+		if ip != c.ip || port != c.port {
+			t.Fatalf("Split %q into %q %d, expect %q %d", c.addr, ip, port, c.ip, c.port)
+		}
+		if addr := JoinAddr(ip, port); addr != c.addr {
+			t.Fatalf("Join %q %d into %q, expect %q", ip, port, addr, c.addr)
+		}
+	}
+	for _, addr := range []string{"::1:8080", "127.0.0.1", "127.0.0.1:http", "[::1]:70000"} {
+		if ip, port, err := SplitAddr(addr); err == nil {
+			t.Fatalf("Split %q into %q %d, expect error", addr, ip, port)
+		}
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.1":         "10.0.0.1",
+		"::1":              "::1",
+		"[::1]":            "::1",
+		"[fe80::1%eth0]":   "fe80::1%eth0",
+		"worker-0.pegasus": "worker-0.pegasus",
+	}
+	for host, expect := range cases {
+		h, err := ParseHost(host)
+		if err != nil {
+			t.Fatalf("Fail to parse %q, %v", host, err)
+		}
+		if h != expect {
+			t.Fatalf("Parse %q into %q, expect %q", host, h, expect)
+		}
+	}
+	for _, host := range []string{"", "[]", "10.0.0.1:80", "::1::2", "[worker]", "a/b"} {
+		if h, err := ParseHost(host); err == nil {
+			t.Fatalf("Parse %q into %q, expect error", host, h)
+		}
+	}
+}
+
+func TestHttpUrlString(t *testing.T) {
+	cases := []struct {
+		ip     string
+		expect string
+	}{
+		{"127.0.0.1", "http://127.0.0.1:8080/ping"},
+		{"::1", "http://[::1]:8080/ping"},
+		{"fe80::1%eth0", "http://[fe80::1%25eth0]:8080/ping"},
+		{"localhost", "http://localhost:8080/ping"},
+	}
+	for _, c := range cases {
+		u := &HttpUrl{IP: c.ip, Port: 8080, Uri: "/ping"}
+		if s := u.String(); s != c.expect {
+			t.Fatalf("Get url %q, expect %q", s, c.expect)
+		}
+	}
+}
@@ -1 +1,45 @@
 package main
+
+import (
+	"pegasus/cfgmgr"
+	"pegasus/log"
+	"pegasus/task"
+	"pegasus/workgroup"
+	"sync/atomic"
+)
+
+// Copy of workgroup.WCfg, replaced as a whole on change so that readers
+// never see a partial update.
+var workerCfg atomic.Value
+
+// Compiled default until pulled from cfg server.
+func getWorkerCfg() *workgroup.WorkerCfg {
+	if wc, ok := workerCfg.Load().(*workgroup.WorkerCfg); ok {
+		return wc
+	}
+	return workgroup.WCfgDef
+}
+
+func initWorkerCfg(cfgserver string) error {
+	if err := cfgmgr.RegisterLayeredCfg(workgroup.WCfg, workgroup.WCfgDef); err != nil {
+		return err
+	}
+	if err := cfgmgr.PullCfg(cfgserver, workgroup.WCfg); err != nil {
+		return err
+	}
+	wc := *workgroup.WCfg
+	workerCfg.Store(&wc)
+	log.Info("Worker cfg %+v", wc)
+	cfgmgr.Subscribe(workgroup.WCfg, func(cOld, cNew interface{}) {
+		workerCfg.Store(cNew.(*workgroup.WorkerCfg))
+	})
+	return nil
+}
+
+func getTaskletRetryPolicy() *task.RetryPolicy {
+	return &task.RetryPolicy{
+		MaxAttempts: getWorkerCfg().TaskletMaxRetry,
+		Backoff:     task.TASKLET_RETRY_BACKOFF,
+		MaxBackoff:  task.TASKLET_RETRY_MAX_BACKOFF,
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"net/url"
+	"pegasus/cfgmgr"
 	"pegasus/log"
 	"pegasus/uri"
 	"pegasus/util"
+	"strconv"
 	"time"
 )
 
@@ -19,14 +21,34 @@ func getHbInterval() (interval time.Duration, err error) {
 	return
 }
 
+type hbArgs struct {
+	interval time.Duration
+}
+
+// A heartbeat not delivered within the interval is stale, give up on it
+// instead of hanging on a slow master. The interval is updated from the
+// response, masters of older version respond with nothing.
 func hbMain(args interface{}) {
 	log.Debug("Post heartbeat...")
-	u := args.(*util.HttpUrl)
+	hb := args.(*hbArgs)
+	// Taken each time, as master could fail over
+	u := workerSelf.makeMasterUrl(uri.MasterWorkerHbUri)
+	// Let master know which cfg revision is in use
+	u.Query.Set(uri.MasterCfgRevKey, strconv.FormatUint(cfgmgr.GetAppliedRevision(), 10))
 	ts := time.Now()
-	if _, err := util.HttpPostData(u, ts); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), hb.interval)
+	defer cancel()
+	s, err := util.HttpPostDataContext(ctx, u, ts)
+	if err != nil {
 		log.Error("Fail to post heartbeat, %v", err)
-	} else {
-		log.Debug("Post heartbeat successfully")
+		return
+	}
+	log.Debug("Post heartbeat successfully")
+	var interval time.Duration
+	if json.Unmarshal([]byte(s), &interval) == nil && interval > 0 &&
+		interval != hb.interval {
+		log.Info("Heartbeat interval changed from %v to %v", hb.interval, interval)
+		hb.interval = interval
 	}
 }
 
@@ -36,13 +58,9 @@ func startHb() error {
 		log.Error("Fail to get heartbeat interval, %v", err)
 		return err
 	}
-	u := &util.HttpUrl{
-		IP:   workerSelf.masterIp,
-		Port: workerSelf.masterPort,
-		Uri:  uri.MasterWorkerHbUri,
-	}
-	u.Query = make(url.Values)
-	u.Query.Add(uri.MasterWorkerQueryKey, workerSelf.Key)
-	go util.PeriodicalRoutine(false, interval, hbMain, u)
+	hb := &hbArgs{interval}
+	// Read by the same routine that runs hbMain
+	go util.PeriodicalRoutineFunc(false, func() time.Duration { return hb.interval },
+		hbMain, hb)
 	return nil
 }
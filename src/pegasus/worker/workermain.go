@@ -5,83 +5,253 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"pegasus/auth"
 	"pegasus/cfgmgr"
+	"pegasus/db"
 	"pegasus/log"
+	"pegasus/pki"
 	"pegasus/rate"
 	"pegasus/route"
 	"pegasus/server"
+	"pegasus/taskreg"
 	"pegasus/uri"
 	"pegasus/util"
 	"pegasus/workgroup"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var cfgServerIP = "127.0.0.1"
+// From bootstrap cfg
+var cfgServerIP string
+
+// Registration on cfg server, closed on shutdown
+var serviceLease *cfgmgr.ServiceLease
+
+const (
+	MASTER_REGISTER_RETRY   = 3
+	MASTER_REGISTER_BACKOFF = 2 * time.Second
+)
 
 type Worker struct {
 	Name         string
 	IP           string
 	ListenPort   int
-	Key          string
 	workerServer *server.Server
 	workerAddr   string
-	masterIp     string
-	masterPort   int
+	// Following fields under mutex protection, changed as master fails over
+	mutex      sync.Mutex
+	Key        string
+	masterIp   string
+	masterPort int
+	// Leader token of the master followed, requests with another are refused
+	masterToken uint64
+	// Token of the master being registered on, which may dispatch as soon
+	// as it verifies us, before the registration returns
+	pendingToken uint64
 }
 
 func (w *Worker) makeMasterUrl(uriQuery string) *util.HttpUrl {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	u := &util.HttpUrl{
-		IP:    workerSelf.masterIp,
-		Port:  workerSelf.masterPort,
-		Uri:   uriQuery,
-		Query: make(url.Values),
+		IP:     w.masterIp,
+		Port:   w.masterPort,
+		Uri:    uriQuery,
+		Query:  make(url.Values),
+		Header: make(http.Header),
 	}
-	u.Query.Add(uri.MasterWorkerQueryKey, w.Key)
+	u.Header.Set(auth.HEADER_WORKER_KEY, w.Key)
 	return u
 }
 
+// Follow the master only once registered on it with the key given.
+func (w *Worker) setMaster(ip string, port int, token uint64, key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.masterIp, w.masterPort, w.masterToken = ip, port, token
+	w.Key, w.pendingToken = key, 0
+}
+
+func (w *Worker) setPendingToken(token uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pendingToken = token
+}
+
+// Whether requests of the master with token are accepted.
+func (w *Worker) checkToken(token uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if token != w.masterToken && (w.pendingToken == 0 || token != w.pendingToken) {
+		return fmt.Errorf("%w, master token %d fenced by %d", util.ErrConflict, token, w.masterToken)
+	}
+	return nil
+}
+
+func (w *Worker) getMasterAddr() (string, int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.masterIp, w.masterPort
+}
+
+func (w *Worker) getMasterToken() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.masterToken
+}
+
 var workerSelf = new(Worker)
 
-func waitForMasterReady() {
+// Wait for the master with the latest leader token, a former master
+// registered again after cfg server restarts may be listed with it.
+func waitForMasterReady() *cfgmgr.ServiceInstance {
 	log.Info("Wait for master ready")
-	var ip string
-	var port int
-	url := &util.HttpUrl{
-		IP:   cfgServerIP,
-		Port: cfgmgr.CfgServerPort,
-		Uri:  uri.CfgMasterUri,
-	}
 	sleepTime := 5 * time.Second
 	for {
-		addr, err := util.HttpGet(url)
-		if err == nil && addr != "" {
-			ip, port, err = util.SplitAddr(addr)
-			if err != nil {
-				log.Error("Fail to split master addr %q, %v", addr, err)
-			} else {
-				break
-			}
-		} else if err != nil {
-			log.Error("Fail to get master addr, %v", err)
-		} else {
+		insts, err := cfgmgr.ListServices(cfgServerIP, cfgmgr.SERVICE_ROLE_MASTER)
+		if err != nil {
+			log.Error("Fail to list masters, %v", err)
+		} else if inst := latestMaster(insts); inst == nil {
 			log.Info("Master not ready")
-		}
-		ip, port, err = util.SplitAddr(addr)
-		if err == nil {
-			break
 		} else {
-			log.Error("Fail to split addr %q, err %v", addr, err)
+			log.Info("Get master addr as %s, token %d", inst.Addr, inst.LeaderToken())
+			return inst
 		}
 		time.Sleep(sleepTime)
 	}
-	workerSelf.masterIp = ip
-	workerSelf.masterPort = port
-	log.Info("Get master addr as %s:%d", ip, port)
+}
+
+// Master with the latest leader token, nil if none.
+func latestMaster(insts []*cfgmgr.ServiceInstance) *cfgmgr.ServiceInstance {
+	var inst *cfgmgr.ServiceInstance
+	for _, i := range insts {
+		if inst == nil || i.LeaderToken() > inst.LeaderToken() {
+			inst = i
+		}
+	}
+	return inst
+}
+
+// Register on the master given and follow it, the task in running is
+// aborted as the new master takes over from its checkpoint.
+func switchMaster(inst *cfgmgr.ServiceInstance) error {
+	ip, port, err := util.SplitAddr(inst.Addr)
+	if err != nil {
+		return fmt.Errorf("Fail to split master addr %q, %v", inst.Addr, err)
+	}
+	token := inst.LeaderToken()
+	log.Info("Master changed to %s, token %d", inst.Addr, token)
+	tskctx.abortRunning()
+	workerSelf.setPendingToken(token)
+	key, err := registerOnMaster(ip, port)
+	if err != nil {
+		workerSelf.setPendingToken(0)
+		return err
+	}
+	workerSelf.setMaster(ip, port, token, key)
+	rate.SetMaster(ip, port)
+	return nil
+}
+
+// Follow master changes out of the registry watch, so that a slow or
+// failing registration never holds up the watch. Only the latest master
+// notified is registered on, the ones superseded meanwhile are skipped.
+type masterFollower struct {
+	mutex  sync.Mutex
+	target *cfgmgr.ServiceInstance
+	notify chan struct{}
+}
+
+var follower = &masterFollower{notify: make(chan struct{}, 1)}
+
+func (f *masterFollower) set(inst *cfgmgr.ServiceInstance) {
+	f.mutex.Lock()
+	f.target = inst
+	f.mutex.Unlock()
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (f *masterFollower) run() {
+	for range f.notify {
+		f.mutex.Lock()
+		inst := f.target
+		f.mutex.Unlock()
+		token := inst.LeaderToken()
+		if cur := workerSelf.getMasterToken(); token < cur {
+			log.Info("Ignore master %s of former token %d, follow token %d", inst.Addr, token, cur)
+			continue
+		} else if token == cur {
+			continue
+		}
+		if err := switchMaster(inst); err != nil {
+			log.Error("Fail to follow master %s, %v", inst.Addr, err)
+			time.AfterFunc(MASTER_REGISTER_BACKOFF, f.refresh)
+		}
+	}
+}
+
+// Retry with the masters registered by now, the failed one may be gone.
+func (f *masterFollower) refresh() {
+	insts, err := cfgmgr.ListServices(cfgServerIP, cfgmgr.SERVICE_ROLE_MASTER)
+	if err != nil {
+		log.Error("Fail to list masters, %v", err)
+		time.AfterFunc(MASTER_REGISTER_BACKOFF, f.refresh)
+		return
+	}
+	if inst := latestMaster(insts); inst != nil {
+		f.set(inst)
+	}
+}
+
+// Switch to the master with the latest leader token once leadership
+// changes. A former master still registered, or registered again after
+// cfg server restarts, is never followed back.
+func followMaster(insts []*cfgmgr.ServiceInstance) {
+	inst := latestMaster(insts)
+	if inst == nil {
+		log.Info("No master registered, wait for the next one")
+		return
+	}
+	follower.set(inst)
+}
+
+// Deregister from cfg server on SIGINT or SIGTERM, rather than being
+// listed until the lease expires.
+func stopOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	log.Info("Stop on %v", sig)
+	if err := serviceLease.Close(); err != nil {
+		log.Error("Fail to deregister from cfg server, %v", err)
+	}
+	os.Exit(0)
+}
+
+func registerOnCfgServer() error {
+	inst := &cfgmgr.ServiceInstance{
+		Role:    cfgmgr.SERVICE_ROLE_WORKER,
+		Addr:    workerSelf.workerAddr,
+		Version: strconv.Itoa(workgroup.PROTO_VERSION),
+		Meta:    map[string]string{"name": workerSelf.Name},
+	}
+	lease, err := cfgmgr.RegisterService(cfgServerIP, inst)
+	if err != nil {
+		return fmt.Errorf("Fail to register on cfg server, %v", err)
+	}
+	serviceLease = lease
+	return nil
 }
 
 func discoverIp() error {
 	log.Info("Discover self ip address")
-	ip, err := cfgmgr.DiscoverIpFromCfg(cfgServerIP)
+	ip, err := cfgmgr.GetAdvertiseIP(cfgServerIP, &cfgmgr.Bootstrap.Worker)
 	if err != nil {
 		return err
 	}
@@ -96,17 +266,14 @@ func prepareNetwork() error {
 	if err := discoverIp(); err != nil {
 		return err
 	}
-	if err := s.Listen(workerSelf.IP); err != nil {
+	nc := &cfgmgr.Bootstrap.Worker
+	if err := s.Listen(nc.BindIP, nc.Port); err != nil {
 		return fmt.Errorf("Fail to listen, %v", err)
 	}
 	workerSelf.workerServer = s
-	workerSelf.workerAddr = s.GetListenAddr()
-	_, port, err := util.SplitAddr(workerSelf.workerAddr)
-	if err != nil {
-		return err
-	}
-	workerSelf.ListenPort = port
-	log.Info("Listen on %d", workerSelf.ListenPort)
+	workerSelf.ListenPort = s.GetListenPort()
+	workerSelf.workerAddr = util.JoinAddr(workerSelf.IP, workerSelf.ListenPort)
+	log.Info("Listen on %s, advertise as %s", s.GetListenAddr(), workerSelf.workerAddr)
 	hostname, err := os.Hostname()
 	if err != nil {
 		return err
@@ -115,44 +282,50 @@ func prepareNetwork() error {
 	return nil
 }
 
-func getRegisterKey() (err error) {
-	u := &util.HttpUrl{
-		IP:   workerSelf.masterIp,
-		Port: workerSelf.masterPort,
-		Uri:  uri.MasterRegisterWokerUri,
+// Get the key from the master and verify with it, retried a few times
+// before giving up on the master.
+func registerOnMaster(ip string, port int) (key string, err error) {
+	log.Info("Register on master %s", util.JoinAddr(ip, port))
+	form := &workgroup.WorkerRegForm{
+		Name:         workerSelf.Name,
+		IP:           workerSelf.IP,
+		Port:         workerSelf.ListenPort,
+		ProtoVersion: workgroup.PROTO_VERSION,
+		TaskKinds:    taskreg.GetTaskKinds(),
 	}
-	sleepTime := 5 * time.Second
-	var key string
-	for {
-		key, err = util.HttpGet(u)
-		if err == nil {
-			break
+	for i := 0; i < MASTER_REGISTER_RETRY; i++ {
+		if i > 0 {
+			time.Sleep(MASTER_REGISTER_BACKOFF)
 		}
-		log.Error("Fail to register/get key, %v", err)
-		time.Sleep(sleepTime)
+		u := &util.HttpUrl{
+			IP:     ip,
+			Port:   port,
+			Uri:    uri.MasterRegisterWokerUri,
+			Header: make(http.Header),
+		}
+		if key, err = util.HttpGet(u); err != nil {
+			err = fmt.Errorf("Fail to get key, %v", err)
+			log.Error("Fail to register on master, %v", err)
+			continue
+		}
+		u.Header.Set(auth.HEADER_WORKER_KEY, key)
+		if _, err = util.HttpPostData(u, form); err != nil {
+			err = fmt.Errorf("Fail to verify, %v", err)
+			log.Error("Fail to register on master, %v", err)
+			continue
+		}
+		log.Info("Register on master done, key %s", key)
+		return key, nil
 	}
-	log.Info("Get worker's key as %s", key)
-	workerSelf.Key = key
-	return
+	return "", err
 }
 
-func registerOnMaster() (err error) {
-	log.Info("Register on master")
-	if err := getRegisterKey(); err != nil {
-		return err
-	}
-	u := workerSelf.makeMasterUrl(uri.MasterRegisterWokerUri)
-	form := &workgroup.WorkerRegForm{
-		Name: workerSelf.Name,
-		IP:   workerSelf.IP,
-		Port: workerSelf.ListenPort,
-	}
-	_, err = util.HttpPostData(u, &form)
-	if err != nil {
-		return fmt.Errorf("Fail to verify, %v", err)
-	}
-	log.Info("Register on master done")
-	return
+func cfgEffectiveHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, cfgmgr.GetCfgOrigins())
+}
+
+func cfgRevHandler(w http.ResponseWriter, r *http.Request) {
+	server.FmtResp(w, nil, cfgmgr.GetAppliedRevision())
 }
 
 func testHandler(w http.ResponseWriter, r *http.Request) {
@@ -164,12 +337,30 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func registerRoutes() {
+	route.RegisterRoute(&route.Route{
+		Name:    "cfgEffectiveHandler",
+		Method:  http.MethodGet,
+		Path:    uri.WorkerCfgEffectiveUri,
+		Handler: cfgEffectiveHandler,
+	})
+	route.RegisterRoute(&route.Route{
+		Name:    "cfgRevHandler",
+		Method:  http.MethodGet,
+		Path:    uri.WorkerCfgRevUri,
+		Handler: cfgRevHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "taskRecipiantHandler",
 		Method:  http.MethodPost,
 		Path:    uri.WorkerTaskUri,
 		Handler: taskRecipiantHandler,
 	})
+	route.RegisterRoute(&route.Route{
+		Name:    "taskAbortHandler",
+		Method:  http.MethodDelete,
+		Path:    uri.WorkerTaskUri + "/{" + uri.WorkerTaskIdKey + "}",
+		Handler: taskAbortHandler,
+	})
 	route.RegisterRoute(&route.Route{
 		Name:    "testHandler",
 		Method:  http.MethodPost,
@@ -179,8 +370,12 @@ func registerRoutes() {
 }
 
 func initLogger() error {
+	level, err := log.GetLogLevel(cfgmgr.Bootstrap.LogLevel)
+	if err != nil {
+		return err
+	}
 	consoleLogger := &log.ConsoleLogger{
-		Level: log.LevelInfo,
+		Level: level,
 	}
 	if err := log.RegisterLogger(consoleLogger); err != nil {
 		return err
@@ -190,21 +385,54 @@ func initLogger() error {
 }
 
 func main() {
+	if err := cfgmgr.InitLayers(); err != nil {
+		panic(err)
+	}
+	cfgServerIP = cfgmgr.Bootstrap.CfgServerIP
 	if err := initLogger(); err != nil {
 		panic(fmt.Errorf("Fail to init logger, %v", err))
 	}
+	if err := pki.InitFromLocalCfg(); err != nil {
+		panic(err)
+	}
 	registerRoutes()
 	cfgmgr.WaitForCfgServerUp(cfgServerIP)
-	waitForMasterReady()
+	if err := workgroup.InitWorkgroup(cfgServerIP); err != nil {
+		panic(err)
+	}
+	if err := initWorkerCfg(cfgServerIP); err != nil {
+		panic(err)
+	}
+	if err := db.InitDb(cfgServerIP); err != nil {
+		panic(err)
+	}
+	cfgmgr.Subscribe(workgroup.WgCfg, func(cOld, cNew interface{}) {
+		log.Info("Executor count %d takes effect from next task",
+			cNew.(*workgroup.WorkgroupCfg).WorkerExecutorCnt)
+	})
+	cfgmgr.WatchCfg(cfgServerIP)
+	cfgmgr.LogCfgOrigins()
+	inst := waitForMasterReady()
 	if err := prepareNetwork(); err != nil {
 		panic(err)
 	}
-	if err := registerOnMaster(); err != nil {
+	if err := registerOnCfgServer(); err != nil {
 		panic(err)
 	}
+	go stopOnSignal()
+	for {
+		err := switchMaster(inst)
+		if err == nil {
+			break
+		}
+		log.Error("Fail to follow master %s, %v", inst.Addr, err)
+		inst = waitForMasterReady()
+	}
 	if err := startHb(); err != nil {
 		panic(err)
 	}
-	rate.InitAsWorker(workerSelf.masterIp, workerSelf.masterPort)
+	rate.InitAsWorker(workerSelf.getMasterAddr())
+	go follower.run()
+	cfgmgr.WatchServices(cfgServerIP, cfgmgr.SERVICE_ROLE_MASTER, followMaster)
 	panic(workerSelf.workerServer.Serve())
 }
@@ -5,16 +5,16 @@ import (
 	"time"
 )
 
-const (
-	MONITOR_INTERVAL = 1 * time.Second
-)
+func getMonitorInterval() time.Duration {
+	return getWorkerCfg().MonitorInterval
+}
 
 func monitorMain(args interface{}) {
 	reportTaskStatus()
 }
 
 func startMonitor() {
-	go util.PeriodicalRoutine(true, MONITOR_INTERVAL, monitorMain, nil)
+	go util.PeriodicalRoutineFunc(true, getMonitorInterval, monitorMain, nil)
 }
 
 func init() {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,90 +11,77 @@ import (
 	"pegasus/taskreg"
 	"pegasus/uri"
 	"pegasus/util"
+	"pegasus/workgroup"
+	"strconv"
 	"sync"
-	"time"
+
+	"github.com/gorilla/mux"
 )
 
 var tskctx = &TaskCtx{}
 
-const (
-	BUF_TASKLET_CNT      = 8
-	RUNNING_EXECUTOR_CNT = 2
-	TASKLET_MAX_RETRY    = 3
-)
-
 type TaskCtx struct {
-	tsk            task.Task
-	wgFinish       sync.WaitGroup
-	taskletCtxList []task.TaskletCtx
-	todoTasklets   chan task.Tasklet
-	doneTasklets   chan task.Tasklet
 	// Following fields under mutex protection
 	mutex    sync.Mutex
-	err      error
+	tsk      task.Task
+	runner   *task.Runner
 	free     bool
-	total    int
-	done     int
-	finished bool
-	startTs  time.Time
-	endTs    time.Time
-}
-
-func (ctx *TaskCtx) kickoff() {
-	ctx.mutex.Lock()
-	defer ctx.mutex.Unlock()
-	ctx.startTs = time.Now()
-	ctx.err = nil
-	ctx.total = 0
-	ctx.done = 0
-	ctx.finished = false
-	ctx.endTs = time.Time{}
+	abortReq bool
 }
 
-func (ctx *TaskCtx) finish() {
+func (ctx *TaskCtx) checkAndUnsetFree(tsk task.Task, resume *task.TaskResume) error {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	ctx.finished = true
-	ctx.endTs = time.Now()
+	if !ctx.free {
+		return fmt.Errorf("%w with task %q", util.ErrBusy, ctx.tsk.GetKind())
+	}
+	ctx.free = false
+	ctx.tsk = tsk
+	// Set up here rather than once the task starts running, so that an
+	// abort coming in right after the task is accepted won't get lost, or
+	// be refused as the previous task finished.
+	ctx.runner = task.NewRunner(context.Background(), tsk, resume, getTaskletRetryPolicy())
+	ctx.abortReq = false
+	return nil
 }
 
-func (ctx *TaskCtx) init() {
-	taskletCnt := ctx.tsk.GetTaskletCnt()
-	log.Info("Task %q tasklet count %d", ctx.tsk.GetTaskId(), taskletCnt)
-	ctx.todoTasklets = make(chan task.Tasklet, BUF_TASKLET_CNT)
-	ctx.doneTasklets = make(chan task.Tasklet, taskletCnt)
-	ctx.taskletCtxList = make([]task.TaskletCtx, 0)
+func (ctx *TaskCtx) getRunner() *task.Runner {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	ctx.err = nil
-	ctx.total = taskletCnt
+	return ctx.runner
 }
 
-func (ctx *TaskCtx) aborted() bool {
+func (ctx *TaskCtx) abort(tid string) error {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	if ctx.err == nil {
-		return false
-	} else {
-		return true
+	if ctx.free || ctx.tsk.GetTaskId() != tid {
+		return fmt.Errorf("%w, task %q not running", util.ErrNotFound, tid)
+	}
+	if err := ctx.runner.Abort(fmt.Errorf("Task %q aborted", tid)); err != nil {
+		return err
 	}
+	ctx.abortReq = true
+	return nil
 }
 
-func (ctx *TaskCtx) setErr(err error) {
+// Abort whatever task in running, if any.
+func (ctx *TaskCtx) abortRunning() {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	ctx.err = err
+	if ctx.free {
+		return
+	}
+	tid := ctx.tsk.GetTaskId()
+	if ctx.runner.Abort(fmt.Errorf("Task %q aborted", tid)) == nil {
+		log.Info("Abort task %q in running", tid)
+		ctx.abortReq = true
+	}
 }
 
-func (ctx *TaskCtx) checkAndUnsetFree(tsk task.Task) error {
+func (ctx *TaskCtx) abortRequested() bool {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
-	if !ctx.free {
-		return fmt.Errorf("Worker busy with task %q", ctx.tsk.GetKind())
-	}
-	ctx.free = false
-	ctx.tsk = tsk
-	return nil
+	return ctx.abortReq
 }
 
 func (ctx *TaskCtx) setFree() {
@@ -102,13 +90,7 @@ func (ctx *TaskCtx) setFree() {
 	defer ctx.mutex.Unlock()
 	ctx.free = true
 	ctx.tsk = nil
-}
-
-func (ctx *TaskCtx) appendDoneTasklet(tasklet task.Tasklet) {
-	ctx.doneTasklets <- tasklet
-	ctx.mutex.Lock()
-	defer ctx.mutex.Unlock()
-	ctx.done++
+	ctx.runner = nil
 }
 
 func (ctx *TaskCtx) getTaskStatus() *task.TaskStatus {
@@ -117,157 +99,37 @@ func (ctx *TaskCtx) getTaskStatus() *task.TaskStatus {
 	if ctx.free {
 		return nil
 	}
-	return &task.TaskStatus{
-		Tid:      ctx.tsk.GetTaskId(),
-		Desc:     ctx.tsk.GetDesc(),
-		StartTs:  ctx.startTs,
-		Finished: ctx.finished,
-		Total:    ctx.total,
-		Done:     ctx.done,
-	}
+	return ctx.runner.GetStatus()
 }
 
+// Read once per task, so that a cfg change applies from the next task.
 func getExecutorCnt() int {
-	return RUNNING_EXECUTOR_CNT
-}
-
-func prepareExecutors(ctx *TaskCtx, tsk task.Task) {
-	cnt := getExecutorCnt()
-	for i := 0; i < cnt; i++ {
-		c := tsk.NewTaskletCtx()
-		ctx.wgFinish.Add(1)
-		go taskletExecutor(i, ctx, c)
-		if c != nil {
-			ctx.taskletCtxList = append(ctx.taskletCtxList, c)
-		}
+	if cnt := workgroup.GetWgCfg().WorkerExecutorCnt; cnt > 0 {
+		return cnt
 	}
-}
-
-func releaseExecutors(ctx *TaskCtx) {
-	log.Info("Release all executors' ctx")
-	for _, c := range ctx.taskletCtxList {
-		c.Close()
-	}
-}
-
-func waitForTaskDone(ctx *TaskCtx) {
-	log.Info("Wait for task %q done", ctx.tsk.GetTaskId())
-	tskctx.wgFinish.Wait()
+	return getWorkerCfg().RunningExecutorCnt
 }
 
 func handleTaskReq(tsk task.Task) {
-	log.Info("Dealing with task %q", tsk.GetTaskId())
-	tskctx.kickoff()
-	if err := tsk.Init(RUNNING_EXECUTOR_CNT); err == nil {
-		tskctx.init()
-		prepareExecutors(tskctx, tsk)
-		assignTasklets(tskctx, tsk)
-		waitForTaskDone(tskctx)
-		releaseExecutors(tskctx)
-	} else {
-		log.Error("Fail to init task %q, %v", tsk.GetTaskId(), err)
-		tskctx.setErr(err)
-	}
-	if tskctx.aborted() {
-		tsk.SetError(tskctx.err)
-	} else {
-		reduceTasklets(tsk, tskctx)
-	}
-	tskctx.finish()
-	report := generateTaskReport(tskctx)
-	tskctx.setFree()
+	report := runTask(tsk)
 	go sendTaskReport(report)
 }
 
-func assignTasklets(ctx *TaskCtx, tsk task.Task) {
-	log.Info("Assign tasklets")
-	i := 0
-	for {
-		if ctx.aborted() {
-			log.Info("Abort assign tasklets")
-			break
-		}
-		taskletid := fmt.Sprintf("%s-%d", tsk.GetTaskId(), i)
-		tasklet := tsk.GetNextTasklet(taskletid)
-		if tasklet == nil {
-			close(ctx.todoTasklets)
-			break
-		}
-		log.Info("Put tasklet %q to todo list", tasklet.GetTaskletId())
-		ctx.todoTasklets <- tasklet
-		i++
-	}
-	log.Info("Assign tasklets finished")
-}
-
-func taskletExecutor(eid int, ctx *TaskCtx, c task.TaskletCtx) {
-	var err error
-	defer ctx.wgFinish.Done()
-	for {
-		if ctx.aborted() {
-			log.Info("Error set in taskctx, abort executor #%d", eid)
-			break
-		}
-		log.Info("Executor #%d, retrieve todo tasklet...", eid)
-		tasklet, ok := <-ctx.todoTasklets
-		if !ok {
-			log.Info("Todo tasklets drained, exit executor #%d", eid)
-			break
-		}
-		log.Info("Executor #%d execute tasklet %q", eid, tasklet.GetTaskletId())
-		for i := 0; i < TASKLET_MAX_RETRY; i++ {
-			if err = tasklet.Execute(c); err == nil {
-				break
-			}
-			log.Info("Retry execute tasklet %q", tasklet.GetTaskletId())
-		}
-		log.Info("Executor #%d execute tasklet %q done", eid, tasklet.GetTaskletId())
-		if err != nil {
-			log.Info("Fail on tasklet %q, err %v", tasklet.GetTaskletId(), err)
-			tskctx.setErr(err)
-			break
-		}
-		ctx.appendDoneTasklet(tasklet)
-	}
-	log.Info("Executor #%d, exit", eid)
-}
-
-func reduceTasklets(tsk task.Task, ctx *TaskCtx) {
-	log.Info("Reduce tasklets for task %q", tsk.GetTaskId())
-	close(ctx.doneTasklets)
-	tasklets := make([]task.Tasklet, 0, len(ctx.doneTasklets))
-	for {
-		tasklet, ok := <-ctx.doneTasklets
-		if !ok {
-			break
-		}
-		tasklets = append(tasklets, tasklet)
-	}
-	tsk.ReduceTasklets(tasklets)
-}
-
-func generateTaskReport(ctx *TaskCtx) *task.TaskReport {
-	tsk := ctx.tsk
-	status := ctx.getTaskStatus()
-	errMsg := ""
-	if err := tsk.GetError(); err != nil {
-		errMsg = err.Error()
-	}
-	return &task.TaskReport{
-		Err:     errMsg,
-		Tid:     tsk.GetTaskId(),
-		Kind:    tsk.GetKind(),
-		StartTs: ctx.startTs,
-		EndTs:   ctx.endTs,
-		Status:  status,
-		Output:  tsk.GetOutput(),
-	}
+// Run the task accepted and set the worker free, with the report returned.
+func runTask(tsk task.Task) *task.TaskReport {
+	log.Info("Dealing with task %q", tsk.GetTaskId())
+	runner := tskctx.getRunner()
+	runner.Run(getExecutorCnt())
+	report := runner.GenerateReport()
+	report.Aborted = tskctx.abortRequested()
+	tskctx.setFree()
+	return report
 }
 
 func sendTaskReport(report *task.TaskReport) {
 	log.Info("Send out task report for %q", report.Tid)
 	u := workerSelf.makeMasterUrl(uri.MasterWorkerTaskReportUri)
-	if _, err := util.HttpPostData(u, report); err == nil {
+	if _, err := util.HttpPostPayload(u, report); err == nil {
 		log.Info("Send out task report for %q done", report.Tid)
 	} else {
 		// TODO need retry on error
@@ -276,25 +138,26 @@ func sendTaskReport(report *task.TaskReport) {
 }
 
 func makeTaskspec(r *http.Request) (tspec *task.TaskSpec, err error) {
-	buf, err := util.HttpReadRequestJsonBody(r)
-	if err != nil {
-		err = fmt.Errorf("Fail to read request body, %v", err)
-		return
-	}
-	maxlen := util.Min(len(buf), 2*1024)
-	log.Info("Get task spec:\n%s", string(buf[:maxlen]))
 	tspec = new(task.TaskSpec)
-	if err = json.Unmarshal(buf, tspec); err != nil {
-		err = fmt.Errorf("Fail unmarshal tspec %s, %v", string(buf), err)
+	if err = util.HttpFitRequestInto(r, tspec); err != nil {
+		err = fmt.Errorf("Fail to read task spec, %w", err)
 		return
 	}
+	// Logged as JSON, so that it could be fed to pegasus-task as is
+	if buf, err := json.Marshal(tspec); err == nil {
+		maxlen := util.Min(len(buf), 2*1024)
+		log.Info("Get task spec:\n%s", string(buf[:maxlen]))
+	}
 	return
 }
 
 func spawnTask(tspec *task.TaskSpec) (task.Task, error) {
 	gen := taskreg.GetTaskGenerator(tspec.Kind)
 	if gen == nil {
-		return nil, fmt.Errorf("Task %q not supported", tspec.Kind)
+		return nil, fmt.Errorf("%w, task %q not supported", util.ErrInvalidSpec, tspec.Kind)
+	}
+	if err := taskreg.DecodeTaskSpec(tspec); err != nil {
+		return nil, fmt.Errorf("%w, %v", util.ErrInvalidSpec, err)
 	}
 	tsk, err := gen(tspec)
 	if err != nil {
@@ -309,14 +172,30 @@ func taskRecepiant(tspec *task.TaskSpec) error {
 	if err != nil {
 		return err
 	}
-	if err := tskctx.checkAndUnsetFree(tsk); err != nil {
+	if err := tskctx.checkAndUnsetFree(tsk, tspec.Resume); err != nil {
 		return err
 	}
 	go handleTaskReq(tsk)
 	return nil
 }
 
+// Requests of a former master are refused, it could still be running for
+// a while after another one took over.
+func checkMasterToken(r *http.Request) error {
+	s := r.URL.Query().Get(uri.LeaderTokenKey)
+	token, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w, invalid master token %q", util.ErrInvalidSpec, s)
+	}
+	return workerSelf.checkToken(token)
+}
+
 func taskRecipiantHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkMasterToken(r); err != nil {
+		log.Error("Refuse task from %s, %v", r.RemoteAddr, err)
+		server.FmtResp(w, err, "")
+		return
+	}
 	tspec, err := makeTaskspec(r)
 	if err != nil {
 		log.Info("Fail to make task spec, %v", err)
@@ -329,6 +208,21 @@ func taskRecipiantHandler(w http.ResponseWriter, r *http.Request) {
 	server.FmtResp(w, err, "")
 }
 
+func taskAbortHandler(w http.ResponseWriter, r *http.Request) {
+	tid := mux.Vars(r)[uri.WorkerTaskIdKey]
+	log.Info("Get abort request for task %q from %s", tid, r.RemoteAddr)
+	if err := checkMasterToken(r); err != nil {
+		log.Error("Refuse to abort task %q, %v", tid, err)
+		server.FmtResp(w, err, "")
+		return
+	}
+	err := tskctx.abort(tid)
+	if err != nil {
+		log.Error("Fail to abort task %q, %v", tid, err)
+	}
+	server.FmtResp(w, err, "")
+}
+
 func reportTaskStatus() {
 	taskStatus := tskctx.getTaskStatus()
 	if taskStatus == nil {
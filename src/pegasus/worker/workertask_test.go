@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pegasus/task"
+)
+
+// Task with cnt tasklets, each adding its index to the output, which is
+// the sum of all tasklets done.
+type testTask struct {
+	tid   string
+	cnt   int
+	next  int
+	err   error
+	sum   int
+	fail  func(i int) error
+	mutex sync.Mutex
+	// Index of tasklets executed
+	executed []int
+}
+
+type testTasklet struct {
+	id  string
+	i   int
+	tsk *testTask
+}
+
+func (t *testTasklet) GetTaskletId() string {
+	return t.id
+}
+
+func (t *testTasklet) Execute(ctx context.Context, c task.TaskletCtx) error {
+	t.tsk.mutex.Lock()
+	t.tsk.executed = append(t.tsk.executed, t.i)
+	t.tsk.mutex.Unlock()
+	if t.tsk.fail != nil {
+		return t.tsk.fail(t.i)
+	}
+	return nil
+}
+
+func (t *testTask) Init(int) error                   { return nil }
+func (t *testTask) NewTaskletCtx() task.TaskletCtx   { return nil }
+func (t *testTask) GetTaskId() string                { return t.tid }
+func (t *testTask) GetKind() string                  { return "test" }
+func (t *testTask) GetDesc() string                  { return t.tid }
+func (t *testTask) GetTaskletCnt() int               { return t.cnt }
+func (t *testTask) GetTaskletTimeout() time.Duration { return time.Second }
+func (t *testTask) SetError(err error)               { t.err = err }
+func (t *testTask) GetError() error                  { return t.err }
+func (t *testTask) GetOutput() interface{}           { return t.sum }
+
+func (t *testTask) GetNextTasklet(taskletid string) task.Tasklet {
+	if t.next >= t.cnt {
+		return nil
+	}
+	t.next++
+	return &testTasklet{id: taskletid, i: t.next - 1, tsk: t}
+}
+
+func (t *testTask) ReduceTasklets(prev interface{}, tasklets []task.Tasklet) error {
+	if prev != nil {
+		t.sum = prev.(int)
+	}
+	for _, tasklet := range tasklets {
+		t.sum += tasklet.(*testTasklet).i
+	}
+	return nil
+}
+
+// Accept tsk as sent by master and run it through.
+func runTestTask(t *testing.T, tsk *testTask, resume *task.TaskResume) *task.TaskReport {
+	if err := tskctx.checkAndUnsetFree(tsk, resume); err != nil {
+		t.Fatalf("Fail to accept task %q, %v", tsk.tid, err)
+	}
+	return runTask(tsk)
+}
+
+// Abort coming in before the task starts running takes effect, even
+// right after another task finished.
+func TestAbortAfterAccept(t *testing.T) {
+	report := runTestTask(t, &testTask{tid: "tsk-0", cnt: 4}, nil)
+	if report.Err != "" || report.Output != 6 {
+		t.Fatalf("Fail to run task, get %+v", report)
+	}
+
+	tsk := &testTask{tid: "tsk-1", cnt: 4}
+	if err := tskctx.checkAndUnsetFree(tsk, nil); err != nil {
+		t.Fatalf("Fail to accept task, %v", err)
+	}
+	if status := tskctx.getTaskStatus(); status.Finished || status.Done != 0 {
+		t.Fatalf("Get status %+v of task just accepted", status)
+	}
+	if err := tskctx.abort(tsk.tid); err != nil {
+		t.Fatalf("Fail to abort task just accepted, %v", err)
+	}
+	report = runTask(tsk)
+	if !report.Aborted || report.Err != fmt.Sprintf("Task %q aborted", tsk.tid) {
+		t.Fatalf("Get report %+v, expect aborted", report)
+	}
+	if len(tsk.executed) != 0 || len(report.Done) != 0 || len(report.Remaining) != 4 {
+		t.Fatalf("Tasklets %v executed, report %+v, expect none", tsk.executed, report)
+	}
+	if err := tskctx.abort(tsk.tid); err == nil {
+		t.Fatalf("Abort task after finished, expect error")
+	}
+}
+
+func tidSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// A partial attempt reports the tasklets done with their output, and the
+// attempt resumed from it runs only the remaining ones.
+func TestResumeTask(t *testing.T) {
+	tsk := &testTask{tid: "tsk-resume", cnt: 4, fail: func(i int) error {
+		if i == 2 {
+			return task.NewPermanentErr(fmt.Errorf("tasklet %d fails", i))
+		}
+		return nil
+	}}
+	report := runTestTask(t, tsk, nil)
+	done := tidSet(report.Done)
+	if report.Err == "" || report.Aborted || !done["tsk-resume-0"] ||
+		!done["tsk-resume-1"] || done["tsk-resume-2"] {
+		t.Fatalf("Get report %+v, expect tasklet 2 failed and 0, 1 done", report)
+	}
+	if len(report.Done)+len(report.Remaining) != 4 {
+		t.Fatalf("Get done %v and remaining %v, expect 4 in all", report.Done, report.Remaining)
+	}
+	sum := 0
+	for _, i := range tsk.executed {
+		if done[fmt.Sprintf("tsk-resume-%d", i)] {
+			sum += i
+		}
+	}
+	if report.Output != sum {
+		t.Fatalf("Get output %v of done tasklets %v, expect %d", report.Output, report.Done, sum)
+	}
+
+	resumed := &testTask{tid: "tsk-resume", cnt: 4}
+	resume := &task.TaskResume{Attempt: 1, Done: report.Done, Output: report.Output}
+	report = runTestTask(t, resumed, resume)
+	if report.Err != "" || report.Output != 6 || len(report.Done) != 4 || len(report.Remaining) != 0 {
+		t.Fatalf("Get report %+v of resumed task, expect all done with output 6", report)
+	}
+	for _, i := range resumed.executed {
+		if done[fmt.Sprintf("tsk-resume-%d", i)] {
+			t.Fatalf("Tasklet %d done in previous attempt executed again", i)
+		}
+	}
+	if len(resumed.executed) != 4-len(done) {
+		t.Fatalf("Tasklets %v executed on resume, expect %v", resumed.executed, report.Remaining)
+	}
+}
+
+// Panic in a tasklet fails the task rather than the worker, with the stack
+// carried in the report.
+func TestPanicTasklet(t *testing.T) {
+	tsk := &testTask{tid: "tsk-panic", cnt: 4, fail: func(i int) error {
+		if i == 1 {
+			panic("tasklet 1 panics")
+		}
+		return nil
+	}}
+	report := runTestTask(t, tsk, nil)
+	if report.Aborted || !strings.Contains(report.Err, "tasklet 1 panics") {
+		t.Fatalf("Get report %+v, expect error of the panic", report)
+	}
+	if !strings.Contains(report.Stack, "(*testTasklet).Execute") {
+		t.Fatalf("Get stack %q, expect the one of tasklet panic", report.Stack)
+	}
+	if tidSet(report.Done)["tsk-panic-1"] {
+		t.Fatalf("Tasklet panic reported done, %v", report.Done)
+	}
+
+	// Worker takes the next task
+	report = runTestTask(t, &testTask{tid: "tsk-next", cnt: 4}, nil)
+	if report.Err != "" || report.Stack != "" || report.Output != 6 {
+		t.Fatalf("Get report %+v of task after panic, expect done", report)
+	}
+}
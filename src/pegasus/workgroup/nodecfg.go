@@ -0,0 +1,86 @@
+package workgroup
+
+import (
+	"fmt"
+	"pegasus/cfgmgr"
+	"time"
+)
+
+// Tuning of master, changes take effect on the fly.
+type MasterCfg struct {
+	WorkerHbInterval      time.Duration
+	WorkerMonitorInterval time.Duration
+	// Heartbeats within a monitor interval for a worker to be good, or
+	// below norm to be unstable
+	WorkerHbCntGood int
+	WorkerHbCntNorm int
+	WorkerMaxFault  int
+	// From the next job
+	BufTaskCnt int
+}
+
+var MCfg = new(MasterCfg)
+var MCfgDef = &MasterCfg{
+	WorkerHbInterval:      5 * time.Second,
+	WorkerMonitorInterval: 30 * time.Second,
+	WorkerHbCntGood:       5,
+	WorkerHbCntNorm:       3,
+	WorkerMaxFault:        2,
+	BufTaskCnt:            10,
+}
+
+// Tuning of worker, changes take effect on the fly or from the next task.
+type WorkerCfg struct {
+	// Unless WorkgroupCfg.WorkerExecutorCnt is set
+	RunningExecutorCnt int
+	TaskletMaxRetry    int
+	MonitorInterval    time.Duration
+}
+
+var WCfg = new(WorkerCfg)
+var WCfgDef = &WorkerCfg{
+	RunningExecutorCnt: 2,
+	TaskletMaxRetry:    3,
+	MonitorInterval:    1 * time.Second,
+}
+
+// A worker could only be good if enough heartbeats fit in a monitor
+// interval.
+func validateMasterCfg(c interface{}) error {
+	mc := c.(*MasterCfg)
+	if mc.WorkerHbInterval < 100*time.Millisecond {
+		return fmt.Errorf("WorkerHbInterval %v less than 100ms", mc.WorkerHbInterval)
+	}
+	if mc.WorkerMonitorInterval < mc.WorkerHbInterval {
+		return fmt.Errorf("WorkerMonitorInterval %v shorter than WorkerHbInterval %v",
+			mc.WorkerMonitorInterval, mc.WorkerHbInterval)
+	}
+	if mc.WorkerHbCntNorm > mc.WorkerHbCntGood {
+		return fmt.Errorf("WorkerHbCntNorm %d above WorkerHbCntGood %d",
+			mc.WorkerHbCntNorm, mc.WorkerHbCntGood)
+	}
+	if max := int(mc.WorkerMonitorInterval / mc.WorkerHbInterval); mc.WorkerHbCntGood > max {
+		return fmt.Errorf("WorkerHbCntGood %d above %d heartbeats per monitor interval",
+			mc.WorkerHbCntGood, max)
+	}
+	return nil
+}
+
+func validateWorkerCfg(c interface{}) error {
+	if d := c.(*WorkerCfg).MonitorInterval; d < 100*time.Millisecond {
+		return fmt.Errorf("MonitorInterval %v less than 100ms", d)
+	}
+	return nil
+}
+
+func registerNodeCfg() {
+	cfgmgr.RegisterCfgEntry(MCfg, MCfgDef)
+	cfgmgr.RegisterCfgValidator(MCfg, cfgmgr.IntRange("WorkerHbCntNorm", 1, 1000))
+	cfgmgr.RegisterCfgValidator(MCfg, cfgmgr.IntRange("WorkerMaxFault", 1, 1000))
+	cfgmgr.RegisterCfgValidator(MCfg, cfgmgr.IntRange("BufTaskCnt", 1, 10000))
+	cfgmgr.RegisterCfgValidator(MCfg, validateMasterCfg)
+	cfgmgr.RegisterCfgEntry(WCfg, WCfgDef)
+	cfgmgr.RegisterCfgValidator(WCfg, cfgmgr.IntRange("RunningExecutorCnt", 1, 64))
+	cfgmgr.RegisterCfgValidator(WCfg, cfgmgr.IntRange("TaskletMaxRetry", 1, 100))
+	cfgmgr.RegisterCfgValidator(WCfg, validateWorkerCfg)
+}
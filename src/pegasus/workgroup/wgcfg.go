@@ -3,11 +3,12 @@ package workgroup
 import (
 	"pegasus/cfgmgr"
 	"pegasus/log"
+	"sync/atomic"
 )
 
 type WorkgroupCfg struct {
-	DataPath          string
-	LogPath           string
+	DataPath          string `cfg:"required"`
+	LogPath           string `cfg:"required"`
 	WorkerExecutorCnt int
 }
 
@@ -18,14 +19,39 @@ var WgCfgDef = &WorkgroupCfg{
 	WorkerExecutorCnt: 2,
 }
 
+// Copy of WgCfg, replaced as a whole on change so that readers never see
+// a partial update.
+var wgCfg atomic.Value
+
+// Compiled default until pulled from cfg server.
+func GetWgCfg() *WorkgroupCfg {
+	if c, ok := wgCfg.Load().(*WorkgroupCfg); ok {
+		return c
+	}
+	return WgCfgDef
+}
+
 func RegisterCfg() {
 	cfgmgr.RegisterCfgEntry(WgCfg, WgCfgDef)
+	cfgmgr.RegisterCfgValidator(WgCfg, cfgmgr.IntRange("WorkerExecutorCnt", 1, 64))
+	registerNodeCfg()
 }
 
+// GetWgCfg is kept up to date once cfgmgr.WatchCfg is started, with the
+// local layers on top of cfg server.
 func InitWorkgroup(cfgserver string) error {
+	RegisterCfg()
+	if err := cfgmgr.RegisterLayeredCfg(WgCfg, WgCfgDef); err != nil {
+		return err
+	}
 	if err := cfgmgr.PullCfg(cfgserver, WgCfg); err != nil {
 		return err
 	}
-	log.Info("workgroup cfg %v", WgCfg)
+	c := *WgCfg
+	wgCfg.Store(&c)
+	log.Info("workgroup cfg %+v", c)
+	cfgmgr.Subscribe(WgCfg, func(cOld, cNew interface{}) {
+		wgCfg.Store(cNew.(*WorkgroupCfg))
+	})
 	return nil
 }
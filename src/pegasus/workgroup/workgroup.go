@@ -1,7 +1,29 @@
 package workgroup
 
+import (
+	"fmt"
+)
+
+// Bump PROTO_VERSION on incompatible changes between master and worker,
+// workers with version below PROTO_MIN_VERSION are refused.
+const (
+	PROTO_VERSION     = 1
+	PROTO_MIN_VERSION = 1
+)
+
 type WorkerRegForm struct {
-	Name string
-	IP   string
-	Port int
+	Name         string
+	IP           string
+	Port         int
+	ProtoVersion int
+	// Task kind to version of the task's spec and output
+	TaskKinds map[string]int
+}
+
+func CheckProtoVersion(version int) error {
+	if version < PROTO_MIN_VERSION || version > PROTO_VERSION {
+		return fmt.Errorf("Protocol version %d not supported, expect %d to %d",
+			version, PROTO_MIN_VERSION, PROTO_VERSION)
+	}
+	return nil
 }